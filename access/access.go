@@ -0,0 +1,170 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package access
+
+import (
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgpclient"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ACL allow or deny the connections by address, denied networks take precedence
+type ACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewACL parse the allowed and denied networks, in CIDR notation or as single addresses,
+// return nil if both are empty
+func NewACL(allow, deny []string) (*ACL, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	a := &ACL{}
+	var err error
+	if a.allow, err = networks(allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = networks(deny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func networks(sources []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, source := range sources {
+		if !strings.Contains(source, "/") {
+			ip := net.ParseIP(source)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address '%s'", source)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network '%s': %s", source, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// Allowed return true if the address is allowed, a nil ACL allow everything
+func (a *ACL) Allowed(addr net.Addr) bool {
+	if a == nil {
+		return true
+	}
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return false
+		}
+		ip = net.ParseIP(host)
+	}
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, n := range a.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// listener close the connections denied by the ACL
+type listener struct {
+	net.Listener
+	acl    *ACL
+	logger *logger.Logger
+}
+
+// Listener return a listener accepting only the connections allowed by the ACL, the
+// listener itself if the ACL is nil
+func Listener(l net.Listener, acl *ACL, log *logger.Logger) net.Listener {
+	if acl == nil {
+		return l
+	}
+	return &listener{Listener: l, acl: acl, logger: log}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.acl.Allowed(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		l.logger.Warn("Connection from %s denied", conn.RemoteAddr())
+		conn.Close()
+	}
+}
+
+// IDEKeys allow the sessions by idekey, from a list or with a shared secret prefix
+type IDEKeys struct {
+	keys   map[string]bool
+	prefix string
+	logger *logger.Logger
+}
+
+// NewIDEKeys return nil if there is neither a list nor a prefix
+func NewIDEKeys(keys []string, prefix string, l *logger.Logger) *IDEKeys {
+	if len(keys) == 0 && prefix == "" {
+		return nil
+	}
+	k := &IDEKeys{keys: map[string]bool{}, prefix: prefix, logger: l}
+	for _, key := range keys {
+		k.keys[key] = true
+	}
+	return k
+}
+
+// Allowed return true if the idekey is in the list or has the prefix
+func (k *IDEKeys) Allowed(idekey string) bool {
+	return k.keys[idekey] || (k.prefix != "" && strings.HasPrefix(idekey, k.prefix))
+}
+
+// Dialer connect the allowed sessions with next, the other sessions are detached
+func (k *IDEKeys) Dialer(next xdebugproxy.DialFunc) xdebugproxy.DialFunc {
+	return func(init *dbgp.Header) (net.Conn, error) {
+		if k.Allowed(init.Attr("idekey")) {
+			return next(init)
+		}
+		k.logger.Warn("Session of %s detached, idekey '%s' not allowed", init.Attr("fileuri"), init.Attr("idekey"))
+		proxy, ide := net.Pipe()
+		go func() {
+			defer ide.Close()
+			if client, err := dbgpclient.New(ide); err == nil {
+				client.Command("detach", nil, "")
+			}
+		}()
+		return proxy, nil
+	}
+}
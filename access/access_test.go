@@ -0,0 +1,76 @@
+package access
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/stretchr/testify/assert"
+
+	"net"
+	"testing"
+)
+
+func addr(ip string) net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP(ip), Port: 41000}
+}
+
+func TestACL(t *testing.T) {
+	acl, err := NewACL([]string{"10.0.0.0/8", "192.168.1.10", "fd00::/8"}, []string{"10.0.66.0/24"})
+	assert.NoError(t, err)
+	assert.True(t, acl.Allowed(addr("10.1.2.3")))
+	assert.True(t, acl.Allowed(addr("192.168.1.10")))
+	assert.True(t, acl.Allowed(addr("fd00::1")))
+	assert.False(t, acl.Allowed(addr("10.0.66.12")))
+	assert.False(t, acl.Allowed(addr("192.168.1.11")))
+	assert.False(t, acl.Allowed(addr("8.8.8.8")))
+
+	acl, err = NewACL(nil, []string{"0.0.0.0/0"})
+	assert.NoError(t, err)
+	assert.False(t, acl.Allowed(addr("127.0.0.1")))
+	assert.True(t, acl.Allowed(addr("::1")))
+
+	acl, err = NewACL(nil, nil)
+	assert.NoError(t, err)
+	assert.True(t, acl.Allowed(addr("8.8.8.8")))
+
+	_, err = NewACL([]string{"10.0.0.0/33"}, nil)
+	assert.Error(t, err)
+	_, err = NewACL([]string{"localhost"}, nil)
+	assert.Error(t, err)
+}
+
+func TestListenerCloseTheDeniedConnections(t *testing.T) {
+	c := &config.Config{}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	acl, _ := NewACL(nil, []string{"127.0.0.0/8"})
+	l = Listener(l, acl, &logger.Logger{Config: c})
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	go l.Accept()
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
+
+func TestSessionWithoutAllowedIDEKeyIsDetached(t *testing.T) {
+	c := &config.Config{}
+	k := NewIDEKeys([]string{"PHPSTORM"}, "s3cr3t-", &logger.Logger{Config: c})
+	assert.True(t, k.Allowed("PHPSTORM"))
+	assert.True(t, k.Allowed("s3cr3t-alice"))
+	assert.False(t, k.Allowed("alice"))
+
+	dialed := false
+	conn, err := k.Dialer(func(*dbgp.Header) (net.Conn, error) {
+		dialed = true
+		return nil, nil
+	})(&dbgp.Header{Attrs: map[string]string{"idekey": "alice"}})
+	assert.NoError(t, err)
+	assert.False(t, dialed)
+
+	conn.Write(dbgp.Packet([]byte(`<init idekey="alice" fileuri="file:///var/www/index.php"></init>`)))
+	line, err := dbgp.NewReader(conn).ReadCommand()
+	assert.NoError(t, err)
+	assert.Equal(t, "detach -i 1", dbgp.ParseCommand(line).String())
+}
@@ -0,0 +1,220 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package audit
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redacted replace the secrets in the audit records
+const Redacted = "[REDACTED]"
+
+// audited are the commands running code or modifying values
+var audited = map[string]bool{
+	"eval":         true,
+	"expr":         true,
+	"exec":         true,
+	"property_set": true,
+}
+
+// Record is a line of the audit file
+type Record struct {
+	Time     time.Time `json:"time"`
+	Session  uint64    `json:"session"`
+	IDEKey   string    `json:"idekey,omitempty"`
+	Remote   string    `json:"remote,omitempty"`
+	Command  string    `json:"command"`
+	Property string    `json:"property,omitempty"`
+	// Data is the decoded expression or value
+	Data string `json:"data"`
+	// Status is ok, error or closed when the session ended before the response
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Proxy is true for the commands sent by the proxy itself, like the logpoints
+	Proxy bool `json:"proxy,omitempty"`
+}
+
+// Redactor remove the secrets of a record before it is written
+type Redactor func(r *Record)
+
+// Auditor write the commands running code or modifying values, with their result, to an
+// append only JSON Lines file
+type Auditor struct {
+	logger *logger.Logger
+	// Redact is applied to each record before it is written
+	Redact  Redactor
+	mu      sync.Mutex
+	out     io.Writer
+	pending map[uint64]map[string]*Record
+}
+
+// New open the audit file, return nil if there is no audit file
+func New(c *config.Config, l *logger.Logger) (*Auditor, error) {
+	if c.AuditFile == "" {
+		return nil, nil
+	}
+	redact, err := RedactPatterns(c.AuditRedactions)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(c.AuditFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &Auditor{logger: l, Redact: redact, out: f, pending: map[uint64]map[string]*Record{}}, nil
+}
+
+// RedactPatterns replace the matches of the regular expressions in the data, property and
+// error of a record, only the first group if the expression has groups
+func RedactPatterns(sources []string) (Redactor, error) {
+	var patterns []*regexp.Regexp
+	for _, source := range sources {
+		p, err := regexp.Compile(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redaction '%s': %s", source, err)
+		}
+		patterns = append(patterns, p)
+	}
+	return func(r *Record) {
+		for _, p := range patterns {
+			r.Data = redact(p, r.Data)
+			r.Property = redact(p, r.Property)
+			r.Error = redact(p, r.Error)
+		}
+	}, nil
+}
+
+func redact(p *regexp.Regexp, s string) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range p.FindAllStringSubmatchIndex(s, -1) {
+		start, end := m[0], m[1]
+		if len(m) > 2 && m[2] >= 0 {
+			start, end = m[2], m[3]
+		}
+		b.WriteString(s[last:start])
+		b.WriteString(Redacted)
+		last = end
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// Observe record the audited commands of the IDE, the record is written with the response
+func (a *Auditor) Observe(s *xdebugproxy.Session, m *xdebugproxy.Message) {
+	if m.Direction == xdebugproxy.ToEngine {
+		if audited[m.Command.Name] {
+			a.record(s, m.Command, false)
+		}
+		return
+	}
+	a.respond(s, m)
+}
+
+// ObserveEngine record the audited commands sent by the proxy, the commands of the IDE are
+// already recorded as sent by the IDE, and the responses of the engine
+func (a *Auditor) ObserveEngine(s *xdebugproxy.Session, m *xdebugproxy.Message) {
+	if m.Direction == xdebugproxy.ToEngine {
+		if audited[m.Command.Name] {
+			a.record(s, m.Command, true)
+		}
+		return
+	}
+	a.respond(s, m)
+}
+
+// respond write the record of a response, if any
+func (a *Auditor) respond(s *xdebugproxy.Session, m *xdebugproxy.Message) {
+	h, err := m.Header()
+	if err != nil || h.Element != "response" {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	r, ok := a.pending[s.ID][h.TransactionID()]
+	if !ok {
+		return
+	}
+	delete(a.pending[s.ID], h.TransactionID())
+	r.Status = "ok"
+	if h.Attr("success") == "0" {
+		r.Status = "error"
+	}
+	if doc, err := dbgp.ParseDocument(m.Data()); err == nil {
+		if e := doc.Root.Child("error"); e != nil {
+			r.Status = "error"
+			r.Error = "error " + e.Attr("code")
+			if msg := e.Child("message"); msg != nil {
+				if text, err := msg.Value(); err == nil && strings.TrimSpace(text) != "" {
+					r.Error += ": " + strings.TrimSpace(text)
+				}
+			}
+		}
+	}
+	a.write(r)
+}
+
+// record an audited command, a command of the proxy is recorded only if it is not a
+// command of the IDE already recorded
+func (a *Auditor) record(s *xdebugproxy.Session, c *dbgp.Command, proxy bool) {
+	r := &Record{Time: time.Now(), Session: s.ID, IDEKey: s.IDEKey(), Command: c.Name, Proxy: proxy}
+	if addr := s.EngineAddr(); addr != nil {
+		r.Remote = addr.String()
+	}
+	r.Property, _ = c.Get("n")
+	data, err := base64.StdEncoding.DecodeString(c.Data)
+	if err != nil {
+		data = []byte(c.Data)
+	}
+	r.Data = string(data)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.pending[s.ID] == nil {
+		a.pending[s.ID] = map[string]*Record{}
+	}
+	if _, ok := a.pending[s.ID][c.TransactionID()]; ok && proxy {
+		return
+	}
+	a.pending[s.ID][c.TransactionID()] = r
+}
+
+// Closed write the records still waiting for a response
+func (a *Auditor) Closed(s *xdebugproxy.Session) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, r := range a.pending[s.ID] {
+		r.Status = "closed"
+		a.write(r)
+	}
+	delete(a.pending, s.ID)
+}
+
+// write a record, the lock is held
+func (a *Auditor) write(r *Record) {
+	if a.Redact != nil {
+		a.Redact(r)
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		a.logger.Warn("Unable to encode the audit record: %s", err)
+		return
+	}
+	if _, err := a.out.Write(append(line, '\n')); err != nil {
+		a.logger.Warn("Unable to write the audit record: %s", err)
+	}
+}
@@ -0,0 +1,115 @@
+package audit
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgptest"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+	"github.com/stretchr/testify/assert"
+
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func command(name, tid, args, data string) *xdebugproxy.Message {
+	return dbgptest.Command(name + " -i " + tid + args + " -- " + base64.StdEncoding.EncodeToString([]byte(data)))
+}
+
+func TestAuditedCommandsAreWrittenWithTheirResult(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	c := &config.Config{AuditFile: path, AuditRedactions: []string{`password\s*=\s*'([^']*)'`}}
+	l := dbgptest.Logger(c)
+	a, err := New(c, l)
+	assert.NoError(t, err)
+	s := dbgptest.Session(c)
+
+	a.Observe(s, dbgptest.Command("stack_get -i 1"))
+	a.Observe(s, command("eval", "2", "", "$user->login($name, password = 'secret')"))
+	a.Observe(s, command("property_set", "3", " -n $count", "42"))
+	a.Observe(s, command("eval", "4", "", "$pending"))
+	a.Observe(s, dbgptest.XML(`<response command="stack_get" transaction_id="1"></response>`))
+	a.Observe(s, dbgptest.XML(`<response command="eval" transaction_id="2"><error code="206"><message><![CDATA[error evaluating code]]></message></error></response>`))
+	a.Observe(s, dbgptest.XML(`<response command="property_set" transaction_id="3" success="1"></response>`))
+	a.Closed(s)
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 3)
+	var records []Record
+	for _, line := range lines {
+		var r Record
+		assert.NoError(t, json.Unmarshal([]byte(line), &r))
+		assert.Equal(t, s.ID, r.Session)
+		records = append(records, r)
+	}
+	assert.Equal(t, "eval", records[0].Command)
+	assert.Equal(t, "$user->login($name, password = '"+Redacted+"')", records[0].Data)
+	assert.Equal(t, "error", records[0].Status)
+	assert.Equal(t, "error 206: error evaluating code", records[0].Error)
+	assert.Equal(t, "property_set", records[1].Command)
+	assert.Equal(t, "$count", records[1].Property)
+	assert.Equal(t, "42", records[1].Data)
+	assert.Equal(t, "ok", records[1].Status)
+	assert.Equal(t, "$pending", records[2].Data)
+	assert.Equal(t, "closed", records[2].Status)
+}
+
+func TestRedactWithoutGroup(t *testing.T) {
+	redact, err := RedactPatterns([]string{`sk_live_[0-9a-z]+`})
+	assert.NoError(t, err)
+	r := &Record{Data: "$stripe->setKey('sk_live_abc123')"}
+	redact(r)
+	assert.Equal(t, "$stripe->setKey('"+Redacted+"')", r.Data)
+}
+
+func TestRedactPropertyAndError(t *testing.T) {
+	redact, err := RedactPatterns([]string{`sk_live_[0-9a-z]+`})
+	assert.NoError(t, err)
+	r := &Record{
+		Property: "$keys['sk_live_abc123']",
+		Error:    "error 206: undefined index sk_live_abc123",
+	}
+	redact(r)
+	assert.Equal(t, "$keys['"+Redacted+"']", r.Property)
+	assert.Equal(t, "error 206: undefined index "+Redacted, r.Error)
+}
+
+func TestCommandsOfTheProxyAreWritten(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	c := &config.Config{AuditFile: path}
+	a, err := New(c, dbgptest.Logger(c))
+	assert.NoError(t, err)
+	s := dbgptest.Session(c)
+
+	// the eval of the IDE is seen on both sides, it is written once
+	ide := command("eval", "2", "", "$a")
+	a.Observe(s, ide)
+	a.ObserveEngine(s, ide)
+	a.ObserveEngine(s, dbgptest.XML(`<response command="eval" transaction_id="2"></response>`))
+	a.Observe(s, dbgptest.XML(`<response command="eval" transaction_id="2"></response>`))
+
+	// the responses to the proxy are not sent to the IDE
+	a.ObserveEngine(s, command("eval", "1073741825", "", "$this->service->_activateDependency()"))
+	a.ObserveEngine(s, dbgptest.XML(`<response command="eval" transaction_id="1073741825"></response>`))
+	a.Closed(s)
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 2)
+	var records []Record
+	for _, line := range lines {
+		var r Record
+		assert.NoError(t, json.Unmarshal([]byte(line), &r))
+		records = append(records, r)
+	}
+	assert.Equal(t, "$a", records[0].Data)
+	assert.False(t, records[0].Proxy)
+	assert.Equal(t, "$this->service->_activateDependency()", records[1].Data)
+	assert.Equal(t, "ok", records[1].Status)
+	assert.True(t, records[1].Proxy)
+}
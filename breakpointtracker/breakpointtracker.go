@@ -0,0 +1,356 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package breakpointtracker
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+
+	"strconv"
+	"sync"
+)
+
+const sessionKey = "breakpointtracker"
+
+// continuations are the commands ending the initialization of a session by the IDE
+var continuations = map[string]bool{
+	"run":       true,
+	"step_into": true,
+	"step_over": true,
+	"step_out":  true,
+	"detach":    true,
+}
+
+// Breakpoint is a breakpoint set by the IDE, as the IDE know it
+type Breakpoint struct {
+	ID string
+	// Command is the breakpoint_set command sent by the IDE, before any path mapping
+	Command *dbgp.Command
+	// File and Line are the location asked by the IDE
+	File string
+	Line int
+	// response are the attributes of the breakpoint_set response of a replayed breakpoint
+	response []string
+}
+
+// Breakpoints are the breakpoints of a session, by id
+type Breakpoints struct {
+	sync.Mutex
+	byID map[string]*Breakpoint
+	// pending breakpoint_set and breakpoint_update commands, by transaction id
+	pending map[string]*dbgp.Command
+	// replayed breakpoints not claimed by the IDE yet, by key
+	replayed map[string]*Breakpoint
+	// running is true once the IDE ended the initialization of the session
+	running bool
+}
+
+// Get return a breakpoint by id
+func (b *Breakpoints) Get(id string) (*Breakpoint, bool) {
+	b.Lock()
+	defer b.Unlock()
+	bp, ok := b.byID[id]
+	return bp, ok
+}
+
+// At check if the IDE set a line breakpoint at the given path and line
+func (b *Breakpoints) At(path string, line int) bool {
+	b.Lock()
+	defer b.Unlock()
+	for _, bp := range b.byID {
+		if bp.Line == line && bp.File != "" && fileuri.ToPath(bp.File) == path {
+			return true
+		}
+	}
+	return false
+}
+
+// Tracker remember the breakpoints set by the IDE, and translate the breakpoints reported
+// by the engine back to the file the IDE asked for. It must be placed on the IDE side of
+// the path mappers, to see the commands before the mapping. Proxy classes keep the lines
+// of the original class, the line reported by the engine, maybe moved to the next
+// executable line, is kept.
+//
+// With replay enabled, the breakpoints are remembered by idekey, set again right after
+// the init packet of the next sessions, and the breakpoint_set commands of the IDE are
+// answered from the replayed breakpoints. Replayed breakpoints the IDE did not set again
+// before running the script are removed.
+type Tracker struct {
+	logger *logger.Logger
+	replay bool
+
+	mu     sync.Mutex
+	stores map[string]*store
+}
+
+// store is the breakpoints of an idekey, the breakpoint_set commands by key, in order
+type store struct {
+	keys     []string
+	commands map[string]*dbgp.Command
+}
+
+// New create a breakpoint tracker
+func New(c *config.Config, l *logger.Logger) *Tracker {
+	return &Tracker{
+		logger: l,
+		replay: c.ReplayBreakpoints,
+		stores: map[string]*store{},
+	}
+}
+
+// SessionBreakpoints return the breakpoints of the session
+func SessionBreakpoints(s *xdebugproxy.Session) *Breakpoints {
+	return s.LoadOrStore(sessionKey, &Breakpoints{
+		byID:     map[string]*Breakpoint{},
+		pending:  map[string]*dbgp.Command{},
+		replayed: map[string]*Breakpoint{},
+	}).(*Breakpoints)
+}
+
+// Process remember the breakpoint commands and translate the breakpoints of the responses
+func (t *Tracker) Process(s *xdebugproxy.Session, m *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+	b := SessionBreakpoints(s)
+	b.Lock()
+	defer b.Unlock()
+	if m.Direction == xdebugproxy.ToEngine {
+		return t.processCommand(s, b, m), nil
+	}
+	h, err := m.Header()
+	if err != nil {
+		return nil, err
+	}
+	if h.Element == "init" && t.replay {
+		return append([]*xdebugproxy.Message{m}, t.replayBreakpoints(s, b)...), nil
+	}
+	if c, ok := b.pending[h.TransactionID()]; ok && h.Element == "response" {
+		delete(b.pending, h.TransactionID())
+		t.track(s, b, c, h)
+	}
+	if len(b.byID) == 0 {
+		return []*xdebugproxy.Message{m}, nil
+	}
+	switch h.Command() {
+	case "breakpoint_list", "breakpoint_get", "breakpoint_update", "breakpoint_set", "breakpoint_remove":
+	default:
+		if h.Element != "notify" {
+			return []*xdebugproxy.Message{m}, nil
+		}
+	}
+	doc, err := dbgp.ParseDocument(m.Data())
+	if err != nil {
+		return nil, err
+	}
+	changed := false
+	for _, n := range doc.Root.Find("breakpoint") {
+		if t.translate(b, n) {
+			changed = true
+		}
+	}
+	if changed {
+		m.SetData(doc.Bytes())
+	}
+	return []*xdebugproxy.Message{m}, nil
+}
+
+func (t *Tracker) processCommand(s *xdebugproxy.Session, b *Breakpoints, m *xdebugproxy.Message) []*xdebugproxy.Message {
+	c := m.Command
+	switch c.Name {
+	case "breakpoint_set":
+		if bp, ok := b.replayed[key(c)]; ok {
+			// already set by the replay, answer with the id of the engine
+			delete(b.replayed, key(c))
+			s.Logger.Log(logger.LevelDebug, "Breakpoint set from the replay", logger.F("breakpoint", bp.ID))
+			attrs := append([]string{"id", bp.ID}, bp.response...)
+			return []*xdebugproxy.Message{xdebugproxy.NewXMLMessage(dbgp.NewResponse(c.Name, c.TransactionID(), attrs, ""))}
+		}
+		b.pending[c.TransactionID()] = c.Clone()
+	case "breakpoint_update":
+		b.pending[c.TransactionID()] = c.Clone()
+	case "breakpoint_remove":
+		if bp, ok := b.byID[argument(c, "d")]; ok {
+			delete(b.byID, bp.ID)
+			t.forget(s.IDEKey(), bp.Command)
+		}
+	}
+	if b.running || !continuations[c.Name] {
+		return []*xdebugproxy.Message{m}
+	}
+	b.running = true
+	// the IDE does not know the remaining replayed breakpoints
+	var messages []*xdebugproxy.Message
+	for k, bp := range b.replayed {
+		delete(b.replayed, k)
+		delete(b.byID, bp.ID)
+		t.forget(s.IDEKey(), bp.Command)
+		s.Logger.Log(logger.LevelDebug, "Remove replayed breakpoint, unknown by the IDE", logger.F("breakpoint", bp.ID))
+		remove := dbgp.NewCommand("breakpoint_remove", "")
+		remove.Set("d", bp.ID)
+		messages = append(messages, s.Request(remove, drop))
+	}
+	return append(messages, m)
+}
+
+// replayBreakpoints set the breakpoints remembered for the idekey of the session
+func (t *Tracker) replayBreakpoints(s *xdebugproxy.Session, b *Breakpoints) []*xdebugproxy.Message {
+	idekey := s.IDEKey()
+	if idekey == "" {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.stores[idekey]
+	if !ok {
+		return nil
+	}
+	var messages []*xdebugproxy.Message
+	for _, k := range st.keys {
+		c := st.commands[k]
+		request := s.Request(c.Clone(), t.replayed(b, c))
+		// the path mappers must process the command of the IDE
+		request.Chain = true
+		messages = append(messages, request)
+	}
+	s.Logger.Log(logger.LevelDebug, "Replay breakpoints", logger.F("idekey", idekey), logger.F("breakpoints", len(messages)))
+	return messages
+}
+
+// replayed remember the breakpoint set by the replay, the response is not sent to the IDE
+func (t *Tracker) replayed(b *Breakpoints, c *dbgp.Command) xdebugproxy.ResponseFunc {
+	return func(s *xdebugproxy.Session, response *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+		h, err := response.Header()
+		if err != nil {
+			return nil, err
+		}
+		b.Lock()
+		defer b.Unlock()
+		id := h.Attr("id")
+		if id == "" || b.running {
+			t.forget(s.IDEKey(), c)
+			if id != "" {
+				remove := dbgp.NewCommand("breakpoint_remove", "")
+				remove.Set("d", id)
+				return []*xdebugproxy.Message{s.Request(remove, drop)}, nil
+			}
+			return nil, nil
+		}
+		bp := newBreakpoint(id, c)
+		for _, name := range []string{"state", "resolved"} {
+			if v, ok := h.Attrs[name]; ok {
+				bp.response = append(bp.response, name, v)
+			}
+		}
+		b.byID[id] = bp
+		b.replayed[key(c)] = bp
+		return nil, nil
+	}
+}
+
+// track the breakpoint set or updated by a successful command
+func (t *Tracker) track(s *xdebugproxy.Session, b *Breakpoints, c *dbgp.Command, h *dbgp.Header) {
+	if h.Attr("success") == "0" {
+		return
+	}
+	if c.Name == "breakpoint_update" {
+		bp, ok := b.byID[argument(c, "d")]
+		if !ok {
+			return
+		}
+		updated := bp.Command.Clone()
+		for _, flag := range []string{"s", "n", "h", "o"} {
+			if v, ok := c.Get(flag); ok {
+				updated.Set(flag, v)
+			}
+		}
+		t.forget(s.IDEKey(), bp.Command)
+		*bp = *newBreakpoint(bp.ID, updated)
+		t.remember(s.IDEKey(), updated)
+		return
+	}
+	id := h.Attr("id")
+	if id == "" {
+		return
+	}
+	b.byID[id] = newBreakpoint(id, c)
+	t.remember(s.IDEKey(), c)
+	s.Logger.Log(logger.LevelDebug, "Track breakpoint", logger.F("breakpoint", id), logger.F("command", c))
+}
+
+// remember a breakpoint for the next sessions of the idekey
+func (t *Tracker) remember(idekey string, c *dbgp.Command) {
+	if !t.replay || idekey == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.stores[idekey]
+	if !ok {
+		st = &store{commands: map[string]*dbgp.Command{}}
+		t.stores[idekey] = st
+	}
+	k := key(c)
+	if _, ok := st.commands[k]; !ok {
+		st.keys = append(st.keys, k)
+	}
+	st.commands[k] = c
+}
+
+// forget a breakpoint removed by the IDE
+func (t *Tracker) forget(idekey string, c *dbgp.Command) {
+	if !t.replay || idekey == "" {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.stores[idekey]
+	if !ok {
+		return
+	}
+	k := key(c)
+	delete(st.commands, k)
+	for i, v := range st.keys {
+		if v == k {
+			st.keys = append(st.keys[:i], st.keys[i+1:]...)
+			break
+		}
+	}
+}
+
+// translate a breakpoint element, return true if it changed
+func (t *Tracker) translate(b *Breakpoints, n *dbgp.Node) bool {
+	bp, ok := b.byID[n.Attr("id")]
+	if !ok || bp.File == "" {
+		return false
+	}
+	changed := false
+	if f, ok := n.LookupAttr("filename"); ok && f != bp.File {
+		n.SetAttr("filename", bp.File)
+		changed = true
+	}
+	return changed
+}
+
+func newBreakpoint(id string, c *dbgp.Command) *Breakpoint {
+	line, _ := strconv.Atoi(argument(c, "n"))
+	return &Breakpoint{ID: id, Command: c, File: argument(c, "f"), Line: line}
+}
+
+// key identify a breakpoint_set command, without its transaction id
+func key(c *dbgp.Command) string {
+	k := c.Clone()
+	k.Del("i")
+	return k.String()
+}
+
+func drop(s *xdebugproxy.Session, response *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+	return nil, nil
+}
+
+func argument(c *dbgp.Command, flag string) string {
+	v, _ := c.Get(flag)
+	return v
+}
@@ -0,0 +1,95 @@
+package breakpointtracker
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgptest"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const ideFile = "file:///home/dev/project/Packages/Application/Acme.Demo/Classes/Service.php"
+
+func newSession() (*Tracker, *xdebugproxy.Session) {
+	c := &config.Config{}
+	return New(c, dbgptest.Logger(c)), dbgptest.Session(c)
+}
+
+func TestTranslateBreakpointListToTheFileOfTheIDE(t *testing.T) {
+	tr, s := newSession()
+	dbgptest.ProcessOne(t, tr, s, dbgptest.Command("breakpoint_set -i 3 -t line -f "+ideFile+" -n 20"))
+	dbgptest.ProcessOne(t, tr, s, dbgptest.XML(`<response command="breakpoint_set" transaction_id="3" state="enabled" id="1230001"></response>`))
+
+	bp, ok := SessionBreakpoints(s).Get("1230001")
+	assert.True(t, ok)
+	assert.Equal(t, 20, bp.Line)
+
+	out := dbgptest.ProcessOne(t, tr, s, dbgptest.XML(`<response command="breakpoint_list" transaction_id="4">`+
+		`<breakpoint type="line" filename="file:///var/www/Packages/Application/Acme.Demo/Classes/Service.php" lineno="21" state="enabled" hit_count="0" hit_value="0" id="1230001"></breakpoint>`+
+		`<breakpoint type="exception" exception="Exception" state="enabled" hit_count="0" hit_value="0" id="1230002"></breakpoint>`+
+		`</response>`))
+	doc, err := dbgp.ParseDocument(out.Data())
+	assert.NoError(t, err)
+	breakpoints := doc.Root.Find("breakpoint")
+	assert.Equal(t, ideFile, breakpoints[0].Attr("filename"))
+	assert.Equal(t, "21", breakpoints[0].Attr("lineno"))
+	_, ok = breakpoints[1].LookupAttr("filename")
+	assert.False(t, ok)
+
+	dbgptest.ProcessOne(t, tr, s, dbgptest.Command("breakpoint_remove -i 5 -d 1230001"))
+	_, ok = SessionBreakpoints(s).Get("1230001")
+	assert.False(t, ok)
+}
+
+func TestReplayBreakpointsOfTheIDEKey(t *testing.T) {
+	c := &config.Config{ReplayBreakpoints: true}
+	tr := New(c, dbgptest.Logger(c))
+	init := `<init appid="1" idekey="PHPSTORM" language="PHP" protocol_version="1.0"></init>`
+
+	// first session, the IDE set two breakpoints
+	s := dbgptest.Session(c)
+	s.Track(dbgptest.XML(init))
+	dbgptest.ProcessOne(t, tr, s, dbgptest.XML(init))
+	dbgptest.ProcessOne(t, tr, s, dbgptest.Command("breakpoint_set -i 2 -t line -f "+ideFile+" -n 20"))
+	dbgptest.ProcessOne(t, tr, s, dbgptest.XML(`<response command="breakpoint_set" transaction_id="2" state="enabled" id="10"></response>`))
+	dbgptest.ProcessOne(t, tr, s, dbgptest.Command("breakpoint_set -i 3 -t exception -x Exception"))
+	dbgptest.ProcessOne(t, tr, s, dbgptest.XML(`<response command="breakpoint_set" transaction_id="3" state="enabled" id="11"></response>`))
+
+	// next session, the breakpoints are set after the init
+	s = dbgptest.Session(c)
+	s.Track(dbgptest.XML(init))
+	out, err := tr.Process(s, dbgptest.XML(init))
+	assert.NoError(t, err)
+	assert.Len(t, out, 3)
+	assert.Equal(t, xdebugproxy.ToIDE, out[0].Direction)
+	assert.True(t, out[1].Chain)
+	assert.Equal(t, "breakpoint_set -i "+out[1].TransactionID()+" -t line -f "+ideFile+" -n 20", out[1].Command.String())
+
+	for i, id := range []string{"20", "21"} {
+		r := `<response command="breakpoint_set" transaction_id="` + out[i+1].TransactionID() + `" state="enabled" id="` + id + `"></response>`
+		assert.Empty(t, dbgptest.Respond(t, s, r))
+	}
+
+	// the IDE set the line breakpoint again, the proxy answer with the replayed id
+	answer := dbgptest.ProcessOne(t, tr, s, dbgptest.Command("breakpoint_set -i 2 -t line -f "+ideFile+" -n 20"))
+	assert.Equal(t, xdebugproxy.ToIDE, answer.Direction)
+	h, err := answer.Header()
+	assert.NoError(t, err)
+	assert.Equal(t, "2", h.TransactionID())
+	assert.Equal(t, "20", h.Attr("id"))
+	assert.Equal(t, "enabled", h.Attr("state"))
+
+	// the exception breakpoint was removed in the IDE meanwhile
+	out, err = tr.Process(s, dbgptest.Command("run -i 3"))
+	assert.NoError(t, err)
+	assert.Len(t, out, 2)
+	assert.Equal(t, "breakpoint_remove -i "+out[0].TransactionID()+" -d 21", out[0].Command.String())
+	assert.Equal(t, "run", out[1].Command.Name)
+
+	s = dbgptest.Session(c)
+	s.Track(dbgptest.XML(init))
+	out, err = tr.Process(s, dbgptest.XML(init))
+	assert.NoError(t, err)
+	assert.Len(t, out, 2)
+}
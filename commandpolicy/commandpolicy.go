@@ -0,0 +1,313 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package commandpolicy
+
+import (
+	"github.com/dfeyer/flow-debugproxy/access"
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/logpoint"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+
+	"encoding/base64"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	sessionKey    = "commandpolicy"
+	uriExpression = "isset($_SERVER['REQUEST_URI']) ? $_SERVER['REQUEST_URI'] : ''"
+)
+
+// features are the features a policy can cap, with the argument capping the same
+// value in a single command
+var features = map[string]string{
+	"max_data":     "m",
+	"max_depth":    "",
+	"max_children": "",
+}
+
+// expressions are the commands running code in the engine, blocked with eval, the
+// logpoints of the IDE evaluate their template on each hit
+var expressions = map[string]bool{
+	"eval":              true,
+	"expr":              true,
+	"exec":              true,
+	logpoint.SetCommand: true,
+}
+
+// Policy block or allow the commands of the sessions it match
+type Policy struct {
+	source string
+	idekey *regexp.Regexp
+	file   *regexp.Regexp
+	uri    *regexp.Regexp
+	remote *access.ACL
+	// allow is nil if every command not denied is allowed
+	allow map[string]bool
+	deny  map[string]bool
+	caps  map[string]int
+}
+
+// Enforcer apply the first policy matching each session, it is placed at the IDE end of
+// the chain so the commands of the proxy are not blocked
+type Enforcer struct {
+	logger   *logger.Logger
+	policies []*Policy
+	// evaluate is true if a policy match the request URI, evaluated in the engine
+	evaluate bool
+}
+
+// state is the policy of a session, the commands are held until it is known
+type state struct {
+	sync.Mutex
+	decided bool
+	policy  *Policy
+	held    []*xdebugproxy.Message
+}
+
+// New create the enforcer, return nil if there is no policy
+func New(c *config.Config, l *logger.Logger) (*Enforcer, error) {
+	if len(c.Policies) == 0 {
+		return nil, nil
+	}
+	e := &Enforcer{logger: l}
+	for _, source := range c.Policies {
+		p, err := Parse(source)
+		if err != nil {
+			return nil, err
+		}
+		if p.uri != nil {
+			e.evaluate = true
+		}
+		e.policies = append(e.policies, p)
+	}
+	return e, nil
+}
+
+// Parse a policy, as space separated key:value:
+//
+//	idekey:regexp, file:regexp, uri:regexp   the sessions of the policy, all by default
+//	remote:network                           the sessions from this address or CIDR network
+//	allow:cmd,cmd                            allow only these commands
+//	deny:cmd,cmd                             block these commands, and any expression with eval
+//	max_data:n, max_depth:n, max_children:n  cap the feature
+func Parse(source string) (*Policy, error) {
+	p := &Policy{source: source, caps: map[string]int{}}
+	for _, field := range strings.Fields(source) {
+		parts := strings.SplitN(field, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid policy '%s', expected key:value in '%s'", source, field)
+		}
+		key, value := parts[0], parts[1]
+		var err error
+		switch key {
+		case "idekey":
+			p.idekey, err = regexp.Compile(value)
+		case "file":
+			p.file, err = regexp.Compile(value)
+		case "uri":
+			p.uri, err = regexp.Compile(value)
+		case "remote":
+			p.remote, err = access.NewACL([]string{value}, nil)
+		case "allow":
+			p.allow = commands(value)
+		case "deny":
+			p.deny = commands(value)
+		default:
+			if _, ok := features[key]; !ok {
+				return nil, fmt.Errorf("invalid policy '%s', unknown key %s", source, key)
+			}
+			if p.caps[key], err = strconv.Atoi(value); err == nil && p.caps[key] < 1 {
+				err = fmt.Errorf("expected a positive number")
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy '%s', %s: %s", source, key, err)
+		}
+	}
+	return p, nil
+}
+
+func commands(list string) map[string]bool {
+	m := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		if name != "" {
+			m[name] = true
+		}
+	}
+	return m
+}
+
+// matches return true if the policy apply to a session, uri is ignored if not evaluated
+func (p *Policy) matches(remote net.Addr, idekey, file, uri string) bool {
+	return (p.remote == nil || (remote != nil && p.remote.Allowed(remote))) &&
+		(p.idekey == nil || p.idekey.MatchString(idekey)) &&
+		(p.file == nil || p.file.MatchString(file)) &&
+		(p.uri == nil || p.uri.MatchString(uri))
+}
+
+// blocked return true if the command is not allowed, the commands carrying an expression
+// are blocked with eval
+func (p *Policy) blocked(c *dbgp.Command) bool {
+	return p.denied(c.Name) || (p.denied("eval") && evaluates(c))
+}
+
+func (p *Policy) denied(name string) bool {
+	if p.deny[name] {
+		return true
+	}
+	return p.allow != nil && !p.allow[name]
+}
+
+// evaluates return true if the command run an expression in the engine, the conditional
+// and watch breakpoints evaluate theirs on each hit
+func evaluates(c *dbgp.Command) bool {
+	if expressions[c.Name] {
+		return true
+	}
+	if c.Name != "breakpoint_set" {
+		return false
+	}
+	t, _ := c.Get("t")
+	return t == "conditional" || t == "watch" || c.Data != ""
+}
+
+// Blocked return true if the policy of the session block a command of the proxy, the
+// processors emitting commands behind the enforcer check theirs, they are blocked until
+// the policy is known
+func Blocked(s *xdebugproxy.Session, c *dbgp.Command) bool {
+	st, ok := s.Value(sessionKey).(*state)
+	if !ok {
+		return false
+	}
+	st.Lock()
+	defer st.Unlock()
+	return !st.decided || (st.policy != nil && st.policy.blocked(c))
+}
+
+// Process select the policy of the session on init and apply it to the commands
+func (e *Enforcer) Process(s *xdebugproxy.Session, m *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+	st := s.LoadOrStore(sessionKey, &state{}).(*state)
+	if m.Direction == xdebugproxy.ToEngine {
+		st.Lock()
+		defer st.Unlock()
+		if !st.decided {
+			st.held = append(st.held, m)
+			return nil, nil
+		}
+		return e.apply(s, st.policy, m), nil
+	}
+	h, err := m.Header()
+	if err != nil || h.Element != "init" {
+		return []*xdebugproxy.Message{m}, err
+	}
+	idekey, file := h.Attr("idekey"), fileuri.ToPath(h.Attr("fileuri"))
+	if !e.evaluate {
+		st.Lock()
+		defer st.Unlock()
+		return append([]*xdebugproxy.Message{m}, e.decide(s, st, e.match(s.EngineAddr(), idekey, file, ""))...), nil
+	}
+	eval := dbgp.NewCommand("eval", "")
+	eval.Data = base64.StdEncoding.EncodeToString([]byte(uriExpression))
+	request := s.Request(eval, func(s *xdebugproxy.Session, response *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+		uri := ""
+		if doc, err := dbgp.ParseDocument(response.Data()); err == nil {
+			if p := doc.Root.Child("property"); p != nil {
+				uri, _ = p.Value()
+			}
+		}
+		st.Lock()
+		defer st.Unlock()
+		messages := e.decide(s, st, e.match(s.EngineAddr(), idekey, file, uri))
+		for _, held := range st.held {
+			held.Chain = true
+			messages = append(messages, held)
+		}
+		st.held = nil
+		return messages, nil
+	})
+	return []*xdebugproxy.Message{m, request}, nil
+}
+
+func (e *Enforcer) match(remote net.Addr, idekey, file, uri string) *Policy {
+	for _, p := range e.policies {
+		if p.matches(remote, idekey, file, uri) {
+			return p
+		}
+	}
+	return nil
+}
+
+// decide record the policy of the session and cap its features in the engine
+func (e *Enforcer) decide(s *xdebugproxy.Session, st *state, p *Policy) []*xdebugproxy.Message {
+	st.decided, st.policy = true, p
+	if p == nil {
+		return nil
+	}
+	s.Logger.Log(logger.LevelDebug, "Policy selected", logger.F("policy", p.source))
+	names := make([]string, 0, len(p.caps))
+	for name := range p.caps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var messages []*xdebugproxy.Message
+	for _, name := range names {
+		c := dbgp.NewCommand("feature_set", "")
+		c.Set("n", name)
+		c.Set("v", strconv.Itoa(p.caps[name]))
+		messages = append(messages, s.Request(c, drop))
+	}
+	return messages
+}
+
+// apply the policy to a command of the IDE, a blocked command is answered with an error
+func (e *Enforcer) apply(s *xdebugproxy.Session, p *Policy, m *xdebugproxy.Message) []*xdebugproxy.Message {
+	if p == nil {
+		return []*xdebugproxy.Message{m}
+	}
+	c := m.Command
+	if p.blocked(c) {
+		s.Logger.Log(logger.LevelWarn, "Command blocked by the policy", logger.F("command", c.Name), logger.F("transaction_id", c.TransactionID()), logger.F("idekey", s.IDEKey()), logger.F("policy", p.source))
+		response := dbgp.NewErrorResponse(c.Name, c.TransactionID(), dbgp.ErrorCommandNotAvailable, "command blocked by the proxy policy")
+		return []*xdebugproxy.Message{xdebugproxy.NewXMLMessage(response)}
+	}
+	if c.Name == "feature_set" {
+		name, _ := c.Get("n")
+		if max, ok := p.caps[name]; ok {
+			e.cap(s, p, c, "v", max)
+		}
+	}
+	for name, arg := range features {
+		if max, ok := p.caps[name]; ok && arg != "" && (c.Name == "property_get" || c.Name == "property_value") {
+			e.cap(s, p, c, arg, max)
+		}
+	}
+	return []*xdebugproxy.Message{m}
+}
+
+// cap the value of an argument, 0 is unlimited for the engine and is capped too
+func (e *Enforcer) cap(s *xdebugproxy.Session, p *Policy, c *dbgp.Command, arg string, max int) {
+	v, ok := c.Get(arg)
+	if !ok {
+		return
+	}
+	if n, err := strconv.Atoi(v); err == nil && n != 0 && n <= max {
+		return
+	}
+	s.Logger.Log(logger.LevelWarn, "Command capped by the policy", logger.F("command", c.Name), logger.F("transaction_id", c.TransactionID()), logger.F("value", v), logger.F("max", max), logger.F("policy", p.source))
+	c.Set(arg, strconv.Itoa(max))
+}
+
+func drop(s *xdebugproxy.Session, response *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+	return nil, nil
+}
@@ -0,0 +1,122 @@
+package commandpolicy
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgptest"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+	"github.com/stretchr/testify/assert"
+
+	"encoding/base64"
+	"net"
+	"testing"
+)
+
+const initPacket = `<init idekey="guest-1" fileuri="file:///var/www/index.php"></init>`
+
+func newSession(t *testing.T, policies ...string) (*Enforcer, *xdebugproxy.Session) {
+	c := &config.Config{Policies: policies}
+	e, err := New(c, dbgptest.Logger(c))
+	assert.NoError(t, err)
+	return e, dbgptest.Session(c)
+}
+
+func TestDeniedCommandIsAnsweredWithAnError(t *testing.T) {
+	e, s := newSession(t, "idekey:^admin$", "idekey:^guest- deny:eval,property_set max_depth:2")
+	out := dbgptest.Process(t, e, s, dbgptest.XML(initPacket))
+	assert.Len(t, out, 2)
+	assert.Equal(t, "feature_set", out[1].Command.Name)
+	v, _ := out[1].Command.Get("v")
+	assert.Equal(t, "2", v)
+
+	out = dbgptest.Process(t, e, s, dbgptest.Command("eval -i 3 -- JGE="))
+	assert.Len(t, out, 1)
+	assert.Equal(t, xdebugproxy.ToIDE, out[0].Direction)
+	doc, err := dbgp.ParseDocument(out[0].Data())
+	assert.NoError(t, err)
+	assert.Equal(t, "3", doc.Root.Attr("transaction_id"))
+	assert.Equal(t, "5", doc.Root.Child("error").Attr("code"))
+
+	out = dbgptest.Process(t, e, s, dbgptest.Command("feature_set -i 4 -n max_depth -v 10"))
+	assert.Equal(t, "feature_set -i 4 -n max_depth -v 2", out[0].Command.String())
+	out = dbgptest.Process(t, e, s, dbgptest.Command("stack_get -i 5"))
+	assert.Equal(t, xdebugproxy.ToEngine, out[0].Direction)
+}
+
+func TestExpressionsAreBlockedWithEval(t *testing.T) {
+	e, s := newSession(t, "deny:eval")
+	dbgptest.Process(t, e, s, dbgptest.XML(initPacket))
+
+	for _, line := range []string{
+		"breakpoint_set -i 3 -t conditional -f file:///var/www/index.php -n 3 -- " + base64.StdEncoding.EncodeToString([]byte("system('id') || true")),
+		"breakpoint_set -i 4 -t watch -- JGE=",
+		"expr -i 5 -- JGE=",
+		"exec -i 6 -- JGE=",
+		"proxy_logpoint_set -i 8 -f file:///var/www/index.php -n 3 -- " + base64.StdEncoding.EncodeToString([]byte("{system('id')}")),
+	} {
+		out := dbgptest.ProcessOne(t, e, s, dbgptest.Command(line))
+		assert.Equal(t, xdebugproxy.ToIDE, out.Direction, line)
+		doc, err := dbgp.ParseDocument(out.Data())
+		assert.NoError(t, err)
+		assert.Equal(t, "5", doc.Root.Child("error").Attr("code"))
+	}
+
+	out := dbgptest.ProcessOne(t, e, s, dbgptest.Command("breakpoint_set -i 7 -t line -f file:///var/www/index.php -n 3"))
+	assert.Equal(t, xdebugproxy.ToEngine, out.Direction)
+}
+
+func TestCommandsAreHeldUntilTheURIIsKnown(t *testing.T) {
+	e, s := newSession(t, "uri:^/admin allow:run,detach")
+	out := dbgptest.Process(t, e, s, dbgptest.XML(initPacket))
+	assert.Len(t, out, 2)
+	eval := out[1]
+	assert.Empty(t, dbgptest.Process(t, e, s, dbgptest.Command("context_get -i 1")))
+	assert.Empty(t, dbgptest.Process(t, e, s, dbgptest.Command("run -i 2")))
+
+	response := `<response command="eval" transaction_id="` + eval.TransactionID() + `">` +
+		`<property type="string" encoding="base64"><![CDATA[` + base64.StdEncoding.EncodeToString([]byte("/admin/users")) + `]]></property></response>`
+	held := dbgptest.Respond(t, s, response)
+	assert.Len(t, held, 2)
+	assert.True(t, held[0].Chain)
+
+	// the held commands run through the chain again
+	out = dbgptest.Process(t, e, s, held[0])
+	assert.Equal(t, xdebugproxy.ToIDE, out[0].Direction)
+	out = dbgptest.Process(t, e, s, held[1])
+	assert.Equal(t, "run", out[0].Command.Name)
+}
+
+func TestInvalidPolicies(t *testing.T) {
+	for _, source := range []string{"deny", "idekey:(", "max_depth:-1", "color:red"} {
+		_, err := Parse(source)
+		assert.Error(t, err, source)
+	}
+}
+
+// remoteConn is an engine connection from a given address
+type remoteConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+func TestPolicyByRemoteAddress(t *testing.T) {
+	c := &config.Config{Policies: []string{"remote:10.0.0.0/8 deny:eval"}}
+	l := dbgptest.Logger(c)
+	e, err := New(c, l)
+	assert.NoError(t, err)
+
+	for addr, blocked := range map[string]bool{"10.1.2.3": true, "192.168.1.10": false} {
+		engine := &remoteConn{addr: &net.TCPAddr{IP: net.ParseIP(addr), Port: 41000}}
+		s := xdebugproxy.NewSession(engine, nil, c, l)
+		dbgptest.Process(t, e, s, dbgptest.XML(initPacket))
+		out := dbgptest.Process(t, e, s, dbgptest.Command("eval -i 3 -- JGE="))
+		assert.Equal(t, blocked, out[0].Direction == xdebugproxy.ToIDE, addr)
+	}
+
+	_, err = Parse("remote:10.0.0.0/33")
+	assert.Error(t, err)
+}
@@ -4,12 +4,64 @@
 
 package config
 
+import "time"
+
 // Config store the proxy configuration
 type Config struct {
-	Context     string
-	Framework   string
-	LocalRoot   string
-	Verbose     bool
-	VeryVerbose bool
-	Debug       bool
+	Context                  string
+	Framework                string
+	LocalRoot                string
+	EngineOS                 string
+	IDEOS                    string
+	PathPrefixes             []PathPrefix
+	MapPayloads              bool
+	HideFrames               bool
+	FramePatterns            []string
+	JustMyCode               bool
+	LibraryPatterns          []string
+	StepLimit                int
+	HideInjectedProperties   bool
+	HiddenProperties         []string
+	ResolveDependencyProxies bool
+	ReplayBreakpoints        bool
+	Logpoints                []string
+	LogpointFile             string
+	Headless                 bool
+	CaptureExceptions        []string
+	CaptureDepth             int
+	ReportDir                string
+	ReportFormat             string
+	Scripts                  []string
+	SessionIncludes          []string
+	SessionExcludes          []string
+	Park                     bool
+	ParkTimeout              time.Duration
+	ObserverAddress          string
+	Policies                 []string
+	AuditFile                string
+	AuditRedactions          []string
+	EngineAllow              []string
+	EngineDeny               []string
+	ControlAllow             []string
+	ControlDeny              []string
+	ControlToken             string
+	IDEKeys                  []string
+	IDEKeyPrefix             string
+	ProxyProtocol            bool
+	ProxyProtocolFrom        []string
+	MaxPacketSize            int
+	LogLevel                 string
+	LogFormat                string
+	LogFile                  string
+	LogMaxSize               int
+	LogMaxBackups            int
+	Verbose                  bool
+	VeryVerbose              bool
+	Debug                    bool
+}
+
+// PathPrefix map a directory seen by the debugger engine to the same directory seen by the IDE
+type PathPrefix struct {
+	Engine string
+	IDE    string
 }
@@ -0,0 +1,193 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package crashcapture
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgpclient"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/logger"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultExceptions break on every exception
+var DefaultExceptions = []string{"*"}
+
+var lastReportID uint64
+
+// Capture act as the IDE of each session in headless mode: it break on exceptions,
+// write a report of the stack and the local variables, and detach
+type Capture struct {
+	config *config.Config
+	logger *logger.Logger
+}
+
+// Report is the state of the script when the exception was thrown
+type Report struct {
+	Time      time.Time `json:"time"`
+	IDEKey    string    `json:"idekey,omitempty"`
+	Script    string    `json:"script,omitempty"`
+	Exception string    `json:"exception"`
+	Message   string    `json:"message,omitempty"`
+	File      string    `json:"file"`
+	Line      int       `json:"line"`
+	Frames    []*Frame  `json:"frames"`
+}
+
+// Frame is a stack frame with its local variables
+type Frame struct {
+	dbgpclient.Frame
+	Locals []*dbgpclient.Variable `json:"locals,omitempty"`
+	Error  string                 `json:"error,omitempty"`
+}
+
+// New create the headless capture, return nil if the headless mode is disabled
+func New(c *config.Config, l *logger.Logger) (*Capture, error) {
+	if !c.Headless {
+		return nil, nil
+	}
+	if c.ReportFormat != "" && c.ReportFormat != "json" && c.ReportFormat != "text" {
+		return nil, errors.New("invalid report format " + c.ReportFormat + ", expected json or text")
+	}
+	return &Capture{config: c, logger: l}, nil
+}
+
+// DialIDE return the IDE end of an in memory connection, the capture run on the other end
+func (c *Capture) DialIDE(init *dbgp.Header) (net.Conn, error) {
+	proxy, ide := net.Pipe()
+	go func() {
+		defer ide.Close()
+		if err := c.run(ide); err != nil && err != io.EOF {
+			c.logger.Warn("Crash capture failed: %s", err)
+		}
+	}()
+	return proxy, nil
+}
+
+func (c *Capture) run(conn net.Conn) error {
+	client, err := dbgpclient.New(conn)
+	if err != nil {
+		return err
+	}
+	depth := c.config.CaptureDepth
+	if depth < 1 {
+		depth = 1
+	}
+	if _, err := client.Command("feature_set", []string{"n", "max_depth", "v", strconv.Itoa(depth)}, ""); err != nil {
+		return err
+	}
+	exceptions := c.config.CaptureExceptions
+	if len(exceptions) == 0 {
+		exceptions = DefaultExceptions
+	}
+	for _, exception := range exceptions {
+		if _, err := client.Command("breakpoint_set", []string{"t", "exception", "x", exception}, ""); err != nil {
+			return err
+		}
+	}
+	status, err := client.Continue("run")
+	if err != nil {
+		return err
+	}
+	if status.Status == "break" {
+		report := c.capture(client, status)
+		path, err := c.write(report)
+		if err != nil {
+			return err
+		}
+		c.logger.Info("Crash report of %s written to %s", report.Exception, path)
+	}
+	_, err = client.Command("detach", nil, "")
+	return err
+}
+
+// capture the stack and the local variables, a frame without locals keep the error
+func (c *Capture) capture(client *dbgpclient.Client, status *dbgpclient.Status) *Report {
+	report := &Report{
+		Time:      time.Now(),
+		IDEKey:    client.Init.Root.Attr("idekey"),
+		Script:    fileuri.ToPath(client.Init.Root.Attr("fileuri")),
+		Exception: status.Exception,
+		Message:   status.Message,
+		File:      fileuri.ToPath(status.File),
+		Line:      status.Line,
+	}
+	frames, err := client.Stack()
+	if err != nil {
+		c.logger.Warn("Unable to capture the stack: %s", err)
+		return report
+	}
+	for _, f := range frames {
+		f.File = fileuri.ToPath(f.File)
+		frame := &Frame{Frame: f}
+		if frame.Locals, err = client.Locals(f.Level); err != nil {
+			frame.Error = err.Error()
+		}
+		report.Frames = append(report.Frames, frame)
+	}
+	return report
+}
+
+func (c *Capture) write(report *Report) (string, error) {
+	dir := c.config.ReportDir
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("crash-%s-%d", report.Time.Format("20060102-150405"), atomic.AddUint64(&lastReportID, 1))
+	var data []byte
+	if c.config.ReportFormat == "text" {
+		name += ".txt"
+		data = report.Text()
+	} else {
+		name += ".json"
+		var err error
+		if data, err = json.MarshalIndent(report, "", "  "); err != nil {
+			return "", err
+		}
+	}
+	path := filepath.Join(dir, name)
+	return path, ioutil.WriteFile(path, data, 0644)
+}
+
+// Text format the report for humans
+func (r *Report) Text() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s: %s\n  at %s:%d\n\n", r.Exception, r.Message, r.File, r.Line)
+	fmt.Fprintf(&b, "Time:   %s\nIDEKey: %s\nScript: %s\n", r.Time.Format(time.RFC3339), r.IDEKey, r.Script)
+	for _, f := range r.Frames {
+		fmt.Fprintf(&b, "\n#%d %s\n   %s:%d\n", f.Level, f.Where, f.File, f.Line)
+		if f.Error != "" {
+			fmt.Fprintf(&b, "   <%s>\n", f.Error)
+		}
+		for _, v := range f.Locals {
+			writeVariable(&b, v, 1)
+		}
+	}
+	return b.Bytes()
+}
+
+func writeVariable(b *bytes.Buffer, v *dbgpclient.Variable, depth int) {
+	fmt.Fprintf(b, "%s%s = %s\n", strings.Repeat("  ", depth+1), v.Name, v)
+	for _, c := range v.Children {
+		writeVariable(b, c, depth+1)
+	}
+}
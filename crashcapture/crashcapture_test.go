@@ -0,0 +1,70 @@
+package crashcapture
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgptest"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/stretchr/testify/assert"
+
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+var responses = map[string]string{
+	"feature_set":    ` success="1">`,
+	"breakpoint_set": ` id="1" state="enabled">`,
+	"run":            ` status="break" reason="ok"><xdebug:message filename="file:///var/www/Service.php" lineno="12" exception="RuntimeException"><![CDATA[Boom]]></xdebug:message>`,
+	"stack_get": `><stack where="Service->run" level="0" type="file" filename="file:///var/www/Service.php" lineno="12"></stack>` +
+		`<stack where="{main}" level="1" type="file" filename="file:///var/www/index.php" lineno="3"></stack>`,
+	"context_get": `><property name="$count" type="int"><![CDATA[3]]></property>`,
+	"detach":      ` status="stopping" reason="ok">`,
+}
+
+func TestCaptureExceptionAndDetach(t *testing.T) {
+	dir := t.TempDir()
+	c := &config.Config{Headless: true, CaptureExceptions: []string{"RuntimeException"}, ReportDir: dir}
+	capture, err := New(c, &logger.Logger{Config: c})
+	assert.NoError(t, err)
+
+	engine, ide := net.Pipe()
+	commands := make(chan *dbgp.Command, 20)
+	go (&dbgptest.Engine{
+		Init:     `<init idekey="CRASH" fileuri="file:///var/www/index.php"></init>`,
+		Respond:  dbgptest.Responses(responses),
+		Commands: commands,
+	}).Serve(engine)
+	assert.NoError(t, capture.run(ide))
+	ide.Close()
+
+	assert.Equal(t, []string{
+		"feature_set -i 1 -n max_depth -v 1",
+		"breakpoint_set -i 2 -t exception -x RuntimeException",
+		"run -i 3",
+		"stack_get -i 4",
+		"context_get -i 5 -d 0 -c 0",
+		"context_get -i 6 -d 1 -c 0",
+		"detach -i 7",
+	}, dbgptest.Sent(commands))
+
+	files, _ := filepath.Glob(filepath.Join(dir, "crash-*.json"))
+	assert.Len(t, files, 1)
+	data, err := ioutil.ReadFile(files[0])
+	assert.NoError(t, err)
+	var report Report
+	assert.NoError(t, json.Unmarshal(data, &report))
+	assert.Equal(t, "RuntimeException", report.Exception)
+	assert.Equal(t, "Boom", report.Message)
+	assert.Equal(t, "CRASH", report.IDEKey)
+	assert.Len(t, report.Frames, 2)
+	assert.Equal(t, "3", report.Frames[0].Locals[0].Value)
+}
+
+func TestInvalidReportFormat(t *testing.T) {
+	c := &config.Config{Headless: true, ReportFormat: "xml"}
+	_, err := New(c, &logger.Logger{Config: c})
+	assert.Error(t, err)
+}
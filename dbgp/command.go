@@ -0,0 +1,182 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbgp
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Arg is a single command argument, like "-i 12"
+type Arg struct {
+	Flag  string
+	Value string
+	// NoValue is true for a flag given without value, an empty Value is written as ""
+	NoValue bool
+}
+
+// Command is an IDE command in the DBGp text protocol
+// name -i transaction_id [-a value ...] [-- base64(data)]
+type Command struct {
+	Name string
+	Args []Arg
+	Data string
+}
+
+// ParseCommand parse a command line, without the trailing NULL byte
+func ParseCommand(line []byte) *Command {
+	s := string(bytes.TrimRight(line, "\x00"))
+	c := &Command{}
+	name, rest := nextToken(s)
+	c.Name = name
+	for {
+		var token string
+		rest = strings.TrimLeft(rest, " ")
+		if rest == "" {
+			break
+		}
+		if strings.HasPrefix(rest, "--") && (len(rest) == 2 || rest[2] == ' ') {
+			c.Data = strings.TrimSpace(rest[2:])
+			break
+		}
+		token, rest = nextToken(rest)
+		if !isFlag(token) {
+			// stray value without flag, keep it to not lose data
+			c.Args = append(c.Args, Arg{Value: token})
+			continue
+		}
+		rest = strings.TrimLeft(rest, " ")
+		arg := Arg{Flag: token[1:], NoValue: true}
+		if next, _ := nextToken(rest); rest != "" && !isFlag(next) && next != "--" {
+			arg.Value, rest = nextValue(rest)
+			arg.NoValue = false
+		}
+		c.Args = append(c.Args, arg)
+	}
+	return c
+}
+
+// NewCommand create a command with the given name and transaction id
+func NewCommand(name, transactionID string) *Command {
+	return &Command{Name: name, Args: []Arg{{Flag: "i", Value: transactionID}}}
+}
+
+// Get return the value of the given flag
+func (c *Command) Get(flag string) (string, bool) {
+	for _, a := range c.Args {
+		if a.Flag == flag {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// Set change the value of the given flag, add the flag if missing
+func (c *Command) Set(flag, value string) {
+	for i, a := range c.Args {
+		if a.Flag == flag {
+			c.Args[i].Value, c.Args[i].NoValue = value, false
+			return
+		}
+	}
+	c.Args = append(c.Args, Arg{Flag: flag, Value: value})
+}
+
+// Del remove the given flag
+func (c *Command) Del(flag string) {
+	args := c.Args[:0]
+	for _, a := range c.Args {
+		if a.Flag != flag {
+			args = append(args, a)
+		}
+	}
+	c.Args = args
+}
+
+// TransactionID return the transaction id of the command
+func (c *Command) TransactionID() string {
+	i, _ := c.Get("i")
+	return i
+}
+
+// Clone return a deep copy of the command
+func (c *Command) Clone() *Command {
+	n := *c
+	n.Args = append([]Arg(nil), c.Args...)
+	return &n
+}
+
+// Bytes serialize the command, without the trailing NULL byte
+func (c *Command) Bytes() []byte {
+	var b bytes.Buffer
+	b.WriteString(c.Name)
+	for _, a := range c.Args {
+		b.WriteByte(' ')
+		if a.Flag != "" {
+			b.WriteString("-" + a.Flag)
+			if a.NoValue {
+				continue
+			}
+			b.WriteByte(' ')
+		}
+		b.WriteString(quote(a.Value))
+	}
+	if c.Data != "" {
+		b.WriteString(" -- ")
+		b.WriteString(c.Data)
+	}
+	return b.Bytes()
+}
+
+func (c *Command) String() string {
+	return string(c.Bytes())
+}
+
+func isFlag(token string) bool {
+	if len(token) != 2 || token[0] != '-' {
+		return false
+	}
+	f := token[1]
+	return (f >= 'a' && f <= 'z') || (f >= 'A' && f <= 'Z')
+}
+
+func nextToken(s string) (string, string) {
+	s = strings.TrimLeft(s, " ")
+	if i := strings.IndexByte(s, ' '); i >= 0 {
+		return s[:i], s[i+1:]
+	}
+	return s, ""
+}
+
+// nextValue read a value, quoted values use backslash to escape quote and backslash
+func nextValue(s string) (string, string) {
+	if s == "" || s[0] != '"' {
+		return nextToken(s)
+	}
+	var v strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			if i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\') {
+				i++
+			}
+			v.WriteByte(s[i])
+		case '"':
+			return v.String(), s[i+1:]
+		default:
+			v.WriteByte(s[i])
+		}
+	}
+	return v.String(), ""
+}
+
+func quote(v string) string {
+	if v != "" && !strings.ContainsAny(v, " \"") {
+		return v
+	}
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, `"`, `\"`, -1)
+	return `"` + v + `"`
+}
@@ -0,0 +1,99 @@
+package dbgp
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	c := ParseCommand([]byte(`breakpoint_set -i 4 -t line -f "file:///my project/Foo.php" -n 12 -- JHggPiAx`))
+	assert.Equal(t, "breakpoint_set", c.Name)
+	assert.Equal(t, "4", c.TransactionID())
+	f, _ := c.Get("f")
+	assert.Equal(t, "file:///my project/Foo.php", f)
+	n, _ := c.Get("n")
+	assert.Equal(t, "12", n)
+	assert.Equal(t, "JHggPiAx", c.Data)
+}
+
+func TestParseCommandWithEscapedQuoteAndNegativeValue(t *testing.T) {
+	c := ParseCommand([]byte(`property_get -i 5 -n "$a[\"b\"]" -d -1 -c 0`))
+	n, _ := c.Get("n")
+	assert.Equal(t, `$a["b"]`, n)
+	d, _ := c.Get("d")
+	assert.Equal(t, "-1", d)
+	assert.Equal(t, `property_get -i 5 -n "$a[\"b\"]" -d -1 -c 0`, c.String())
+}
+
+func TestCommandRoundTrip(t *testing.T) {
+	line := "feature_set -i 1 -n max_depth -v 1"
+	assert.Equal(t, line, ParseCommand([]byte(line)).String())
+}
+
+func TestCommandRoundTripWithEmptyValue(t *testing.T) {
+	line := `eval -i 1 -x "" -- JGE=`
+	c := ParseCommand([]byte(line))
+	x, ok := c.Get("x")
+	assert.True(t, ok)
+	assert.Equal(t, "", x)
+	assert.Equal(t, line, c.String())
+
+	line = "breakpoint_list -i 2 -r"
+	assert.Equal(t, line, ParseCommand([]byte(line)).String())
+	c.Set("v", "")
+	assert.Equal(t, `eval -i 1 -x "" -v "" -- JGE=`, c.String())
+}
+
+func TestReadPacket(t *testing.T) {
+	var b bytes.Buffer
+	b.Write(Packet([]byte("<init/>")))
+	b.Write(Packet([]byte("<response/>")))
+	r := NewReader(&b)
+	p, err := r.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, "<init/>", string(p))
+	p, err = r.ReadPacket()
+	assert.NoError(t, err)
+	assert.Equal(t, "<response/>", string(p))
+}
+
+func TestReadPacketTooLarge(t *testing.T) {
+	var b bytes.Buffer
+	b.WriteString("9223372036854775807\x00<init/>\x00")
+	_, err := NewReader(&b).ReadPacket()
+	assert.EqualError(t, err, "packet length 9223372036854775807 exceeds the maximum of 67108864 bytes")
+
+	b.Reset()
+	b.Write(Packet([]byte("<response/>")))
+	r := NewReader(&b)
+	r.MaxPacketSize = 10
+	_, err = r.ReadPacket()
+	assert.EqualError(t, err, "packet length 11 exceeds the maximum of 10 bytes")
+}
+
+func TestParseHeader(t *testing.T) {
+	h, err := ParseHeader([]byte(`<?xml version="1.0" encoding="iso-8859-1"?>
+<response xmlns="urn:debugger_protocol_v1" command="step_into" transaction_id="3" status="break" reason="ok"></response>`))
+	assert.NoError(t, err)
+	assert.Equal(t, "response", h.Element)
+	assert.Equal(t, "step_into", h.Command())
+	assert.Equal(t, "3", h.TransactionID())
+	assert.Equal(t, "break", h.Status())
+}
+
+func TestDocumentRoundTrip(t *testing.T) {
+	data := "<?xml version=\"1.0\" encoding=\"iso-8859-1\"?>\n" +
+		`<response xmlns="urn:debugger_protocol_v1" xmlns:xdebug="https://xdebug.org/dbgp/xdebug" command="property_get" transaction_id="9">` +
+		`<property name="$e" type="object" classname="Exception" numchildren="1"><property name="file" type="string" size="5" encoding="base64"><![CDATA[L2Zvbw==]]></property></property>` +
+		`<xdebug:message filename="file:///a&amp;b.php" lineno="3"></xdebug:message></response>`
+	doc, err := ParseDocument([]byte(data))
+	assert.NoError(t, err)
+	assert.Equal(t, data, string(doc.Bytes()))
+
+	file := doc.Root.Find("property")[1]
+	v, err := file.Value()
+	assert.NoError(t, err)
+	assert.Equal(t, "/foo", v)
+	assert.Equal(t, "file:///a&b.php", doc.Root.Child("xdebug:message").Attr("filename"))
+}
@@ -0,0 +1,189 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbgp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io"
+	"strings"
+)
+
+// Document is a parsed engine packet, it keep namespace prefixes and CDATA sections
+// to serialize the document like the engine does
+type Document struct {
+	prolog []byte
+	Root   *Node
+}
+
+// Node is an element of a Document
+type Node struct {
+	// Name is the qualified name, like "response" or "xdebug:message"
+	Name     string
+	Attrs    []xml.Attr
+	Children []*Node
+	// Text is the unescaped character data of the element
+	Text string
+	// CDATA serialize the text as a CDATA section
+	CDATA bool
+}
+
+// ParseDocument parse the XML document of an engine packet
+func ParseDocument(data []byte) (*Document, error) {
+	d := newDecoder(data)
+	doc := &Document{}
+	var stack []*Node
+	for {
+		start := d.InputOffset()
+		t, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			n := &Node{Name: qualifiedName(t.Name)}
+			for _, a := range t.Attr {
+				n.Attrs = append(n.Attrs, xml.Attr{Name: xml.Name{Local: qualifiedName(a.Name)}, Value: a.Value})
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.Children = append(parent.Children, n)
+			} else if doc.Root == nil {
+				doc.prolog = append([]byte(nil), data[:start]...)
+				doc.Root = n
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				n := stack[len(stack)-1]
+				if bytes.HasPrefix(data[start:], []byte("<![CDATA[")) {
+					n.CDATA = true
+				}
+				n.Text += string(t)
+			}
+		}
+	}
+	if doc.Root == nil {
+		return nil, errors.New("empty XML document")
+	}
+	return doc, nil
+}
+
+// Bytes serialize the document
+func (d *Document) Bytes() []byte {
+	var b bytes.Buffer
+	b.Write(d.prolog)
+	d.Root.write(&b)
+	return b.Bytes()
+}
+
+// Attr return the value of an attribute
+func (n *Node) Attr(name string) string {
+	v, _ := n.LookupAttr(name)
+	return v
+}
+
+// LookupAttr return the value of an attribute and if the attribute exist
+func (n *Node) LookupAttr(name string) (string, bool) {
+	for _, a := range n.Attrs {
+		if a.Name.Local == name {
+			return a.Value, true
+		}
+	}
+	return "", false
+}
+
+// SetAttr change the value of an attribute, add the attribute if missing
+func (n *Node) SetAttr(name, value string) {
+	for i, a := range n.Attrs {
+		if a.Name.Local == name {
+			n.Attrs[i].Value = value
+			return
+		}
+	}
+	n.Attrs = append(n.Attrs, xml.Attr{Name: xml.Name{Local: name}, Value: value})
+}
+
+// Child return the first child element with the given name
+func (n *Node) Child(name string) *Node {
+	for _, c := range n.Children {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Find return all descendant elements with the given name, in document order
+func (n *Node) Find(name string) []*Node {
+	var found []*Node
+	for _, c := range n.Children {
+		if c.Name == name {
+			found = append(found, c)
+		}
+		found = append(found, c.Find(name)...)
+	}
+	return found
+}
+
+// Filter keep only the child elements accepted by the given function
+func (n *Node) Filter(keep func(c *Node) bool) {
+	children := n.Children[:0]
+	for _, c := range n.Children {
+		if keep(c) {
+			children = append(children, c)
+		}
+	}
+	n.Children = children
+}
+
+// Value return the text of the element, base64 decoded if the element is encoded
+func (n *Node) Value() (string, error) {
+	if n.Attr("encoding") != "base64" {
+		return n.Text, nil
+	}
+	v, err := base64.StdEncoding.DecodeString(strings.TrimSpace(n.Text))
+	return string(v), err
+}
+
+// SetValue change the text of the element, base64 encoded if the element is encoded
+func (n *Node) SetValue(v string) {
+	if n.Attr("encoding") == "base64" {
+		v = base64.StdEncoding.EncodeToString([]byte(v))
+	}
+	n.Text = v
+}
+
+func (n *Node) write(b *bytes.Buffer) {
+	b.WriteString("<" + n.Name)
+	for _, a := range n.Attrs {
+		b.WriteString(" " + a.Name.Local + `="`)
+		xml.EscapeText(b, []byte(a.Value))
+		b.WriteString(`"`)
+	}
+	b.WriteString(">")
+	if n.Text != "" {
+		if n.CDATA {
+			b.WriteString(CDATA(strings.Replace(n.Text, "]]>", "]]]]><![CDATA[>", -1)))
+		} else {
+			b.WriteString(textEscaper.Replace(n.Text))
+		}
+	}
+	for _, c := range n.Children {
+		c.write(b)
+	}
+	b.WriteString("</" + n.Name + ">")
+}
+
+var textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
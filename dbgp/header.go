@@ -0,0 +1,75 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbgp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+)
+
+// Header is the root element of an engine packet, like <init>, <response>, <stream> or <notify>
+type Header struct {
+	Element string
+	Attrs   map[string]string
+}
+
+// ParseHeader read the root element of an engine packet
+func ParseHeader(data []byte) (*Header, error) {
+	d := newDecoder(data)
+	for {
+		t, err := d.RawToken()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if s, ok := t.(xml.StartElement); ok {
+			h := &Header{Element: s.Name.Local, Attrs: map[string]string{}}
+			for _, a := range s.Attr {
+				h.Attrs[qualifiedName(a.Name)] = a.Value
+			}
+			return h, nil
+		}
+	}
+}
+
+// Attr return the value of an attribute of the root element
+func (h *Header) Attr(name string) string {
+	return h.Attrs[name]
+}
+
+// Command return the command name of a response
+func (h *Header) Command() string {
+	return h.Attrs["command"]
+}
+
+// TransactionID return the transaction id of a response
+func (h *Header) TransactionID() string {
+	return h.Attrs["transaction_id"]
+}
+
+// Status return the engine status of a response
+func (h *Header) Status() string {
+	return h.Attrs["status"]
+}
+
+func newDecoder(data []byte) *xml.Decoder {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	// xDebug announce iso-8859-1 but send UTF-8, keep the bytes as is
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return input, nil
+	}
+	d.Strict = false
+	return d
+}
+
+func qualifiedName(n xml.Name) string {
+	if n.Space == "" {
+		return n.Local
+	}
+	return n.Space + ":" + n.Local
+}
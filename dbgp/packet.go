@@ -0,0 +1,76 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbgp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// DefaultMaxPacketSize is the maximum size of an engine packet, in bytes
+const DefaultMaxPacketSize = 64 << 20
+
+// Reader read DBGp messages from a connection
+type Reader struct {
+	r *bufio.Reader
+	// MaxPacketSize reject the engine packets announcing a bigger size
+	MaxPacketSize int
+}
+
+// NewReader create a new message reader
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, 0xffff), MaxPacketSize: DefaultMaxPacketSize}
+}
+
+// ReadPacket read an engine packet: [size NULL XML(data) NULL], return only the XML data
+func (r *Reader) ReadPacket() ([]byte, error) {
+	header, err := r.r.ReadBytes(0)
+	if err != nil {
+		return nil, err
+	}
+	size, err := strconv.Atoi(string(header[:len(header)-1]))
+	if err != nil || size < 0 {
+		return nil, fmt.Errorf("invalid packet length %q", header[:len(header)-1])
+	}
+	if size > r.MaxPacketSize {
+		return nil, fmt.Errorf("packet length %d exceeds the maximum of %d bytes", size, r.MaxPacketSize)
+	}
+	data := make([]byte, size+1)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return nil, err
+	}
+	if data[size] != 0 {
+		return nil, fmt.Errorf("packet of %d bytes is not NULL terminated", size)
+	}
+	return data[:size], nil
+}
+
+// ReadCommand read an IDE command, without the trailing NULL byte
+func (r *Reader) ReadCommand() ([]byte, error) {
+	line, err := r.r.ReadBytes(0)
+	if err != nil {
+		return nil, err
+	}
+	return line[:len(line)-1], nil
+}
+
+// Packet frame XML data as an engine packet
+func Packet(data []byte) []byte {
+	size := strconv.Itoa(len(data))
+	b := make([]byte, 0, len(size)+len(data)+2)
+	b = append(b, size...)
+	b = append(b, 0)
+	b = append(b, data...)
+	return append(b, 0)
+}
+
+// CommandLine frame a command line with the trailing NULL byte
+func CommandLine(line []byte) []byte {
+	b := make([]byte, 0, len(line)+1)
+	b = append(b, line...)
+	return append(b, 0)
+}
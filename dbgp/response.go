@@ -0,0 +1,68 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbgp
+
+import (
+	"bytes"
+	"encoding/xml"
+	"strconv"
+)
+
+const (
+	// Namespace of the DBGp protocol
+	Namespace = "urn:debugger_protocol_v1"
+	// XdebugNamespace of the xDebug extensions
+	XdebugNamespace = "https://xdebug.org/dbgp/xdebug"
+	xmlHeader       = "<?xml version=\"1.0\" encoding=\"iso-8859-1\"?>\n"
+)
+
+// DBGp error codes, see https://xdebug.org/docs/dbgp#error-codes
+const (
+	ErrorParse                = 1
+	ErrorInvalidOptions       = 3
+	ErrorUnimplemented        = 4
+	ErrorCommandNotAvailable  = 5
+	ErrorCanNotOpenFile       = 100
+	ErrorStreamRedirectFailed = 101
+	ErrorEvaluation           = 206
+	ErrorUnknown              = 998
+)
+
+// NewResponse build the XML document of a response to the given command, attrs
+// are name and value pairs, the body is inserted as is
+func NewResponse(command, transactionID string, attrs []string, body string) []byte {
+	var b bytes.Buffer
+	b.WriteString(xmlHeader)
+	b.WriteString(`<response xmlns="` + Namespace + `" xmlns:xdebug="` + XdebugNamespace + `"`)
+	writeAttr(&b, "command", command)
+	writeAttr(&b, "transaction_id", transactionID)
+	for i := 0; i+1 < len(attrs); i += 2 {
+		writeAttr(&b, attrs[i], attrs[i+1])
+	}
+	b.WriteString(">")
+	b.WriteString(body)
+	b.WriteString("</response>")
+	return b.Bytes()
+}
+
+// NewErrorResponse build the XML document of an error response to the given command
+func NewErrorResponse(command, transactionID string, code int, message string) []byte {
+	var body bytes.Buffer
+	body.WriteString(`<error code="` + strconv.Itoa(code) + `"><message>`)
+	xml.EscapeText(&body, []byte(message))
+	body.WriteString(`</message></error>`)
+	return NewResponse(command, transactionID, nil, body.String())
+}
+
+// CDATA wrap the given text in a CDATA section
+func CDATA(text string) string {
+	return "<![CDATA[" + text + "]]>"
+}
+
+func writeAttr(b *bytes.Buffer, name, value string) {
+	b.WriteString(" " + name + `="`)
+	xml.EscapeText(b, []byte(value))
+	b.WriteString(`"`)
+}
@@ -0,0 +1,282 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbgpclient
+
+import (
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Client talk to a debugger engine like an IDE, one command at a time
+type Client struct {
+	conn     io.ReadWriteCloser
+	reader   *dbgp.Reader
+	lastID   int
+	initData []byte
+	// Init is the init packet of the engine
+	Init *dbgp.Document
+	// OnPacket receive the stream and notify packets, received while waiting for a response
+	OnPacket func(doc *dbgp.Document)
+}
+
+// Error is an error response of the engine
+type Error struct {
+	Command string
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("%s failed with error %d", e.Command, e.Code)
+	}
+	return fmt.Sprintf("%s failed with error %d: %s", e.Command, e.Code, e.Message)
+}
+
+// New create a client and read the init packet of the engine
+func New(conn io.ReadWriteCloser) (*Client, error) {
+	c := &Client{conn: conn, reader: dbgp.NewReader(conn)}
+	data, err := c.reader.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	doc, err := dbgp.ParseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	if doc.Root.Name != "init" {
+		return nil, errors.New("expected init packet, got " + doc.Root.Name)
+	}
+	c.Init, c.initData = doc, data
+	return c, nil
+}
+
+// Command send a command and wait for its response, data is base64 encoded
+func (c *Client) Command(name string, args []string, data string) (*dbgp.Document, error) {
+	c.lastID++
+	cmd := dbgp.NewCommand(name, strconv.Itoa(c.lastID))
+	for i := 0; i+1 < len(args); i += 2 {
+		cmd.Set(args[i], args[i+1])
+	}
+	if data != "" {
+		cmd.Data = base64.StdEncoding.EncodeToString([]byte(data))
+	}
+	if _, err := c.conn.Write(dbgp.CommandLine(cmd.Bytes())); err != nil {
+		return nil, err
+	}
+	tid := cmd.TransactionID()
+	for {
+		doc, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		if doc.Root.Name != "response" || doc.Root.Attr("transaction_id") != tid {
+			if c.OnPacket != nil {
+				c.OnPacket(doc)
+			}
+			continue
+		}
+		if e := doc.Root.Child("error"); e != nil {
+			code, _ := strconv.Atoi(e.Attr("code"))
+			message := ""
+			if m := e.Child("message"); m != nil {
+				message = strings.TrimSpace(m.Text)
+			}
+			return doc, &Error{Command: name, Code: code, Message: message}
+		}
+		return doc, nil
+	}
+}
+
+// Splice hand the session over to another IDE: the init packet is sent to ide, then
+// the packets are copied both ways until a side is closed
+func (c *Client) Splice(ide io.ReadWriteCloser) error {
+	defer ide.Close()
+	if _, err := ide.Write(dbgp.Packet(c.initData)); err != nil {
+		return err
+	}
+	go func() {
+		io.Copy(c.conn, ide)
+		c.conn.Close()
+	}()
+	for {
+		data, err := c.reader.ReadPacket()
+		if err != nil {
+			return err
+		}
+		if _, err := ide.Write(dbgp.Packet(data)); err != nil {
+			return err
+		}
+	}
+}
+
+// Close the connection
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Client) read() (*dbgp.Document, error) {
+	data, err := c.reader.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	return dbgp.ParseDocument(data)
+}
+
+// Frame is a stack frame
+type Frame struct {
+	Level int    `json:"level"`
+	Where string `json:"where,omitempty"`
+	File  string `json:"file"`
+	Line  int    `json:"line"`
+}
+
+// Stack return the frames of the call stack
+func (c *Client) Stack() ([]Frame, error) {
+	doc, err := c.Command("stack_get", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	var frames []Frame
+	for _, n := range doc.Root.Find("stack") {
+		level, _ := strconv.Atoi(n.Attr("level"))
+		line, _ := strconv.Atoi(n.Attr("lineno"))
+		frames = append(frames, Frame{Level: level, Where: n.Attr("where"), File: n.Attr("filename"), Line: line})
+	}
+	return frames, nil
+}
+
+// Variable is a property of the engine, like a local variable
+type Variable struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Class    string      `json:"class,omitempty"`
+	Value    string      `json:"value,omitempty"`
+	Size     int         `json:"size,omitempty"`
+	Children []*Variable `json:"children,omitempty"`
+}
+
+// NewVariable convert a property element, with its children
+func NewVariable(n *dbgp.Node) *Variable {
+	v := &Variable{Name: n.Attr("name"), Type: n.Attr("type"), Class: n.Attr("classname")}
+	if c := n.Child("name"); c != nil {
+		v.Name, _ = c.Value()
+	}
+	switch v.Type {
+	case "array", "object":
+		v.Size, _ = strconv.Atoi(n.Attr("numchildren"))
+		for _, c := range n.Children {
+			if c.Name == "property" {
+				v.Children = append(v.Children, NewVariable(c))
+			}
+		}
+	case "uninitialized", "null":
+	default:
+		if c := n.Child("value"); c != nil {
+			v.Value, _ = c.Value()
+		} else {
+			v.Value, _ = n.Value()
+		}
+	}
+	return v
+}
+
+// String format the value of the variable on a single line
+func (v *Variable) String() string {
+	switch v.Type {
+	case "array":
+		return fmt.Sprintf("array(%d)", v.Size)
+	case "object":
+		return v.Class
+	case "uninitialized", "null":
+		return "null"
+	case "string":
+		return strconv.Quote(v.Value)
+	case "bool":
+		if v.Value == "1" {
+			return "true"
+		}
+		return "false"
+	}
+	return v.Value
+}
+
+// Locals return the local variables of a frame
+func (c *Client) Locals(level int) ([]*Variable, error) {
+	doc, err := c.Command("context_get", []string{"d", strconv.Itoa(level), "c", "0"}, "")
+	if err != nil {
+		return nil, err
+	}
+	var vars []*Variable
+	for _, n := range doc.Root.Children {
+		if n.Name == "property" {
+			vars = append(vars, NewVariable(n))
+		}
+	}
+	return vars, nil
+}
+
+// Eval evaluate an expression in the current frame
+func (c *Client) Eval(expression string) (*Variable, error) {
+	doc, err := c.Command("eval", nil, expression)
+	if err != nil {
+		return nil, err
+	}
+	p := doc.Root.Child("property")
+	if p == nil {
+		return nil, errors.New("eval returned no value")
+	}
+	return NewVariable(p), nil
+}
+
+// Status is the state of the engine after a continuation command
+type Status struct {
+	Status string
+	Reason string
+	// File and Line are the location of a break
+	File string
+	Line int
+	// Exception and Message describe the exception of an exception breakpoint
+	Exception string
+	Message   string
+}
+
+// Continue send a continuation command, like run or step_into, and return the new status
+func (c *Client) Continue(name string) (*Status, error) {
+	doc, err := c.Command(name, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	s := &Status{Status: doc.Root.Attr("status"), Reason: doc.Root.Attr("reason")}
+	if m := doc.Root.Child("xdebug:message"); m != nil {
+		s.File = m.Attr("filename")
+		s.Line, _ = strconv.Atoi(m.Attr("lineno"))
+		s.Exception = m.Attr("exception")
+		s.Message = strings.TrimSpace(m.Text)
+	}
+	return s, nil
+}
+
+// Source return the lines of a file, from begin to end included, 0 for the whole file
+func (c *Client) Source(file string, begin, end int) (string, error) {
+	args := []string{"f", file}
+	if begin > 0 {
+		args = append(args, "b", strconv.Itoa(begin))
+	}
+	if end > 0 {
+		args = append(args, "e", strconv.Itoa(end))
+	}
+	doc, err := c.Command("source", args, "")
+	if err != nil {
+		return "", err
+	}
+	return doc.Root.Value()
+}
@@ -0,0 +1,46 @@
+package dbgpclient
+
+import (
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgptest"
+	"github.com/stretchr/testify/assert"
+
+	"net"
+	"testing"
+)
+
+func TestClientWaitForTheResponseOfTheCommand(t *testing.T) {
+	engine, ide := net.Pipe()
+	go (&dbgptest.Engine{Before: `<stream type="stdout"></stream>`, Respond: dbgptest.Sequence(
+		` status="break" reason="ok"><xdebug:message filename="file:///var/www/Service.php" lineno="12" exception="RuntimeException"><![CDATA[Boom]]></xdebug:message>`,
+		`><stack where="Service->run" level="0" type="file" filename="file:///var/www/Service.php" lineno="12"></stack>`,
+		`><property name="$a" type="array" numchildren="1"><property name="0" type="int"><![CDATA[1]]></property></property>`,
+		`><error code="206"><message><![CDATA[error evaluating code]]></message></error>`,
+	)}).Serve(engine)
+	c, err := New(ide)
+	assert.NoError(t, err)
+	assert.Equal(t, "PHPSTORM", c.Init.Root.Attr("idekey"))
+	streams := 0
+	c.OnPacket = func(doc *dbgp.Document) { streams++ }
+
+	status, err := c.Continue("run")
+	assert.NoError(t, err)
+	assert.Equal(t, "break", status.Status)
+	assert.Equal(t, "RuntimeException", status.Exception)
+	assert.Equal(t, "Boom", status.Message)
+	assert.Equal(t, 12, status.Line)
+
+	frames, err := c.Stack()
+	assert.NoError(t, err)
+	assert.Equal(t, []Frame{{Level: 0, Where: "Service->run", File: "file:///var/www/Service.php", Line: 12}}, frames)
+
+	locals, err := c.Locals(0)
+	assert.NoError(t, err)
+	assert.Len(t, locals, 1)
+	assert.Equal(t, "array(1)", locals[0].String())
+	assert.Equal(t, "1", locals[0].Children[0].String())
+
+	_, err = c.Eval("$b")
+	assert.EqualError(t, err, "eval failed with error 206: error evaluating code")
+	assert.Equal(t, 4, streams)
+}
@@ -0,0 +1,104 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package dbgptest provide a fake debugger engine and helpers to test the processors
+package dbgptest
+
+import (
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+
+	"net"
+)
+
+// DefaultInit is the init packet sent by an engine without Init
+const DefaultInit = `<init idekey="PHPSTORM" fileuri="file:///var/www/index.php"></init>`
+
+// Engine is a fake debugger engine, it send the init packet then answer each command
+type Engine struct {
+	// Init is the init packet, DefaultInit if empty
+	Init string
+	// Respond return the end of the response to a command, after the attributes of the
+	// response element, like ` status="break" reason="ok">`, the response is empty if nil
+	Respond func(c *dbgp.Command) string
+	// Before is a packet sent before each response, like a stream
+	Before string
+	// Commands receive the commands if not nil, it is closed at the end of the connection
+	Commands chan<- *dbgp.Command
+}
+
+// Responses answer the commands by name, the response is empty for the other commands
+func Responses(responses map[string]string) func(c *dbgp.Command) string {
+	return func(c *dbgp.Command) string {
+		if body, ok := responses[c.Name]; ok {
+			return body
+		}
+		return ">"
+	}
+}
+
+// Sequence answer the commands with the given responses, in order, then with an empty response
+func Sequence(responses ...string) func(c *dbgp.Command) string {
+	return func(c *dbgp.Command) string {
+		if len(responses) == 0 {
+			return ">"
+		}
+		body := responses[0]
+		responses = responses[1:]
+		return body
+	}
+}
+
+// Response return the packet of a response to a command
+func Response(c *dbgp.Command, body string) []byte {
+	return dbgp.Packet([]byte(`<response command="` + c.Name + `" transaction_id="` + c.TransactionID() + `"` + body + `</response>`))
+}
+
+// Serve the connection until it is closed
+func (e *Engine) Serve(conn net.Conn) {
+	if e.Commands != nil {
+		defer close(e.Commands)
+	}
+	init := e.Init
+	if init == "" {
+		init = DefaultInit
+	}
+	conn.Write(dbgp.Packet([]byte(init)))
+	r := dbgp.NewReader(conn)
+	for {
+		line, err := r.ReadCommand()
+		if err != nil {
+			return
+		}
+		c := dbgp.ParseCommand(line)
+		if e.Commands != nil {
+			e.Commands <- c
+		}
+		body := ">"
+		if e.Respond != nil {
+			body = e.Respond(c)
+		}
+		if e.Before != "" {
+			conn.Write(dbgp.Packet([]byte(e.Before)))
+		}
+		conn.Write(Response(c, body))
+	}
+}
+
+// Sent return the commands received by an engine, once its connection is closed
+func Sent(commands <-chan *dbgp.Command) []string {
+	var sent []string
+	for c := range commands {
+		sent = append(sent, c.String())
+	}
+	return sent
+}
+
+// Names return the names of the commands received by an engine, once its connection is closed
+func Names(commands <-chan *dbgp.Command) []string {
+	var names []string
+	for c := range commands {
+		names = append(names, c.Name)
+	}
+	return names
+}
@@ -0,0 +1,63 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package dbgptest
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+	"github.com/stretchr/testify/assert"
+
+	"testing"
+)
+
+// Logger return a logger of the configuration
+func Logger(c *config.Config) *logger.Logger {
+	return &logger.Logger{Config: c}
+}
+
+// Session return a session without connections
+func Session(c *config.Config) *xdebugproxy.Session {
+	return xdebugproxy.NewSession(nil, nil, c, Logger(c))
+}
+
+// Command return the message of a command line of the IDE
+func Command(line string) *xdebugproxy.Message {
+	return xdebugproxy.NewCommandMessage(dbgp.ParseCommand([]byte(line)))
+}
+
+// XML return the message of a packet of the engine
+func XML(data string) *xdebugproxy.Message {
+	return xdebugproxy.NewXMLMessage([]byte(data))
+}
+
+// Process run the processor on the message, the processor must not fail
+func Process(t *testing.T, p xdebugproxy.Processor, s *xdebugproxy.Session, m *xdebugproxy.Message) []*xdebugproxy.Message {
+	out, err := p.Process(s, m)
+	assert.NoError(t, err)
+	return out
+}
+
+// ProcessOne run the processor on the message, the processor must return a single message
+func ProcessOne(t *testing.T, p xdebugproxy.Processor, s *xdebugproxy.Session, m *xdebugproxy.Message) *xdebugproxy.Message {
+	out := Process(t, p, s, m)
+	if !assert.Len(t, out, 1) {
+		t.FailNow()
+	}
+	return out[0]
+}
+
+// Respond pass a response of the engine to the request of the proxy waiting for it
+func Respond(t *testing.T, s *xdebugproxy.Session, data string) []*xdebugproxy.Message {
+	response := XML(data)
+	f := s.PendingRequest(response)
+	if !assert.NotNil(t, f, "no request waiting for %s", data) {
+		t.FailNow()
+	}
+	out, err := f(s, response)
+	assert.NoError(t, err)
+	return out
+}
@@ -9,13 +9,14 @@ import (
 	"github.com/dfeyer/flow-debugproxy/logger"
 	"github.com/dfeyer/flow-debugproxy/pathmapperfactory"
 	"github.com/dfeyer/flow-debugproxy/pathmapping"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
 )
 
 const framework = "dummy"
 
 func init() {
 	p := &PathMapper{}
-	pathmapperfactory.Register(framework, p)
+	pathmapperfactory.RegisterPathMapper(framework, p)
 }
 
 // PathMapper handle the mapping between real code and proxy
@@ -32,12 +33,7 @@ func (p *PathMapper) Initialize(c *config.Config, l *logger.Logger, m *pathmappi
 	p.pathMapping = m
 }
 
-// ApplyMappingToTextProtocol change file path in xDebug text protocol
-func (p *PathMapper) ApplyMappingToTextProtocol(message []byte) []byte {
-	return message
-}
-
-// ApplyMappingToXML change file path in xDebug XML protocol
-func (p *PathMapper) ApplyMappingToXML(message []byte) []byte {
-	return message
+// Process forward the message as is
+func (p *PathMapper) Process(s *xdebugproxy.Session, m *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+	return []*xdebugproxy.Message{m}, nil
 }
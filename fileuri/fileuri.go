@@ -0,0 +1,192 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package fileuri
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	scheme    = "file://"
+	hexDigits = "0123456789ABCDEF"
+)
+
+// IsURI check if the given string is a file URI
+func IsURI(s string) bool {
+	return strings.HasPrefix(s, scheme)
+}
+
+// ToPath convert a file URI to a filesystem path, like xdebug_path_from_url does
+func ToPath(uri string) string {
+	if !IsURI(uri) {
+		return uri
+	}
+	path := Decode(strings.TrimPrefix(uri, scheme))
+	switch {
+	case len(path) > 2 && path[0] == '/' && path[2] == ':':
+		// windows drive path, file:///C:/path
+		path = path[1:]
+	case len(path) > 0 && path[0] != '/':
+		// UNC path, the authority is the server, file://server/share
+		path = "//" + path
+	}
+	return path
+}
+
+// FromPath convert a filesystem path to a file URI, like xdebug_path_to_url does
+func FromPath(path string) string {
+	if IsURI(path) || strings.HasPrefix(path, "phar://") {
+		return path
+	}
+	encoded := Encode(path)
+	var uri string
+	switch {
+	case len(path) > 1 && (path[1] == '/' || path[1] == '\\') && (path[0] == '/' || path[0] == '\\'):
+		// UNC path, \\server\share
+		uri = "file:" + encoded
+	case len(path) > 0 && (path[0] == '/' || path[0] == '\\'):
+		uri = scheme + encoded
+	case len(path) > 1 && path[1] == ':':
+		// windows drive path, C:\path
+		uri = scheme + "/" + encoded
+	default:
+		uri = encoded
+	}
+	return strings.Replace(uri, "\\", "/", -1)
+}
+
+// Encode percent-encode a path, slashes, backslashes, colons and [A-Za-z0-9-._~] are kept
+func Encode(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		if isSafe(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(hexDigits[c>>4])
+		b.WriteByte(hexDigits[c&15])
+	}
+	return b.String()
+}
+
+// Decode percent-decode a path, invalid escape sequences are kept as is
+func Decode(path string) string {
+	if !strings.Contains(path, "%") {
+		return path
+	}
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '%' && i+2 < len(path) && isHex(path[i+1]) && isHex(path[i+2]) {
+			b.WriteByte(unhex(path[i+1])<<4 | unhex(path[i+2]))
+			i += 2
+			continue
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+func isSafe(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.IndexByte("-._~/\\:", c) >= 0
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case c >= 'a':
+		return c - 'a' + 10
+	case c >= 'A':
+		return c - 'A' + 10
+	}
+	return c - '0'
+}
+
+// Style is the path style of an operating system
+type Style int
+
+const (
+	// Auto detect the style from the path
+	Auto Style = iota
+	// Unix style path, /path/to/file.php
+	Unix
+	// Windows style path, C:\path\to\file.php or \\server\share\file.php
+	Windows
+)
+
+// ParseStyle parse a style name: auto, unix (linux, darwin) or windows
+func ParseStyle(name string) (Style, error) {
+	switch strings.ToLower(name) {
+	case "", "auto":
+		return Auto, nil
+	case "unix", "linux", "darwin", "mac":
+		return Unix, nil
+	case "windows", "win":
+		return Windows, nil
+	}
+	return Auto, fmt.Errorf("unsupported OS style '%s', use auto, unix or windows", name)
+}
+
+// DetectStyle return the style of the given path or file URI
+func DetectStyle(path string) Style {
+	if IsURI(path) {
+		if strings.HasPrefix(path, scheme+"/") {
+			path = ToPath(path)
+		} else {
+			// file://server/share
+			return Windows
+		}
+	}
+	switch {
+	case len(path) > 1 && path[1] == ':' && isLetter(path[0]):
+		return Windows
+	case strings.HasPrefix(path, `\\`), strings.HasPrefix(path, "//"):
+		return Windows
+	case strings.Contains(path, `\`) && !strings.Contains(path, "/"):
+		return Windows
+	}
+	return Unix
+}
+
+// Normalize convert a path to the canonical form used by the proxy: forward slashes and,
+// for windows paths, an upper case drive letter
+func (s Style) Normalize(path string) string {
+	if s == Auto {
+		s = DetectStyle(path)
+	}
+	if s != Windows {
+		return path
+	}
+	path = strings.Replace(path, `\`, "/", -1)
+	if len(path) > 1 && path[1] == ':' && isLetter(path[0]) {
+		path = strings.ToUpper(path[:1]) + path[1:]
+	}
+	return path
+}
+
+// HasPrefix check if the path start with the given directory, windows paths are case insensitive
+func (s Style) HasPrefix(path, prefix string) bool {
+	path, prefix = s.Normalize(path), strings.TrimRight(s.Normalize(prefix), "/")
+	if len(path) < len(prefix) || (len(path) > len(prefix) && path[len(prefix)] != '/') {
+		return false
+	}
+	if s == Windows || (s == Auto && DetectStyle(path) == Windows) {
+		return strings.EqualFold(path[:len(prefix)], prefix)
+	}
+	return path[:len(prefix)] == prefix
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
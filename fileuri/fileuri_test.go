@@ -0,0 +1,42 @@
+package fileuri
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFromPathEncodeLikeXdebug(t *testing.T) {
+	assert.Equal(t, "file:///home/me/Client%20Projects/Z%C3%BCrich/Foo.php", FromPath("/home/me/Client Projects/Zürich/Foo.php"))
+	assert.Equal(t, "file:///srv/%23hash/100%25/Foo.php", FromPath("/srv/#hash/100%/Foo.php"))
+	assert.Equal(t, "file:///C:/Client%20Projects/Foo.php", FromPath(`C:\Client Projects\Foo.php`))
+	assert.Equal(t, "file://server/share/Foo.php", FromPath(`\\server\share\Foo.php`))
+	assert.Equal(t, "file:///srv/a-b_c.d~e/Foo.php", FromPath("/srv/a-b_c.d~e/Foo.php"))
+}
+
+func TestToPath(t *testing.T) {
+	assert.Equal(t, "/home/me/Client Projects/Zürich/Foo.php", ToPath("file:///home/me/Client%20Projects/Z%C3%BCrich/Foo.php"))
+	assert.Equal(t, "C:/Client Projects/Foo.php", ToPath("file:///C:/Client%20Projects/Foo.php"))
+	assert.Equal(t, "/not/an/uri%20.php", ToPath("/not/an/uri%20.php"))
+	assert.Equal(t, "/broken/%zz/%4", ToPath("file:///broken/%zz/%4"))
+	assert.Equal(t, "//server/share/Foo.php", ToPath("file://server/share/Foo.php"))
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, path := range []string{
+		"/home/me/Client Projects/Zürich/Foo.php",
+		"/srv/#hash/Foo.php",
+		"/srv/100%/Foo.php",
+		"/srv/100%20/Foo.php",
+		"/srv/äöü ÄÖÜ/Straße.php",
+		"C:/Users/me/Zürich #1/Foo.php",
+		"//server/share/Zürich #1/Foo.php",
+	} {
+		assert.Equal(t, path, ToPath(FromPath(path)), "round trip of %s", path)
+	}
+	for _, uri := range []string{
+		"file://server/share/Foo.php",
+		"file://server/share/Z%C3%BCrich/Foo.php",
+	} {
+		assert.Equal(t, uri, FromPath(ToPath(uri)), "round trip of %s", uri)
+	}
+}
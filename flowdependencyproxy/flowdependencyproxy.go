@@ -0,0 +1,194 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flowdependencyproxy
+
+import (
+	"github.com/dfeyer/flow-debugproxy/commandpolicy"
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+
+	"encoding/base64"
+	"errors"
+	"strings"
+	"sync"
+)
+
+const (
+	sessionKey = "flowdependencyproxy"
+	// Marker is appended to the class name of the resolved objects
+	Marker = " (resolved by flow-debugproxy)"
+)
+
+// classNames of the lazy dependency proxy, for Neos Flow and TYPO3 Flow
+var classNames = map[string]bool{
+	`Neos\Flow\ObjectManagement\DependencyInjection\DependencyProxy`:  true,
+	`TYPO3\Flow\ObjectManagement\DependencyInjection\DependencyProxy`: true,
+}
+
+// Resolver replace the lazy DependencyProxy of the variables view by the real instance
+type Resolver struct {
+	logger *logger.Logger
+}
+
+// state keep if the variables requested by the IDE belong to the current frame, by transaction id
+type state struct {
+	sync.Mutex
+	current map[string]bool
+}
+
+// resolution is a response waiting for its dependencies
+type resolution struct {
+	message *xdebugproxy.Message
+	doc     *dbgp.Document
+	pending int
+}
+
+// New create a resolver, return nil if the resolution is disabled
+func New(c *config.Config, l *logger.Logger) *Resolver {
+	if !c.ResolveDependencyProxies {
+		return nil
+	}
+	return &Resolver{logger: l}
+}
+
+// Process hold the context_get and property_get responses of the current frame containing
+// dependency proxies, until the engine evaluated the real instances
+func (r *Resolver) Process(s *xdebugproxy.Session, m *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+	st := s.LoadOrStore(sessionKey, &state{current: map[string]bool{}}).(*state)
+	if m.Direction == xdebugproxy.ToEngine {
+		if m.Command.Name == "context_get" || m.Command.Name == "property_get" {
+			// eval run in the current frame and the local variables only
+			d, _ := m.Command.Get("d")
+			c, _ := m.Command.Get("c")
+			st.Lock()
+			st.current[m.Command.TransactionID()] = (d == "" || d == "0") && (c == "" || c == "0")
+			st.Unlock()
+		}
+		return []*xdebugproxy.Message{m}, nil
+	}
+	name := m.CommandName()
+	if name != "context_get" && name != "property_get" {
+		return []*xdebugproxy.Message{m}, nil
+	}
+	tid := m.TransactionID()
+	st.Lock()
+	current := st.current[tid]
+	delete(st.current, tid)
+	st.Unlock()
+	if !current {
+		return []*xdebugproxy.Message{m}, nil
+	}
+	doc, err := dbgp.ParseDocument(m.Data())
+	if err != nil {
+		return nil, err
+	}
+	var requests []*xdebugproxy.Message
+	res := &resolution{message: m, doc: doc}
+	for _, p := range doc.Root.Find("property") {
+		if !classNames[p.Attr("classname")] {
+			continue
+		}
+		fullname := propertyName(p, "fullname")
+		if fullname == "" {
+			continue
+		}
+		c := dbgp.NewCommand("eval", "")
+		c.Data = base64.StdEncoding.EncodeToString([]byte(fullname + "->_activateDependency()"))
+		if commandpolicy.Blocked(s, c) {
+			// the activation run code in the engine, the session policy decide
+			s.Logger.Log(logger.LevelDebug, "Dependency resolution blocked by the policy", logger.F("command", name), logger.F("transaction_id", tid))
+			return []*xdebugproxy.Message{m}, nil
+		}
+		requests = append(requests, s.Request(c, r.activate(res, p)))
+		res.pending++
+	}
+	if len(requests) == 0 {
+		return []*xdebugproxy.Message{m}, nil
+	}
+	s.Logger.Log(logger.LevelDebug, "Resolve dependency proxies", logger.F("command", name), logger.F("transaction_id", tid), logger.F("proxies", len(requests)))
+	return requests, nil
+}
+
+// activate get the instance once the dependency is activated, the activation replace the
+// dependency proxy in the frame, so the engine give the children their names in the frame
+func (r *Resolver) activate(res *resolution, p *dbgp.Node) xdebugproxy.ResponseFunc {
+	return func(s *xdebugproxy.Session, response *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+		instance, err := property(response, p)
+		if err != nil {
+			s.Logger.Log(logger.LevelDebug, "Unable to activate the dependency", logger.F("error", err))
+			return r.done(res), nil
+		}
+		c := dbgp.NewCommand("property_get", "")
+		c.Set("n", propertyName(p, "fullname"))
+		return []*xdebugproxy.Message{s.Request(c, r.resolve(res, p, instance))}, nil
+	}
+}
+
+// resolve replace the dependency proxy by the instance, the evaluated instance is used if
+// the property is not found, its children can then not be expanded
+func (r *Resolver) resolve(res *resolution, p, evaluated *dbgp.Node) xdebugproxy.ResponseFunc {
+	return func(s *xdebugproxy.Session, response *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+		instance, err := property(response, p)
+		if err != nil {
+			s.Logger.Log(logger.LevelDebug, "Unable to get the activated dependency", logger.F("error", err))
+			instance = evaluated
+		}
+		replace(p, instance)
+		return r.done(res), nil
+	}
+}
+
+// done return the response once every dependency is resolved, even if the resolution failed
+func (r *Resolver) done(res *resolution) []*xdebugproxy.Message {
+	res.pending--
+	if res.pending > 0 {
+		return nil
+	}
+	res.message.SetData(res.doc.Bytes())
+	return []*xdebugproxy.Message{res.message}
+}
+
+// property return the property of a response to the resolution of p
+func property(response *xdebugproxy.Message, p *dbgp.Node) (*dbgp.Node, error) {
+	doc, err := dbgp.ParseDocument(response.Data())
+	if err != nil {
+		return nil, err
+	}
+	instance := doc.Root.Child("property")
+	if instance == nil {
+		return nil, errors.New("unable to resolve dependency proxy " + propertyName(p, "fullname"))
+	}
+	return instance, nil
+}
+
+// replace the dependency proxy by the instance, keeping the name of the property
+func replace(p, instance *dbgp.Node) {
+	for _, a := range p.Attrs {
+		switch a.Name.Local {
+		case "name", "fullname", "facet":
+			instance.SetAttr(a.Name.Local, a.Value)
+		}
+	}
+	for _, name := range []string{"name", "fullname"} {
+		if c := p.Child(name); c != nil {
+			instance.Filter(func(n *dbgp.Node) bool { return n.Name != name })
+			instance.Children = append([]*dbgp.Node{c}, instance.Children...)
+		}
+	}
+	instance.SetAttr("classname", instance.Attr("classname")+Marker)
+	*p = *instance
+}
+
+// propertyName return the name or fullname of a property, from the extended property element if any
+func propertyName(p *dbgp.Node, attr string) string {
+	if c := p.Child(attr); c != nil {
+		if v, err := c.Value(); err == nil {
+			return strings.TrimSpace(v)
+		}
+	}
+	return p.Attr(attr)
+}
@@ -0,0 +1,113 @@
+package flowdependencyproxy
+
+import (
+	"github.com/dfeyer/flow-debugproxy/commandpolicy"
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgptest"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+	"github.com/stretchr/testify/assert"
+
+	"encoding/base64"
+	"testing"
+)
+
+const context = `<response command="context_get" transaction_id="4" context="0">` +
+	`<property name="$this" fullname="$this" type="object" classname="Acme\Demo\Controller" children="1" numchildren="1">` +
+	`<property name="service" fullname="$this-&gt;service" facet="protected" type="object" classname="Neos\Flow\ObjectManagement\DependencyInjection\DependencyProxy" children="1" numchildren="3"></property>` +
+	`</property></response>`
+
+func newSession() (*Resolver, *xdebugproxy.Session) {
+	c := &config.Config{ResolveDependencyProxies: true}
+	return New(c, dbgptest.Logger(c)), dbgptest.Session(c)
+}
+
+func TestResolveDependencyProxyOfCurrentFrame(t *testing.T) {
+	r, s := newSession()
+	dbgptest.Process(t, r, s, dbgptest.Command("context_get -i 4 -d 0 -c 0"))
+	out := dbgptest.Process(t, r, s, dbgptest.XML(context))
+	assert.Len(t, out, 1)
+	eval := out[0]
+	assert.Equal(t, xdebugproxy.ToEngine, eval.Direction)
+	assert.Equal(t, "eval", eval.Command.Name)
+	expression, _ := base64.StdEncoding.DecodeString(eval.Command.Data)
+	assert.Equal(t, "$this->service->_activateDependency()", string(expression))
+
+	out = dbgptest.Respond(t, s, `<response command="eval" transaction_id="`+eval.TransactionID()+`">`+
+		`<property type="object" classname="Acme\Demo\Service" children="1" numchildren="2"></property></response>`)
+	assert.Len(t, out, 1)
+	get := out[0]
+	assert.Equal(t, xdebugproxy.ToEngine, get.Direction)
+	assert.Equal(t, "property_get -i "+get.TransactionID()+" -n $this->service", get.Command.String())
+
+	// the children keep the names of the frame, the IDE can expand them
+	out = dbgptest.Respond(t, s, `<response command="property_get" transaction_id="`+get.TransactionID()+`">`+
+		`<property name="service" fullname="$this-&gt;service" facet="protected" type="object" classname="Acme\Demo\Service" children="1" numchildren="2">`+
+		`<property name="repository" fullname="$this-&gt;service-&gt;repository" facet="protected" type="null"></property>`+
+		`</property></response>`)
+	assert.Len(t, out, 1)
+	assert.Equal(t, "4", out[0].TransactionID())
+
+	doc, err := dbgp.ParseDocument(out[0].Data())
+	assert.NoError(t, err)
+	properties := doc.Root.Find("property")
+	service := properties[1]
+	assert.Equal(t, "service", service.Attr("name"))
+	assert.Equal(t, "$this->service", service.Attr("fullname"))
+	assert.Equal(t, "protected", service.Attr("facet"))
+	assert.Equal(t, `Acme\Demo\Service`+Marker, service.Attr("classname"))
+	assert.Equal(t, "2", service.Attr("numchildren"))
+	assert.Equal(t, "$this->service->repository", properties[2].Attr("fullname"))
+}
+
+func TestEvaluatedInstanceIsUsedIfThePropertyIsNotFound(t *testing.T) {
+	r, s := newSession()
+	dbgptest.Process(t, r, s, dbgptest.Command("context_get -i 4"))
+	eval := dbgptest.Process(t, r, s, dbgptest.XML(context))[0]
+	get := dbgptest.Respond(t, s, `<response command="eval" transaction_id="`+eval.TransactionID()+`">`+
+		`<property type="object" classname="Acme\Demo\Service" children="1" numchildren="2"></property></response>`)[0]
+	out := dbgptest.Respond(t, s, `<response command="property_get" transaction_id="`+get.TransactionID()+`">`+
+		`<error code="300"><message><![CDATA[can not get property]]></message></error></response>`)
+	assert.Len(t, out, 1)
+
+	doc, err := dbgp.ParseDocument(out[0].Data())
+	assert.NoError(t, err)
+	service := doc.Root.Find("property")[1]
+	assert.Equal(t, "$this->service", service.Attr("fullname"))
+	assert.Equal(t, `Acme\Demo\Service`+Marker, service.Attr("classname"))
+}
+
+func TestResolutionIsBlockedWithEval(t *testing.T) {
+	c := &config.Config{ResolveDependencyProxies: true, Policies: []string{"uri:^/admin deny:eval"}}
+	r, s := New(c, dbgptest.Logger(c)), dbgptest.Session(c)
+	e, err := commandpolicy.New(c, dbgptest.Logger(c))
+	assert.NoError(t, err)
+	out := dbgptest.Process(t, e, s, dbgptest.XML(`<init idekey="guest-1" fileuri="file:///var/www/index.php"></init>`))
+
+	// nothing is evaluated until the policy is known
+	dbgptest.Process(t, r, s, dbgptest.Command("context_get -i 4"))
+	m := dbgptest.XML(context)
+	assert.Equal(t, []*xdebugproxy.Message{m}, dbgptest.Process(t, r, s, m))
+
+	dbgptest.Respond(t, s, `<response command="eval" transaction_id="`+out[1].TransactionID()+`"><property type="string"><![CDATA[/admin/users]]></property></response>`)
+	dbgptest.Process(t, r, s, dbgptest.Command("context_get -i 4"))
+	m = dbgptest.XML(context)
+	assert.Equal(t, []*xdebugproxy.Message{m}, dbgptest.Process(t, r, s, m))
+
+	// the sessions of another policy are resolved
+	c.Policies = []string{"deny:exec"}
+	r, s = New(c, dbgptest.Logger(c)), dbgptest.Session(c)
+	e, err = commandpolicy.New(c, dbgptest.Logger(c))
+	assert.NoError(t, err)
+	dbgptest.Process(t, e, s, dbgptest.XML(`<init idekey="guest-1" fileuri="file:///var/www/index.php"></init>`))
+	dbgptest.Process(t, r, s, dbgptest.Command("context_get -i 4"))
+	assert.Equal(t, "eval", dbgptest.Process(t, r, s, dbgptest.XML(context))[0].Command.Name)
+}
+
+func TestOtherFramesAreNotResolved(t *testing.T) {
+	r, s := newSession()
+	dbgptest.Process(t, r, s, dbgptest.Command("context_get -i 4 -d 1 -c 0"))
+	out := dbgptest.Process(t, r, s, dbgptest.XML(context))
+	assert.Len(t, out, 1)
+	assert.Equal(t, xdebugproxy.ToIDE, out[0].Direction)
+}
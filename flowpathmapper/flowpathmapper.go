@@ -6,10 +6,12 @@ package flowpathmapper
 
 import (
 	"github.com/dfeyer/flow-debugproxy/config"
-	"github.com/dfeyer/flow-debugproxy/errorhandler"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
 	"github.com/dfeyer/flow-debugproxy/logger"
 	"github.com/dfeyer/flow-debugproxy/pathmapperfactory"
 	"github.com/dfeyer/flow-debugproxy/pathmapping"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
 
 	"bytes"
 	"fmt"
@@ -18,7 +20,6 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"runtime"
 )
 
 const (
@@ -28,9 +29,8 @@ const (
 )
 
 var (
-	regexpPhpFile         = regexp.MustCompile(`(?://)?(/[^ ]*\.php)`)
-	regexpFilename__Win   = regexp.MustCompile(`filename=["]?file:///(\S+)/Data/Temporary/.+?/Cache/Code/Flow_Object_Classes/([^"]*)\.php`)
-	regexpFilename__Unix  = regexp.MustCompile(`filename=["]?file://(\S+)/Data/Temporary/.+?/Cache/Code/Flow_Object_Classes/([^"]*)\.php`)
+	regexpFilename        = regexp.MustCompile(`filename=["]?(file://\S+?)/Data/Temporary/.+?/Cache/Code/Flow_Object_Classes/([^"]*)\.php`)
+	regexpProxyPath       = regexp.MustCompile(`(file://)?((?:[A-Za-z]:)?/[^\n"'(]*?)/Data/Temporary/[^\s"']+?/Cache/Code/Flow_Object_Classes/(\w+)\.php`)
 	regexpPathAndFilename = regexp.MustCompile(`(?m)^# PathAndFilename: (.*)$`)
 	regexpPackageClass    = regexp.MustCompile(`(.*?)/Packages/[^/]*/(.*?)/Classes/(.*).php`)
 	regexpDot             = regexp.MustCompile(`[\./]`)
@@ -38,14 +38,7 @@ var (
 
 func init() {
 	p := &PathMapper{}
-	pathmapperfactory.Register(framework, p)
-}
-
-func regexpFilename() *regexp.Regexp {
-	if runtime.GOOS == "windows" {
-		return regexpFilename__Win
-	}
-	return regexpFilename__Unix
+	pathmapperfactory.RegisterPathMapper(framework, p)
 }
 
 // PathMapper handle the mapping between real code and proxy
@@ -62,44 +55,47 @@ func (p *PathMapper) Initialize(c *config.Config, l *logger.Logger, m *pathmappi
 	p.pathMapping = m
 }
 
-// ApplyMappingToTextProtocol change file path in xDebug text protocol
-func (p *PathMapper) ApplyMappingToTextProtocol(message []byte) []byte {
-	return p.doTextPathMapping(message)
-}
-
-// ApplyMappingToXML change file path in xDebug XML protocol
-func (p *PathMapper) ApplyMappingToXML(message []byte) []byte {
-	message = p.doXMLPathMapping(message)
-
-	// update xml length count
-	s := strings.Split(string(message), "\x00")
-	i, err := strconv.Atoi(s[0])
-	errorhandler.PanicHandling(err, p.logger)
-	l := len(s[1])
-	if i != l {
-		message = bytes.Replace(message, []byte(strconv.Itoa(i)), []byte(strconv.Itoa(l)), 1)
+// Process change file path in xDebug text and XML protocol
+func (p *PathMapper) Process(s *xdebugproxy.Session, m *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+	if m.Direction == xdebugproxy.ToEngine {
+		p.doTextPathMapping(m.Command)
+		return []*xdebugproxy.Message{m}, nil
 	}
-
-	return message
-}
-
-func (p *PathMapper) doTextPathMapping(message []byte) []byte {
-	var processedMapping = map[string]string{}
-	for _, match := range regexpPhpFile.FindAllStringSubmatch(string(message), -1) {
-		originalPath := match[1]
-		if runtime.GOOS == "windows" {
-			originalPath = strings.Replace(originalPath,"//","", 1)
+	data, err := p.doXMLPathMapping(m.Data())
+	if err != nil {
+		return nil, err
+	}
+	if h, err := m.Header(); err == nil && h.Element == "notify" {
+		data, err = p.doNotifyPathMapping(data)
+		if err != nil {
+			return nil, err
 		}
-		path := p.mapPath(originalPath)
-		p.logger.Debug("doTextPathMapping %s >>> %s", path, originalPath)
-		processedMapping[path] = originalPath
 	}
-
-	for path, originalPath := range processedMapping {
-		message = bytes.Replace(message, []byte(p.getRealFilename(originalPath)), []byte(p.getRealFilename(path)), -1)
+	if p.config.MapPayloads {
+		data, err = p.doPayloadPathMapping(data)
+		if err != nil {
+			return nil, err
+		}
 	}
+	m.SetData(data)
+	return []*xdebugproxy.Message{m}, nil
+}
 
-	return message
+func (p *PathMapper) doTextPathMapping(command *dbgp.Command) {
+	uri, ok := command.Get("f")
+	if !ok || !strings.HasSuffix(uri, ".php") {
+		return
+	}
+	originalPath := fileuri.ToPath(uri)
+	path := p.mapPath(originalPath)
+	if path == originalPath {
+		return
+	}
+	p.logger.Debug("doTextPathMapping %s >>> %s", path, originalPath)
+	if fileuri.IsURI(uri) {
+		path = fileuri.FromPath(path)
+	}
+	command.Set("f", path)
 }
 
 func (p *PathMapper) getCachePath(base, filename string) string {
@@ -114,37 +110,147 @@ func (p *PathMapper) getCachePath(base, filename string) string {
 	return strings.Replace(cachePath, "@filename@", filename, 1)
 }
 
-func (p *PathMapper) doXMLPathMapping(b []byte) []byte {
+func (p *PathMapper) doXMLPathMapping(b []byte) ([]byte, error) {
 	var processedMapping = map[string]string{}
-	for _, match := range regexpFilename().FindAllStringSubmatch(string(b), -1) {
-		path := p.getCachePath(match[1], match[2])
+	for _, match := range regexpFilename.FindAllStringSubmatch(string(b), -1) {
+		// the URI style is detected per message, file:///C:/... for windows engines
+		basePath := fileuri.ToPath(match[1])
+		path := p.getCachePath(basePath, fileuri.Decode(match[2]))
 		if _, ok := processedMapping[path]; ok == false {
-			if originalPath, exist := p.pathMapping.Get(path); exist {
-				if p.config.VeryVerbose {
-					p.logger.Info("Umpa Lumpa can help you, he know the mapping\n%s\n%s\n", p.logger.Colorize(">>> "+fmt.Sprintf(h, path), "yellow"), p.logger.Colorize(">>> "+fmt.Sprintf(h, p.getRealFilename(originalPath)), "green"))
-				}
-				processedMapping[path] = originalPath
-				p.logger.Debug("doXMLPathMapping mapping exist %s >>> %s", path, originalPath)
-			} else {
-				originalPath = p.readOriginalPathFromCache(path, match[1])
-				processedMapping[path] = originalPath
-				p.logger.Debug("doXMLPathMapping missing mapping %s >>> %s", path, originalPath)
+			originalPath, err := p.getOriginalPath(path, basePath)
+			if err != nil {
+				return nil, err
 			}
+			processedMapping[path] = originalPath
 		}
 	}
 
 	for path, originalPath := range processedMapping {
-		path = p.getRealFilename(path)
-		originalPath = p.getRealFilename(originalPath)
+		path = uriPath(p.getRealFilename(path))
+		originalPath = uriPath(p.getRealFilename(originalPath))
 		b = bytes.Replace(b, []byte(path), []byte(originalPath), -1)
 	}
 
-	return b
+	return b, nil
+}
+
+func (p *PathMapper) getOriginalPath(path, basePath string) (string, error) {
+	if originalPath, exist := p.pathMapping.Get(path); exist {
+		p.logger.Debug("Umpa Lumpa can help you, he know the mapping\n%s\n%s\n", p.logger.Colorize(">>> "+fmt.Sprintf(h, path), "yellow"), p.logger.Colorize(">>> "+fmt.Sprintf(h, p.getRealFilename(originalPath)), "green"))
+		p.logger.Debug("getOriginalPath mapping exist %s >>> %s", path, originalPath)
+		return originalPath, nil
+	}
+	originalPath, err := p.readOriginalPathFromCache(path, basePath)
+	if err != nil {
+		return "", err
+	}
+	p.logger.Debug("getOriginalPath missing mapping %s >>> %s", path, originalPath)
+	return originalPath, nil
+}
+
+// doNotifyPathMapping change file path in the messages of xDebug 3 notifications, like
+// <notify name="error">, the filename attributes are already mapped like any response
+func (p *PathMapper) doNotifyPathMapping(b []byte) ([]byte, error) {
+	doc, err := dbgp.ParseDocument(b)
+	if err != nil {
+		return nil, err
+	}
+	changed := false
+	for _, message := range doc.Root.Find("xdebug:message") {
+		value, err := message.Value()
+		if err != nil {
+			return nil, err
+		}
+		if mapped := p.doPlainTextPathMapping(value); mapped != value {
+			message.SetValue(mapped)
+			changed = true
+		}
+	}
+	if !changed {
+		return b, nil
+	}
+	return doc.Bytes(), nil
+}
+
+// doPayloadPathMapping change file path in base64 encoded stream and property values, like
+// PHP warnings redirected to the IDE or the file property of an exception. Flow keep the line
+// numbers of the original code in the proxy class, so only the path need to be changed.
+func (p *PathMapper) doPayloadPathMapping(b []byte) ([]byte, error) {
+	if !bytes.Contains(b, []byte(`encoding="base64"`)) {
+		return b, nil
+	}
+	doc, err := dbgp.ParseDocument(b)
+	if err != nil {
+		return nil, err
+	}
+	nodes := []*dbgp.Node{doc.Root}
+	nodes = append(nodes, doc.Root.Find("property")...)
+	nodes = append(nodes, doc.Root.Find("value")...)
+	changed := false
+	for _, n := range nodes {
+		if n.Attr("encoding") != "base64" || n.Text == "" || (n.Name != "stream" && n.Name != "property" && n.Name != "value") {
+			continue
+		}
+		value, err := n.Value()
+		if err != nil {
+			return nil, err
+		}
+		mapped := p.doPlainTextPathMapping(value)
+		if mapped == value {
+			continue
+		}
+		n.SetValue(mapped)
+		if _, ok := n.LookupAttr("size"); ok {
+			n.SetAttr("size", strconv.Itoa(len(mapped)))
+		}
+		changed = true
+	}
+	if !changed {
+		return b, nil
+	}
+	// the size of extended properties is on the parent of the <value> element
+	for _, property := range doc.Root.Find("property") {
+		if value := property.Child("value"); value != nil && value.Attr("encoding") == "base64" {
+			if v, err := value.Value(); err == nil {
+				property.SetAttr("size", strconv.Itoa(len(v)))
+			}
+		}
+	}
+	return doc.Bytes(), nil
+}
+
+func (p *PathMapper) doPlainTextPathMapping(text string) string {
+	return regexpProxyPath.ReplaceAllStringFunc(text, func(proxyPath string) string {
+		match := regexpProxyPath.FindStringSubmatch(proxyPath)
+		scheme, basePath, prefix := match[1], match[2], ""
+		// paths can contain spaces, try the base path from each slash preceded by a space
+		for {
+			base := fileuri.ToPath(scheme + basePath)
+			if originalPath, err := p.getOriginalPath(p.getCachePath(base, match[3]), base); err == nil {
+				if scheme != "" {
+					originalPath = fileuri.FromPath(originalPath)
+				}
+				return prefix + originalPath
+			}
+			i := strings.Index(basePath, " /")
+			if i < 0 {
+				p.logger.Debug("doPlainTextPathMapping unable to map %s", proxyPath)
+				return proxyPath
+			}
+			prefix += scheme + basePath[:i+1]
+			scheme, basePath = "", basePath[i+1:]
+		}
+	})
 }
 
-// getRealFilename removes file:// protocol from the given path
+// getRealFilename convert the given file URI to a filesystem path
 func (p *PathMapper) getRealFilename(path string) string {
-	return strings.TrimPrefix(path, "file://")
+	return fileuri.ToPath(path)
+}
+
+// uriPath return the encoded path of a filesystem path, as found in a file URI
+func uriPath(path string) string {
+	return strings.TrimPrefix(fileuri.FromPath(path), "file://")
 }
 
 func (p *PathMapper) mapPath(originalPath string) string {
@@ -165,10 +271,7 @@ func (p *PathMapper) mapPath(originalPath string) string {
 }
 
 func (p *PathMapper) setPathMapping(path string, originalPath string) string {
-	if p.config.Verbose {
-		p.logger.Info(h, "Our Umpa Lumpa take care of your mapping and they did a great job, they found a proxy for you:")
-		p.logger.Info(">>> %s\n", path)
-	}
+	p.logger.Debug("Our Umpa Lumpa take care of your mapping and they did a great job, they found a proxy for you:\n>>> %s\n", path)
 
 	if p.pathMapping.Has(path) == false {
 		p.pathMapping.Set(path, originalPath)
@@ -176,28 +279,28 @@ func (p *PathMapper) setPathMapping(path string, originalPath string) string {
 	return path
 }
 
-func (p *PathMapper) readOriginalPathFromCache(path, basePath string) string {
+func (p *PathMapper) readOriginalPathFromCache(path, basePath string) (string, error) {
 	localPath := path
 	if len(p.config.LocalRoot) > 0 {
 		localPath = strings.Replace(path, basePath, p.config.LocalRoot, 1)
 	}
 	p.logger.Debug("readOriginalPathFromCache %s", localPath)
 	dat, err := ioutil.ReadFile(localPath)
-	errorhandler.PanicHandling(err, p.logger)
+	if err != nil {
+		return "", fmt.Errorf("unable to read proxy class: %s", err)
+	}
 	match := regexpPathAndFilename.FindStringSubmatch(string(dat))
 	if len(match) == 2 {
 		originalPath := match[1]
 		if len(p.config.LocalRoot) > 0 {
 			originalPath = strings.Replace(strings.Replace(originalPath, "\\", "/", -1), p.config.LocalRoot, basePath, 1)
 		}
-		if p.config.VeryVerbose {
-			p.logger.Info("Umpa Lumpa need to work harder, need to reverse this one\n>>> %s\n>>> %s\n", p.logger.Colorize(fmt.Sprintf(h, path), "yellow"), p.logger.Colorize(fmt.Sprintf(h, originalPath), "green"))
-		}
+		p.logger.Debug("Umpa Lumpa need to work harder, need to reverse this one\n>>> %s\n>>> %s\n", p.logger.Colorize(fmt.Sprintf(h, path), "yellow"), p.logger.Colorize(fmt.Sprintf(h, originalPath), "green"))
 		p.logger.Debug("readOriginalPathFromCache %s >>> %s", path, originalPath)
 		p.setPathMapping(path, originalPath)
-		return originalPath
+		return originalPath, nil
 	}
-	return path
+	return path, nil
 }
 
 func (p *PathMapper) buildClassNameFromPath(path string) (string, string) {
@@ -1,7 +1,20 @@
 package flowpathmapper
 
 import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/pathmapping"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
 	"github.com/stretchr/testify/assert"
+
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
 )
 
@@ -16,3 +29,86 @@ func TestBuildClassNameFromPathSupportPSR4(t *testing.T) {
 	assert.Equal(t, "/your/path/sites/dev/master-dev.neos-workplace.dev", basePath, "they should be equal")
 	assert.Equal(t, "Ttree_FlowDebugProxyHelper_ProxyClassMapperComponent", className, "they should be equal")
 }
+
+func setupFlowProject(t *testing.T) (*PathMapper, string, string) {
+	root := filepath.Join(t.TempDir(), "Client Projects", "Zürich #1")
+	originalPath := filepath.Join(root, "Packages/Application/Acme.Demo/Classes/Controller/StandardController.php")
+	cachePath := filepath.Join(root, "Data/Temporary/Development/Cache/Code/Flow_Object_Classes/Acme_Demo_Controller_StandardController.php")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(originalPath), 0755))
+	assert.NoError(t, os.MkdirAll(filepath.Dir(cachePath), 0755))
+	assert.NoError(t, ioutil.WriteFile(originalPath, []byte("<?php\n"), 0644))
+	assert.NoError(t, ioutil.WriteFile(cachePath, []byte("<?php\n# PathAndFilename: "+originalPath+"\n"), 0644))
+
+	c := &config.Config{Context: "Development"}
+	p := &PathMapper{}
+	p.Initialize(c, &logger.Logger{Config: c}, &pathmapping.PathMapping{})
+	return p, originalPath, cachePath
+}
+
+func TestTextPathMappingSupportPercentEncodedURI(t *testing.T) {
+	p, originalPath, cachePath := setupFlowProject(t)
+	m := xdebugproxy.NewCommandMessage(dbgp.ParseCommand([]byte("breakpoint_set -i 3 -t line -f " + fileuri.FromPath(originalPath) + " -n 12")))
+	out, err := p.Process(nil, m)
+	assert.NoError(t, err)
+	assert.Equal(t, "breakpoint_set -i 3 -t line -f "+fileuri.FromPath(cachePath)+" -n 12", out[0].Command.String())
+}
+
+func TestXMLPathMappingSupportPercentEncodedURI(t *testing.T) {
+	p, originalPath, cachePath := setupFlowProject(t)
+	xml := `<response command="stack_get" transaction_id="4"><stack where="{main}" level="0" type="file" filename="` + fileuri.FromPath(cachePath) + `" lineno="12"></stack></response>`
+	out, err := p.Process(nil, xdebugproxy.NewXMLMessage([]byte(xml)))
+	assert.NoError(t, err)
+	expected := strings.Replace(xml, fileuri.FromPath(cachePath), fileuri.FromPath(originalPath), 1)
+	assert.Equal(t, expected, string(out[0].Data()))
+}
+
+func TestXMLPathMappingReturnErrorOnMissingProxyClass(t *testing.T) {
+	p, _, cachePath := setupFlowProject(t)
+	missing := strings.Replace(cachePath, "StandardController", "MissingController", 1)
+	xml := `<response command="stack_get" transaction_id="4"><stack level="0" filename="` + fileuri.FromPath(missing) + `" lineno="12"></stack></response>`
+	_, err := p.Process(nil, xdebugproxy.NewXMLMessage([]byte(xml)))
+	assert.Error(t, err)
+}
+
+func TestPayloadPathMappingInStreamAndProperty(t *testing.T) {
+	p, originalPath, cachePath := setupFlowProject(t)
+	p.config.MapPayloads = true
+	encode := func(s string) string {
+		return base64.StdEncoding.EncodeToString([]byte(s))
+	}
+
+	warning := "Warning: Undefined variable $foo in " + cachePath + " on line 12"
+	stream := `<stream xmlns="urn:debugger_protocol_v1" type="stdout" encoding="base64"><![CDATA[` + encode(warning) + `]]></stream>`
+	out, err := p.Process(nil, xdebugproxy.NewXMLMessage([]byte(stream)))
+	assert.NoError(t, err)
+	expected := strings.Replace(warning, cachePath, originalPath, 1)
+	assert.Equal(t, `<stream xmlns="urn:debugger_protocol_v1" type="stdout" encoding="base64"><![CDATA[`+encode(expected)+`]]></stream>`, string(out[0].Data()))
+
+	property := `<response command="property_get" transaction_id="5"><property name="file" fullname="$e-&gt;file" type="string" size="` + strconv.Itoa(len(cachePath)) + `" encoding="base64"><![CDATA[` + encode(cachePath) + `]]></property></response>`
+	out, err = p.Process(nil, xdebugproxy.NewXMLMessage([]byte(property)))
+	assert.NoError(t, err)
+	assert.Equal(t, `<response command="property_get" transaction_id="5"><property name="file" fullname="$e-&gt;file" type="string" size="`+strconv.Itoa(len(originalPath))+`" encoding="base64"><![CDATA[`+encode(originalPath)+`]]></property></response>`, string(out[0].Data()))
+}
+
+func TestPayloadPathMappingIsOptIn(t *testing.T) {
+	p, _, cachePath := setupFlowProject(t)
+	stream := `<stream type="stderr" encoding="base64"><![CDATA[` + base64.StdEncoding.EncodeToString([]byte(cachePath)) + `]]></stream>`
+	out, err := p.Process(nil, xdebugproxy.NewXMLMessage([]byte(stream)))
+	assert.NoError(t, err)
+	assert.Equal(t, stream, string(out[0].Data()))
+}
+
+func TestNotifyPathMapping(t *testing.T) {
+	p, originalPath, cachePath := setupFlowProject(t)
+
+	resolved := `<notify xmlns="urn:debugger_protocol_v1" xmlns:xdebug="https://xdebug.org/dbgp/xdebug" name="breakpoint_resolved"><breakpoint type="line" resolved="resolved" filename="` + fileuri.FromPath(cachePath) + `" lineno="12" state="enabled" hit_count="0" hit_value="0" id="10001"></breakpoint></notify>`
+	out, err := p.Process(nil, xdebugproxy.NewXMLMessage([]byte(resolved)))
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Replace(resolved, fileuri.FromPath(cachePath), fileuri.FromPath(originalPath), 1), string(out[0].Data()))
+
+	notify := `<notify xmlns="urn:debugger_protocol_v1" xmlns:xdebug="https://xdebug.org/dbgp/xdebug" name="error"><xdebug:message filename="` + fileuri.FromPath(cachePath) + `" lineno="12" type="Warning" type_string="E_WARNING"><![CDATA[include(): Failed opening in ` + cachePath + `]]></xdebug:message></notify>`
+	out, err = p.Process(nil, xdebugproxy.NewXMLMessage([]byte(notify)))
+	assert.NoError(t, err)
+	expected := strings.Replace(strings.Replace(notify, fileuri.FromPath(cachePath), fileuri.FromPath(originalPath), 1), cachePath, originalPath, 1)
+	assert.Equal(t, expected, string(out[0].Data()))
+}
@@ -0,0 +1,172 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flowpropertyfilter
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Feature toggle the filter of a session with feature_set, the proxy answer it
+	Feature    = "flow_hide_injected_properties"
+	sessionKey = "flowpropertyfilter"
+)
+
+// DefaultProperties are the synthetic properties added by Flow to the proxy classes
+var DefaultProperties = []string{
+	"Flow_Injected_Properties",
+	"Flow_Object_PropertiesSerialization_Identifier",
+	"Flow_Aop_Proxy_*",
+	"Flow_Persistence_*",
+	"Flow_Proxy_*",
+}
+
+var filteredCommands = map[string]bool{
+	"context_get":  true,
+	"property_get": true,
+	"eval":         true,
+}
+
+// Filter hide the properties injected by Flow in context_get, property_get and eval responses
+type Filter struct {
+	config   *config.Config
+	logger   *logger.Logger
+	patterns []*regexp.Regexp
+}
+
+// New create a property filter, the filter is enabled by default if configured, and can be
+// toggled by each session
+func New(c *config.Config, l *logger.Logger) *Filter {
+	names := c.HiddenProperties
+	if len(names) == 0 {
+		names = DefaultProperties
+	}
+	f := &Filter{config: c, logger: l}
+	for _, name := range names {
+		// only * is a wildcard
+		f.patterns = append(f.patterns, regexp.MustCompile(`^`+strings.Replace(regexp.QuoteMeta(name), `\*`, `.*`, -1)+`$`))
+	}
+	return f
+}
+
+// Process answer the feature toggle and filter the properties
+func (f *Filter) Process(s *xdebugproxy.Session, m *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+	if m.Direction == xdebugproxy.ToEngine {
+		return f.processCommand(s, m)
+	}
+	if !f.enabled(s) || !filteredCommands[m.CommandName()] {
+		return []*xdebugproxy.Message{m}, nil
+	}
+	doc, err := dbgp.ParseDocument(m.Data())
+	if err != nil {
+		return nil, err
+	}
+	if hidden := f.filter(doc.Root); hidden > 0 {
+		s.Logger.Log(logger.LevelDebug, "Hide Flow properties", logger.F("command", m.CommandName()), logger.F("transaction_id", m.TransactionID()), logger.F("hidden", hidden))
+		m.SetData(doc.Bytes())
+	}
+	return []*xdebugproxy.Message{m}, nil
+}
+
+func (f *Filter) processCommand(s *xdebugproxy.Session, m *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+	c := m.Command
+	if n, _ := c.Get("n"); n != Feature || (c.Name != "feature_set" && c.Name != "feature_get") {
+		return []*xdebugproxy.Message{m}, nil
+	}
+	var response []byte
+	if c.Name == "feature_set" {
+		v, _ := c.Get("v")
+		s.SetValue(sessionKey, v == "1")
+		s.Logger.Log(logger.LevelDebug, "Hide Flow properties", logger.F("enabled", v == "1"))
+		response = dbgp.NewResponse(c.Name, c.TransactionID(), []string{"feature", Feature, "success", "1"}, "")
+	} else {
+		v := "0"
+		if f.enabled(s) {
+			v = "1"
+		}
+		response = dbgp.NewResponse(c.Name, c.TransactionID(), []string{"feature_name", Feature, "supported", "1"}, dbgp.CDATA(v))
+	}
+	return []*xdebugproxy.Message{xdebugproxy.NewXMLMessage(response)}, nil
+}
+
+func (f *Filter) enabled(s *xdebugproxy.Session) bool {
+	if v, ok := s.Value(sessionKey).(bool); ok {
+		return v
+	}
+	return f.config.HideInjectedProperties
+}
+
+// filter remove the hidden child properties and return the number of removed properties
+func (f *Filter) filter(n *dbgp.Node) int {
+	total := 0
+	for _, c := range n.Children {
+		total += f.filter(c)
+	}
+	if n.Name != "property" {
+		return total
+	}
+	hidden := 0
+	n.Filter(func(c *dbgp.Node) bool {
+		if c.Name == "property" && f.hide(c) {
+			hidden++
+			return false
+		}
+		return true
+	})
+	if hidden > 0 {
+		f.fixNumChildren(n, hidden)
+	}
+	return total + hidden
+}
+
+// fixNumChildren decrease the number of children, without removing a page the IDE need to request
+func (f *Filter) fixNumChildren(n *dbgp.Node, hidden int) {
+	numChildren, err := strconv.Atoi(n.Attr("numchildren"))
+	if err != nil {
+		return
+	}
+	count := numChildren - hidden
+	if pageSize, err := strconv.Atoi(n.Attr("pagesize")); err == nil && pageSize > 0 && numChildren > pageSize {
+		// paged object, hidden properties of other pages are not known
+		pages := (numChildren + pageSize - 1) / pageSize
+		if min := (pages-1)*pageSize + 1; count < min {
+			count = min
+		}
+	}
+	if count < 0 {
+		count = 0
+	}
+	n.SetAttr("numchildren", strconv.Itoa(count))
+	if count == 0 {
+		n.SetAttr("children", "0")
+	}
+}
+
+func (f *Filter) hide(property *dbgp.Node) bool {
+	name := property.Attr("name")
+	if child := property.Child("name"); child != nil {
+		// extended properties
+		if v, err := child.Value(); err == nil {
+			name = v
+		}
+	}
+	// private properties of PHP 5 can be prefixed by the class name
+	if i := strings.LastIndexAny(name, ":*"); i >= 0 {
+		name = name[i+1:]
+	}
+	for _, p := range f.patterns {
+		if p.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,62 @@
+package flowpropertyfilter
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgptest"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const context = `<response command="context_get" transaction_id="4" context="0">` +
+	`<property name="$this" fullname="$this" type="object" classname="Acme\Demo\Service" children="1" numchildren="3" page="0" pagesize="32">` +
+	`<property name="logger" fullname="$this-&gt;logger" facet="protected" type="object" children="0" numchildren="0"></property>` +
+	`<property name="Flow_Injected_Properties" fullname="$this-&gt;Flow_Injected_Properties" facet="private" type="array" children="1" numchildren="1"></property>` +
+	`<property name="Flow_Persistence_RelatedEntities" fullname="$this-&gt;Flow_Persistence_RelatedEntities" facet="private" type="array" children="0" numchildren="0"></property>` +
+	`</property></response>`
+
+func newSession(hide bool) (*Filter, *xdebugproxy.Session) {
+	c := &config.Config{HideInjectedProperties: hide}
+	return New(c, dbgptest.Logger(c)), dbgptest.Session(c)
+}
+
+func properties(t *testing.T, m *xdebugproxy.Message) *dbgp.Node {
+	doc, err := dbgp.ParseDocument(m.Data())
+	assert.NoError(t, err)
+	return doc.Root.Child("property")
+}
+
+func TestHideInjectedProperties(t *testing.T) {
+	f, s := newSession(true)
+	this := properties(t, dbgptest.ProcessOne(t, f, s, dbgptest.XML(context)))
+	assert.Len(t, this.Children, 1)
+	assert.Equal(t, "logger", this.Children[0].Attr("name"))
+	assert.Equal(t, "1", this.Attr("numchildren"))
+}
+
+func TestPagedObjectKeepTheLastPage(t *testing.T) {
+	f, _ := newSession(true)
+	n := &dbgp.Node{Name: "property"}
+	n.SetAttr("numchildren", "34")
+	n.SetAttr("pagesize", "32")
+	f.fixNumChildren(n, 3)
+	assert.Equal(t, "33", n.Attr("numchildren"))
+}
+
+func TestToggleFilterWithFeatureSet(t *testing.T) {
+	f, s := newSession(true)
+	out := dbgptest.ProcessOne(t, f, s, dbgptest.Command("feature_set -i 3 -n flow_hide_injected_properties -v 0"))
+	assert.Equal(t, xdebugproxy.ToIDE, out.Direction)
+	assert.Equal(t, "3", out.TransactionID())
+
+	this := properties(t, dbgptest.ProcessOne(t, f, s, dbgptest.XML(context)))
+	assert.Len(t, this.Children, 3)
+	assert.Equal(t, "3", this.Attr("numchildren"))
+
+	out = dbgptest.ProcessOne(t, f, s, dbgptest.Command("feature_get -i 5 -n flow_hide_injected_properties"))
+	assert.Contains(t, string(out.Data()), "<![CDATA[0]]>")
+
+	cmd := dbgptest.ProcessOne(t, f, s, dbgptest.Command("feature_set -i 6 -n max_depth -v 2"))
+	assert.Equal(t, xdebugproxy.ToEngine, cmd.Direction)
+}
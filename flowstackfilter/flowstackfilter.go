@@ -0,0 +1,230 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flowstackfilter
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	sessionKey   = "flowstackfilter"
+	proxyPattern = "flow:proxy"
+)
+
+// DefaultPatterns hide the generated proxy methods, the AOP advices and join points
+var DefaultPatterns = []string{
+	proxyPattern,
+	`where:^Neos\\Flow\\Aop\\`,
+	`where:->Flow_Aop_Proxy_`,
+	`file:/Neos\.Flow/Classes/Aop/`,
+}
+
+var (
+	regexpProxyClass    = regexp.MustCompile(`/Cache/Code/Flow_Object_Classes/`)
+	regexpOriginalClass = regexp.MustCompile(`_Original(->|::)`)
+)
+
+// commands using the -d option to select a stack frame
+var depthCommands = map[string]bool{
+	"context_get":    true,
+	"context_names":  true,
+	"property_get":   true,
+	"property_set":   true,
+	"property_value": true,
+	"stack_get":      true,
+}
+
+// continuations are the commands moving the engine, the frames of the last stack are gone
+var continuations = map[string]bool{
+	"run":       true,
+	"step_into": true,
+	"step_over": true,
+	"step_out":  true,
+}
+
+type pattern struct {
+	proxy  bool
+	where  *regexp.Regexp
+	file   *regexp.Regexp
+	source string
+}
+
+// Filter hide the Flow AOP and proxy plumbing frames in stack_get responses. It must be placed
+// on the engine side of the path mapper, to see the proxy class of the frames.
+type Filter struct {
+	config   *config.Config
+	logger   *logger.Logger
+	patterns []pattern
+}
+
+// state is the depth translation table of a session
+type state struct {
+	sync.Mutex
+	// depths map the depth seen by the IDE to the depth of the engine
+	depths []int
+	// requested keep the depth requested by stack_get -d, by transaction id
+	requested map[string]int
+}
+
+// New create a stack filter, it return nil if the filter is disabled
+func New(c *config.Config, l *logger.Logger) (*Filter, error) {
+	if !c.HideFrames {
+		return nil, nil
+	}
+	sources := c.FramePatterns
+	if len(sources) == 0 {
+		sources = DefaultPatterns
+	}
+	f := &Filter{config: c, logger: l}
+	for _, source := range sources {
+		p, err := parsePattern(source)
+		if err != nil {
+			return nil, err
+		}
+		f.patterns = append(f.patterns, p)
+	}
+	return f, nil
+}
+
+// parsePattern parse a frame pattern: "where:regexp" match the function, "file:regexp" match
+// the file path and "flow:proxy" match the methods of the generated proxy classes
+func parsePattern(source string) (pattern, error) {
+	p := pattern{source: source}
+	if source == proxyPattern {
+		p.proxy = true
+		return p, nil
+	}
+	kind, expression := "where", source
+	if i := strings.Index(source, ":"); i > 0 && (source[:i] == "where" || source[:i] == "file") {
+		kind, expression = source[:i], source[i+1:]
+	}
+	r, err := regexp.Compile(expression)
+	if err != nil {
+		return p, fmt.Errorf("invalid frame pattern '%s': %s", source, err)
+	}
+	if kind == "file" {
+		p.file = r
+	} else {
+		p.where = r
+	}
+	return p, nil
+}
+
+func (p pattern) match(where, path string) bool {
+	switch {
+	case p.proxy:
+		return regexpProxyClass.MatchString(path) && !regexpOriginalClass.MatchString(where)
+	case p.file != nil:
+		return p.file.MatchString(path)
+	}
+	return p.where.MatchString(where)
+}
+
+// Process filter stack_get responses and translate the depth of the commands
+func (f *Filter) Process(s *xdebugproxy.Session, m *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+	st := s.LoadOrStore(sessionKey, &state{requested: map[string]int{}}).(*state)
+	st.Lock()
+	defer st.Unlock()
+
+	if m.Direction == xdebugproxy.ToEngine {
+		if continuations[m.Command.Name] {
+			st.depths = nil
+		}
+		f.translateDepth(st, m.Command)
+		return []*xdebugproxy.Message{m}, nil
+	}
+	if m.CommandName() != "stack_get" {
+		return []*xdebugproxy.Message{m}, nil
+	}
+	doc, err := dbgp.ParseDocument(m.Data())
+	if err != nil {
+		return nil, err
+	}
+	if depth, ok := st.requested[m.TransactionID()]; ok {
+		// single frame requested by the IDE, restore the depth it know, the table is left as is
+		delete(st.requested, m.TransactionID())
+		if depth >= 0 {
+			for _, frame := range doc.Root.Find("stack") {
+				frame.SetAttr("level", strconv.Itoa(depth))
+			}
+		}
+	} else {
+		st.depths = f.filter(doc.Root)
+	}
+	m.SetData(doc.Bytes())
+	return []*xdebugproxy.Message{m}, nil
+}
+
+// filter remove the hidden frames and return the depth translation table
+func (f *Filter) filter(response *dbgp.Node) []int {
+	var depths []int
+	hidden := 0
+	response.Filter(func(frame *dbgp.Node) bool {
+		if frame.Name != "stack" {
+			return true
+		}
+		level, err := strconv.Atoi(frame.Attr("level"))
+		if err != nil {
+			return true
+		}
+		// the current frame is always visible, the IDE need to show where the engine stopped
+		if level > 0 && f.hide(frame) {
+			hidden++
+			return false
+		}
+		frame.SetAttr("level", strconv.Itoa(len(depths)))
+		depths = append(depths, level)
+		return true
+	})
+	if hidden > 0 {
+		f.logger.Debug("Hide %d Flow plumbing frames in stack_get", hidden)
+	}
+	return depths
+}
+
+func (f *Filter) hide(frame *dbgp.Node) bool {
+	where, path := frame.Attr("where"), fileuri.ToPath(frame.Attr("filename"))
+	for _, p := range f.patterns {
+		if p.match(where, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) translateDepth(st *state, c *dbgp.Command) {
+	if !depthCommands[c.Name] {
+		return
+	}
+	d, ok := c.Get("d")
+	if !ok {
+		return
+	}
+	depth, err := strconv.Atoi(d)
+	if err != nil {
+		depth = -1
+	}
+	if c.Name == "stack_get" {
+		// even untranslated, the response of a single frame must not replace the table
+		st.requested[c.TransactionID()] = depth
+	}
+	if depth < 0 || depth >= len(st.depths) {
+		return
+	}
+	if depth != st.depths[depth] {
+		f.logger.Debug("Translate %s depth %d >>> %d", c.Name, depth, st.depths[depth])
+		c.Set("d", strconv.Itoa(st.depths[depth]))
+	}
+}
@@ -0,0 +1,102 @@
+package flowstackfilter
+
+import (
+	"fmt"
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgptest"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const (
+	proxyFile = "file:///var/www/Data/Temporary/Development/Cache/Code/Flow_Object_Classes/Acme_Demo_Service.php"
+	stack     = `<response command="stack_get" transaction_id="5">` +
+		`<stack where="Acme\Demo\Service_Original->doSomething" level="0" type="file" filename="` + proxyFile + `" lineno="20"></stack>` +
+		`<stack where="Neos\Flow\Aop\Advice\AdviceChain->proceed" level="1" type="file" filename="file:///var/www/Packages/Framework/Neos.Flow/Classes/Aop/Advice/AdviceChain.php" lineno="57"></stack>` +
+		`<stack where="Acme\Demo\Service->Flow_Aop_Proxy_invokeJoinPoint" level="2" type="file" filename="file:///var/www/Packages/Framework/Neos.Flow/Classes/Aop/AdvicesTrait.php" lineno="40"></stack>` +
+		`<stack where="Acme\Demo\Service->doSomething" level="3" type="file" filename="` + proxyFile + `" lineno="120"></stack>` +
+		`<stack where="Acme\Demo\Controller_Original->indexAction" level="4" type="file" filename="file:///var/www/Data/Temporary/Development/Cache/Code/Flow_Object_Classes/Acme_Demo_Controller.php" lineno="12"></stack>` +
+		`</response>`
+)
+
+func newSession(t *testing.T) (*Filter, *xdebugproxy.Session) {
+	c := &config.Config{HideFrames: true}
+	f, err := New(c, dbgptest.Logger(c))
+	assert.NoError(t, err)
+	return f, dbgptest.Session(c)
+}
+
+func command(t *testing.T, f *Filter, s *xdebugproxy.Session, line string) string {
+	return dbgptest.ProcessOne(t, f, s, dbgptest.Command(line)).Command.String()
+}
+
+func TestHidePlumbingFramesAndTranslateDepth(t *testing.T) {
+	f, s := newSession(t)
+	out := dbgptest.ProcessOne(t, f, s, dbgptest.XML(stack))
+	doc, err := dbgp.ParseDocument(out.Data())
+	assert.NoError(t, err)
+	frames := doc.Root.Find("stack")
+	assert.Len(t, frames, 2)
+	assert.Equal(t, `Acme\Demo\Service_Original->doSomething`, frames[0].Attr("where"))
+	assert.Equal(t, "0", frames[0].Attr("level"))
+	assert.Equal(t, `Acme\Demo\Controller_Original->indexAction`, frames[1].Attr("where"))
+	assert.Equal(t, "1", frames[1].Attr("level"))
+
+	assert.Equal(t, "context_get -i 6 -d 4 -c 0", command(t, f, s, "context_get -i 6 -d 1 -c 0"))
+	assert.Equal(t, "property_get -i 7 -d 0 -n $this", command(t, f, s, "property_get -i 7 -d 0 -n $this"))
+	assert.Equal(t, "property_get -i 8 -d 9 -n $this", command(t, f, s, "property_get -i 8 -d 9 -n $this"))
+}
+
+func TestDepthTranslationEndWithTheBreak(t *testing.T) {
+	f, s := newSession(t)
+	dbgptest.ProcessOne(t, f, s, dbgptest.XML(stack))
+	assert.Equal(t, "context_get -i 6 -d 4 -c 0", command(t, f, s, "context_get -i 6 -d 1 -c 0"))
+
+	// the frames of the previous stack are gone once the engine move
+	command(t, f, s, "step_over -i 7")
+	assert.Equal(t, "context_get -i 8 -d 1 -c 0", command(t, f, s, "context_get -i 8 -d 1 -c 0"))
+}
+
+func TestStackGetOfSingleFrameKeepTheDepthOfTheIDE(t *testing.T) {
+	f, s := newSession(t)
+	dbgptest.ProcessOne(t, f, s, dbgptest.XML(stack))
+
+	assert.Equal(t, "stack_get -i 9 -d 4", command(t, f, s, "stack_get -i 9 -d 1"))
+	out := dbgptest.ProcessOne(t, f, s, dbgptest.XML(`<response command="stack_get" transaction_id="9"><stack where="Acme\Demo\Controller_Original->indexAction" level="4" type="file" filename="file:///var/www/Controller.php" lineno="12"></stack></response>`))
+	assert.Contains(t, string(out.Data()), `level="1"`)
+}
+
+func TestStackGetOfSingleFrameKeepTheTable(t *testing.T) {
+	f, s := newSession(t)
+	single := `<response command="stack_get" transaction_id="%s"><stack where="Acme\Demo\Service_Original->doSomething" level="%s" type="file" filename="` + proxyFile + `" lineno="20"></stack></response>`
+
+	// before the first full stack, the depth is not translated but the response is not a table
+	assert.Equal(t, "stack_get -i 3 -d 0", command(t, f, s, "stack_get -i 3 -d 0"))
+	dbgptest.ProcessOne(t, f, s, dbgptest.XML(fmt.Sprintf(single, "3", "0")))
+	assert.Equal(t, "context_get -i 4 -d 1 -c 0", command(t, f, s, "context_get -i 4 -d 1 -c 0"))
+
+	// outside of the table, the single frame response keep the table of the full stack
+	dbgptest.ProcessOne(t, f, s, dbgptest.XML(stack))
+	assert.Equal(t, "stack_get -i 9 -d 7", command(t, f, s, "stack_get -i 9 -d 7"))
+	out := dbgptest.ProcessOne(t, f, s, dbgptest.XML(fmt.Sprintf(single, "9", "7")))
+	assert.Contains(t, string(out.Data()), `level="7"`)
+	assert.Equal(t, "context_get -i 10 -d 4 -c 0", command(t, f, s, "context_get -i 10 -d 1 -c 0"))
+}
+
+func TestCustomPatterns(t *testing.T) {
+	c := &config.Config{HideFrames: true, FramePatterns: []string{`file:/vendor/`}}
+	f, err := New(c, dbgptest.Logger(c))
+	assert.NoError(t, err)
+	vendor := &dbgp.Node{Name: "stack"}
+	vendor.SetAttr("filename", "file:///var/www/Packages/Libraries/vendor/lib/Foo.php")
+	assert.True(t, f.hide(vendor))
+	proxy := &dbgp.Node{Name: "stack"}
+	proxy.SetAttr("where", `Acme\Demo\Service->doSomething`)
+	proxy.SetAttr("filename", proxyFile)
+	assert.False(t, f.hide(proxy))
+
+	_, err = New(&config.Config{HideFrames: true, FramePatterns: []string{"where:("}}, nil)
+	assert.Error(t, err)
+}
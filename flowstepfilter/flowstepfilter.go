@@ -0,0 +1,255 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package flowstepfilter
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	sessionKey       = "flowstepfilter"
+	proxyPattern     = "flow:proxy"
+	defaultStepLimit = 100
+)
+
+// DefaultPatterns step through the Flow plumbing to reach the user code, and step out of libraries
+var DefaultPatterns = []string{
+	"into:" + proxyPattern,
+	`into:/Neos\.Flow/Classes/(Aop|ObjectManagement)/`,
+	`out:/Packages/Framework/`,
+	`out:/Packages/Libraries/`,
+}
+
+var (
+	regexpProxyClass = regexp.MustCompile(`^(.*)/Data/Temporary/.+/Cache/Code/Flow_Object_Classes/`)
+	regexpProxyCode  = regexp.MustCompile(`^# Start of Flow generated Proxy code`)
+)
+
+var stepCommands = map[string]bool{
+	"step_into": true,
+	"step_over": true,
+	"step_out":  true,
+}
+
+type pattern struct {
+	action string
+	proxy  bool
+	file   *regexp.Regexp
+}
+
+// Filter skip the steps ending in library code, like generated proxy methods, advice chains or
+// dependency proxies, and report only the step reaching the user code to the IDE. It must be
+// placed on the engine side of the path mapper, to see the proxy class of the location.
+type Filter struct {
+	config   *config.Config
+	logger   *logger.Logger
+	patterns []pattern
+	limit    int
+
+	mu        sync.Mutex
+	proxyCode map[string]int
+}
+
+// state is the step in progress of a session
+type state struct {
+	sync.Mutex
+	// pending is the step command of the IDE, by transaction id
+	pending map[string]string
+	skipped []string
+}
+
+// New create a step filter, it return nil if the filter is disabled
+func New(c *config.Config, l *logger.Logger) (*Filter, error) {
+	if !c.JustMyCode {
+		return nil, nil
+	}
+	sources := c.LibraryPatterns
+	if len(sources) == 0 {
+		sources = DefaultPatterns
+	}
+	f := &Filter{config: c, logger: l, limit: c.StepLimit, proxyCode: map[string]int{}}
+	if f.limit <= 0 {
+		f.limit = defaultStepLimit
+	}
+	for _, source := range sources {
+		p, err := parsePattern(source)
+		if err != nil {
+			return nil, err
+		}
+		f.patterns = append(f.patterns, p)
+	}
+	return f, nil
+}
+
+// parsePattern parse a library location: "[into:|out:]regexp" match the file path, "flow:proxy"
+// match the generated code of the proxy classes. The action is the step command used to leave
+// the location after a step_into, "out" by default.
+func parsePattern(source string) (pattern, error) {
+	p := pattern{action: "step_out"}
+	switch {
+	case strings.HasPrefix(source, "into:"):
+		p.action, source = "step_into", strings.TrimPrefix(source, "into:")
+	case strings.HasPrefix(source, "out:"):
+		source = strings.TrimPrefix(source, "out:")
+	}
+	if source == proxyPattern {
+		p.proxy = true
+		return p, nil
+	}
+	r, err := regexp.Compile(strings.TrimPrefix(source, "file:"))
+	if err != nil {
+		return p, fmt.Errorf("invalid library pattern '%s': %s", source, err)
+	}
+	p.file = r
+	return p, nil
+}
+
+// Process keep stepping while the engine stop in library code
+func (f *Filter) Process(s *xdebugproxy.Session, m *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+	st := s.LoadOrStore(sessionKey, &state{pending: map[string]string{}}).(*state)
+	st.Lock()
+	defer st.Unlock()
+
+	if m.Direction == xdebugproxy.ToEngine {
+		if stepCommands[m.Command.Name] {
+			st.pending[m.Command.TransactionID()] = m.Command.Name
+			st.skipped = nil
+		}
+		return []*xdebugproxy.Message{m}, nil
+	}
+
+	tid := m.TransactionID()
+	command, ok := st.pending[tid]
+	if !ok || !stepCommands[m.CommandName()] {
+		return []*xdebugproxy.Message{m}, nil
+	}
+	h, err := m.Header()
+	if err != nil {
+		return nil, err
+	}
+	path, line, ok := location(m)
+	action := ""
+	if ok && h.Status() == "break" {
+		action = f.library(path, line)
+	}
+	if action == "" {
+		delete(st.pending, tid)
+		f.report(s, st)
+		return respond(m, h, command)
+	}
+	st.skipped = append(st.skipped, fmt.Sprintf("%s:%d", path, line))
+	if len(st.skipped) >= f.limit {
+		delete(st.pending, tid)
+		f.report(s, st, logger.F("step_limit", f.limit))
+		return respond(m, h, command)
+	}
+	if command != "step_into" {
+		// stepping over or out of user code end in library code only when returning to it
+		action = "step_out"
+	}
+	s.Logger.Log(logger.LevelDebug, "Skip library code", logger.F("file", path), logger.F("line", line), logger.F("command", action))
+	return []*xdebugproxy.Message{xdebugproxy.NewCommandMessage(dbgp.NewCommand(action, tid))}, nil
+}
+
+// respond forward the final response as the response to the step command of the IDE
+func respond(m *xdebugproxy.Message, h *dbgp.Header, command string) ([]*xdebugproxy.Message, error) {
+	if h.Command() == command {
+		return []*xdebugproxy.Message{m}, nil
+	}
+	doc, err := dbgp.ParseDocument(m.Data())
+	if err != nil {
+		return nil, err
+	}
+	doc.Root.SetAttr("command", command)
+	m.SetData(doc.Bytes())
+	return []*xdebugproxy.Message{m}, nil
+}
+
+func (f *Filter) report(s *xdebugproxy.Session, st *state, fields ...logger.Field) {
+	if len(st.skipped) == 0 {
+		return
+	}
+	fields = append([]logger.Field{logger.F("steps", len(st.skipped))}, fields...)
+	s.Logger.Log(logger.LevelInfo, "Skipped library code", append(fields, logger.F("locations", strings.Join(st.skipped, "\n")))...)
+	st.skipped = nil
+}
+
+// library return the step command to leave the location, or an empty string for user code
+func (f *Filter) library(path string, line int) string {
+	for _, p := range f.patterns {
+		if p.proxy && f.isProxyCode(path, line) || p.file != nil && p.file.MatchString(path) {
+			return p.action
+		}
+	}
+	return ""
+}
+
+// isProxyCode check if the line is in the code generated by Flow, after the original code of the class
+func (f *Filter) isProxyCode(path string, line int) bool {
+	match := regexpProxyClass.FindStringSubmatch(path)
+	if match == nil {
+		return false
+	}
+	f.mu.Lock()
+	start, ok := f.proxyCode[path]
+	f.mu.Unlock()
+	if !ok {
+		localPath := path
+		if len(f.config.LocalRoot) > 0 {
+			localPath = f.config.LocalRoot + strings.TrimPrefix(path, match[1])
+		}
+		start = proxyCodeStart(localPath)
+		f.mu.Lock()
+		f.proxyCode[path] = start
+		f.mu.Unlock()
+	}
+	return start > 0 && line >= start
+}
+
+// proxyCodeStart return the first line of the generated proxy code, 0 if unknown
+func proxyCodeStart(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0xffff), 0xfffff)
+	for line := 1; scanner.Scan(); line++ {
+		if regexpProxyCode.Match(scanner.Bytes()) {
+			return line
+		}
+	}
+	return 0
+}
+
+// location return the file and line where the engine stopped
+func location(m *xdebugproxy.Message) (string, int, bool) {
+	doc, err := dbgp.ParseDocument(m.Data())
+	if err != nil {
+		return "", 0, false
+	}
+	message := doc.Root.Child("xdebug:message")
+	if message == nil {
+		return "", 0, false
+	}
+	line, err := strconv.Atoi(message.Attr("lineno"))
+	if err != nil {
+		return "", 0, false
+	}
+	return fileuri.ToPath(message.Attr("filename")), line, true
+}
@@ -0,0 +1,84 @@
+package flowstepfilter
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgptest"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+	"github.com/stretchr/testify/assert"
+
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func stepResponse(command, tid, status, path string, line string) *xdebugproxy.Message {
+	return dbgptest.XML(`<response xmlns="urn:debugger_protocol_v1" xmlns:xdebug="https://xdebug.org/dbgp/xdebug" command="` + command + `" transaction_id="` + tid + `" status="` + status + `" reason="ok"><xdebug:message filename="` + fileuri.FromPath(path) + `" lineno="` + line + `"></xdebug:message></response>`)
+}
+
+func newFilter(t *testing.T, c *config.Config) (*Filter, *xdebugproxy.Session) {
+	c.JustMyCode = true
+	f, err := New(c, dbgptest.Logger(c))
+	assert.NoError(t, err)
+	return f, dbgptest.Session(c)
+}
+
+func TestStepIntoSkipFlowPlumbing(t *testing.T) {
+	root := t.TempDir()
+	proxyClass := filepath.Join(root, "Data/Temporary/Development/Cache/Code/Flow_Object_Classes/Acme_Demo_Service.php")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(proxyClass), 0755))
+	code := "<?php\nclass Service_Original {\n    public function doSomething() {\n    }\n}\n#\n# Start of Flow generated Proxy code\n#\nclass Service extends Service_Original {\n}\n"
+	assert.NoError(t, ioutil.WriteFile(proxyClass, []byte(code), 0644))
+	f, s := newFilter(t, &config.Config{})
+
+	dbgptest.ProcessOne(t, f, s, dbgptest.Command("step_into -i 12"))
+
+	// generated proxy method
+	out := dbgptest.ProcessOne(t, f, s, stepResponse("step_into", "12", "break", proxyClass, "9"))
+	assert.Equal(t, xdebugproxy.ToEngine, out.Direction)
+	assert.Equal(t, "step_into -i 12", out.Command.String())
+
+	// advice chain
+	out = dbgptest.ProcessOne(t, f, s, stepResponse("step_into", "12", "break", "/var/www/Packages/Framework/Neos.Flow/Classes/Aop/Advice/AdviceChain.php", "57"))
+	assert.Equal(t, "step_into -i 12", out.Command.String())
+
+	// logger called by the advice
+	out = dbgptest.ProcessOne(t, f, s, stepResponse("step_into", "12", "break", "/var/www/Packages/Libraries/psr/log/Logger.php", "10"))
+	assert.Equal(t, "step_out -i 12", out.Command.String())
+
+	// original method, reached by the step_out and reported as the step_into of the IDE
+	out = dbgptest.ProcessOne(t, f, s, stepResponse("step_out", "12", "break", proxyClass, "3"))
+	assert.Equal(t, xdebugproxy.ToIDE, out.Direction)
+	assert.True(t, strings.Contains(string(out.Data()), `lineno="3"`))
+	assert.Equal(t, "step_into", out.CommandName())
+}
+
+func TestStepOverReturningToLibraryStepOut(t *testing.T) {
+	f, s := newFilter(t, &config.Config{})
+	dbgptest.ProcessOne(t, f, s, dbgptest.Command("step_over -i 4"))
+	out := dbgptest.ProcessOne(t, f, s, stepResponse("step_over", "4", "break", "/var/www/Packages/Framework/Neos.Flow/Classes/Aop/Advice/AdviceChain.php", "57"))
+	assert.Equal(t, "step_out -i 4", out.Command.String())
+
+	out = dbgptest.ProcessOne(t, f, s, stepResponse("step_out", "4", "stopping", "/var/www/Packages/Framework/Neos.Flow/Classes/Aop/Advice/AdviceChain.php", "57"))
+	assert.Equal(t, xdebugproxy.ToIDE, out.Direction)
+	assert.Equal(t, "step_over", out.CommandName())
+	assert.Contains(t, string(out.Data()), `status="stopping"`)
+}
+
+func TestStepLimit(t *testing.T) {
+	f, s := newFilter(t, &config.Config{StepLimit: 2})
+	dbgptest.ProcessOne(t, f, s, dbgptest.Command("step_into -i 4"))
+	library := "/var/www/Packages/Libraries/vendor/lib/Foo.php"
+	assert.Equal(t, xdebugproxy.ToEngine, dbgptest.ProcessOne(t, f, s, stepResponse("step_into", "4", "break", library, "1")).Direction)
+	out := dbgptest.ProcessOne(t, f, s, stepResponse("step_out", "4", "break", library, "2"))
+	assert.Equal(t, xdebugproxy.ToIDE, out.Direction)
+	assert.Equal(t, "step_into", out.CommandName())
+}
+
+func TestResponseToOtherCommandsAreForwarded(t *testing.T) {
+	f, s := newFilter(t, &config.Config{})
+	m := stepResponse("step_into", "8", "break", "/var/www/Packages/Libraries/vendor/lib/Foo.php", "1")
+	assert.Equal(t, m, dbgptest.ProcessOne(t, f, s, m))
+}
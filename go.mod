@@ -6,5 +6,7 @@ require (
 	github.com/clbanning/mxj v1.8.4
 	github.com/mattn/go-colorable v0.1.4 // indirect
 	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b
+	github.com/stretchr/testify v1.12.1
 	github.com/urfave/cli v1.22.2
+	go.yaml.in/yaml/v3 v3.0.5
 )
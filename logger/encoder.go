@@ -0,0 +1,171 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logger
+
+import (
+	"github.com/mgutz/ansi"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const timeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+var (
+	debugize = ansi.ColorFunc("green+h:black")
+	greenize = ansi.ColorFunc("green")
+	redize   = ansi.ColorFunc("red")
+)
+
+// Field is a key/value of a log entry
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// F return a field
+func F(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// Entry is a log message with its fields
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  []Field
+}
+
+// Encoder format the entries, each encoded entry end with a line break
+type Encoder interface {
+	Encode(e *Entry) []byte
+}
+
+// NewEncoder return the encoder of a format, text, logfmt or json, the text is coloured
+// if color is true
+func NewEncoder(format string, color bool) (Encoder, error) {
+	switch format {
+	case "", "text":
+		return &TextEncoder{Color: color}, nil
+	case "logfmt":
+		return &LogfmtEncoder{}, nil
+	case "json":
+		return &JSONEncoder{}, nil
+	}
+	return nil, fmt.Errorf("invalid log format '%s', use text, logfmt or json", format)
+}
+
+// TextEncoder write the message for humans, the fields follow as key=value, the multiline
+// values on their own lines
+type TextEncoder struct {
+	Color bool
+}
+
+// Encode an entry
+func (t *TextEncoder) Encode(e *Entry) []byte {
+	var line, blocks bytes.Buffer
+	if e.Level == LevelDebug {
+		line.WriteString("[DEBUG] ")
+	}
+	line.WriteString(e.Message)
+	for _, f := range e.Fields {
+		v := value(f.Value)
+		if strings.Contains(v, "\n") {
+			blocks.WriteString("\n" + strings.TrimRight(v, "\n"))
+			continue
+		}
+		line.WriteString(" " + f.Key + "=" + quote(v))
+	}
+	text := line.String()
+	if t.Color {
+		switch e.Level {
+		case LevelDebug:
+			text = debugize(text)
+		case LevelInfo:
+			text = greenize(text)
+		default:
+			text = redize(text)
+		}
+	}
+	return append([]byte(text), append(blocks.Bytes(), '\n')...)
+}
+
+// LogfmtEncoder write the entries as time=... level=... msg=... key=value
+type LogfmtEncoder struct{}
+
+// Encode an entry
+func (LogfmtEncoder) Encode(e *Entry) []byte {
+	var b bytes.Buffer
+	b.WriteString("time=" + e.Time.Format(timeFormat))
+	b.WriteString(" level=" + e.Level.String())
+	b.WriteString(" msg=" + quote(strings.TrimSpace(e.Message)))
+	for _, f := range e.Fields {
+		b.WriteString(" " + f.Key + "=" + quote(value(f.Value)))
+	}
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// JSONEncoder write the entries as JSON Lines, with the time, level and msg keys
+type JSONEncoder struct{}
+
+// Encode an entry
+func (JSONEncoder) Encode(e *Entry) []byte {
+	var b bytes.Buffer
+	b.WriteString(`{"time":"` + e.Time.Format(timeFormat) + `","level":"` + e.Level.String() + `","msg":`)
+	b.Write(marshal(strings.TrimSpace(e.Message)))
+	for _, f := range e.Fields {
+		b.WriteByte(',')
+		b.Write(marshal(f.Key))
+		b.WriteByte(':')
+		b.Write(marshal(f.Value))
+	}
+	b.WriteString("}\n")
+	return b.Bytes()
+}
+
+func marshal(v interface{}) []byte {
+	switch v := v.(type) {
+	case error:
+		return marshal(v.Error())
+	case fmt.Stringer:
+		return marshal(v.String())
+	case []byte:
+		return marshal(string(v))
+	}
+	var b bytes.Buffer
+	e := json.NewEncoder(&b)
+	e.SetEscapeHTML(false)
+	if err := e.Encode(v); err != nil {
+		b.Reset()
+		e.Encode(fmt.Sprint(v))
+	}
+	return bytes.TrimSuffix(b.Bytes(), []byte("\n"))
+}
+
+func value(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// quote a logfmt value if it has spaces, quotes, equal signs or control characters
+func quote(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for _, r := range s {
+		if r == ' ' || r == '"' || r == '=' || unicode.IsControl(r) {
+			return strconv.Quote(s)
+		}
+	}
+	return s
+}
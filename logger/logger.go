@@ -6,7 +6,6 @@ package logger
 
 import (
 	"encoding/xml"
-	"os"
 	"regexp"
 	"strings"
 
@@ -15,16 +14,15 @@ import (
 
 	"bytes"
 	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
 
 	"github.com/mgutz/ansi"
 )
 
-var (
-	debugize          = ansi.ColorFunc("green+h:black")
-	greenize          = ansi.ColorFunc("green")
-	redize            = ansi.ColorFunc("red")
-	regexpFirstNumber = regexp.MustCompile(`^[0-9]*`)
-)
+var regexpFirstNumber = regexp.MustCompile(`^[0-9]*`)
 
 type node struct {
 	Attr     []xml.Attr
@@ -33,30 +31,158 @@ type node struct {
 	Text     string `xml:",chardata"`
 }
 
-// Logger handle log message
+// Logger handle log message, a Logger without a sink write coloured text to stdout if
+// it is a terminal, the debug messages are shown if enabled in the configuration
 type Logger struct {
 	Config *config.Config
+	once   sync.Once
+	sink   *Sink
+	fields []Field
+}
+
+// Sink is where the entries at or above a level are written, shared by a logger and
+// the loggers derived with With
+type Sink struct {
+	mu      sync.Mutex
+	Level   Level
+	Encoder Encoder
+	Out     io.Writer
+	// Color is true if Colorize can use ANSI colours, for the text written to a terminal
+	Color bool
+}
+
+// New create a logger from the configuration: level, format and file with rotation
+func New(c *config.Config) (*Logger, error) {
+	sink := defaultSink(c)
+	if c.LogLevel != "" {
+		level, err := ParseLevel(c.LogLevel)
+		if err != nil {
+			return nil, err
+		}
+		sink.Level = level
+	}
+	if c.LogFile != "" {
+		f, err := OpenFile(c.LogFile, int64(c.LogMaxSize)*1024*1024, c.LogMaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		sink.Out, sink.Color = f, false
+	}
+	if err := sink.setFormat(c.LogFormat); err != nil {
+		return nil, err
+	}
+	return NewWithSink(c, sink), nil
+}
+
+// setFormat set the encoder of a format, the colours are kept for the text only, they
+// would be escaped in the fields of the other formats
+func (s *Sink) setFormat(format string) error {
+	encoder, err := NewEncoder(format, s.Color)
+	if err != nil {
+		return err
+	}
+	if _, ok := encoder.(*TextEncoder); !ok {
+		s.Color = false
+	}
+	s.Encoder = encoder
+	return nil
+}
+
+// NewWithSink create a logger writing to the sink
+func NewWithSink(c *config.Config, sink *Sink) *Logger {
+	return &Logger{Config: c, sink: sink}
+}
+
+func defaultSink(c *config.Config) *Sink {
+	color := isTerminal(os.Stdout)
+	sink := &Sink{Level: LevelWarn, Encoder: &TextEncoder{Color: color}, Out: os.Stdout, Color: color}
+	// the problems only by default, --verbose is info, the sessions, -vv is debug, the
+	// messages exchanged
+	switch {
+	case c == nil:
+	case c.Debug || c.VeryVerbose:
+		sink.Level = LevelDebug
+	case c.Verbose:
+		sink.Level = LevelInfo
+	}
+	return sink
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (l *Logger) getSink() *Sink {
+	l.once.Do(func() {
+		if l.sink == nil {
+			l.sink = defaultSink(l.Config)
+		}
+	})
+	return l.sink
+}
+
+// With return a logger adding the fields to each entry, like the session id
+func (l *Logger) With(fields ...Field) *Logger {
+	if l == nil {
+		return nil
+	}
+	child := NewWithSink(l.Config, l.getSink())
+	child.fields = append(append([]Field{}, l.fields...), fields...)
+	return child
+}
+
+// Enabled return true if the entries of the level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.getSink().Level
+}
+
+// Log write an entry with the fields of the logger and the given fields
+func (l *Logger) Log(level Level, msg string, fields ...Field) {
+	sink := l.getSink()
+	if level < sink.Level {
+		return
+	}
+	if len(l.fields) > 0 {
+		fields = append(append([]Field{}, l.fields...), fields...)
+	}
+	data := sink.Encoder.Encode(&Entry{Time: time.Now(), Level: level, Message: msg, Fields: fields})
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.Out.Write(data)
 }
 
 //Debug output a debug text
 func (l *Logger) Debug(f string, args ...interface{}) {
-	if l.Config.Debug {
-		fmt.Printf(debugize("[DEBUG] "+f)+"\n", args...)
+	if l.Enabled(LevelDebug) {
+		l.Log(LevelDebug, fmt.Sprintf(f, args...))
 	}
 }
 
 //Info output a green text line
 func (l *Logger) Info(f string, args ...interface{}) {
-	fmt.Printf(greenize(f)+"\n", args...)
+	if l.Enabled(LevelInfo) {
+		l.Log(LevelInfo, fmt.Sprintf(f, args...))
+	}
 }
 
 //Warn output a red text line
 func (l *Logger) Warn(f string, args ...interface{}) {
-	fmt.Printf(redize(f)+"\n", args...)
+	if l.Enabled(LevelWarn) {
+		l.Log(LevelWarn, fmt.Sprintf(f, args...))
+	}
+}
+
+//Error output a red text line
+func (l *Logger) Error(f string, args ...interface{}) {
+	l.Log(LevelError, fmt.Sprintf(f, args...))
 }
 
-//Colorize use the Ansi module to colorize output
+//Colorize use the Ansi module to colorize output, only on terminals
 func (l *Logger) Colorize(str, style string) string {
+	if !l.getSink().Color {
+		return str
+	}
 	return ansi.Color(str, style)
 }
 
@@ -73,13 +199,13 @@ func normalizeXMLProtocol(buffer []byte) string {
 	return s
 }
 
-//FormatXMLProtocol beautify XML output
+//FormatXMLProtocol beautify XML output, unparseable XML is returned as is
 func (l *Logger) FormatXMLProtocol(protocol []byte) []byte {
 	p := normalizeXMLProtocol(protocol)
 	output, err := mxj.BeautifyXml([]byte(p), "", "  ")
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		l.Debug("Unable to beautify XML: %s", err)
+		return []byte(p)
 	}
 	return output
 }
@@ -0,0 +1,119 @@
+package logger
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/stretchr/testify/assert"
+
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newLogger(level Level, encoder Encoder) (*Logger, *bytes.Buffer) {
+	out := &bytes.Buffer{}
+	return NewWithSink(&config.Config{}, &Sink{Level: level, Encoder: encoder, Out: out}), out
+}
+
+func TestLevelsAndFields(t *testing.T) {
+	l, out := newLogger(LevelInfo, &LogfmtEncoder{})
+	l.Debug("hidden")
+	s := l.With(F("session", 3))
+	s.Info("Opened %s", "session")
+	s.Log(LevelWarn, "Processing failed", F("command", "eval"), F("transaction_id", "4"), F("error", errors.New("bad xml")))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], ` level=info msg="Opened session" session=3`)
+	assert.Contains(t, lines[1], ` level=warn msg="Processing failed" session=3 command=eval transaction_id=4 error="bad xml"`)
+	assert.False(t, l.Enabled(LevelDebug))
+	assert.True(t, l.Enabled(LevelError))
+}
+
+func TestJSONEncoder(t *testing.T) {
+	l, out := newLogger(LevelDebug, &JSONEncoder{})
+	l.With(F("session", 3)).Log(LevelDebug, "Raw protocol\n", F("direction", LevelInfo), F("data", []byte("<init/>")))
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &entry))
+	assert.Equal(t, "debug", entry["level"])
+	assert.Equal(t, "Raw protocol", entry["msg"])
+	assert.Equal(t, float64(3), entry["session"])
+	assert.Equal(t, "info", entry["direction"])
+	assert.Equal(t, "<init/>", entry["data"])
+	_, err := time.Parse(timeFormat, entry["time"].(string))
+	assert.NoError(t, err)
+}
+
+func TestTextEncoder(t *testing.T) {
+	l, out := newLogger(LevelDebug, &TextEncoder{})
+	l.Debug("Translate %s", "path")
+	l.Log(LevelInfo, "Raw protocol", F("command", "stack_get"), F("data", "<response>\n</response>"))
+	assert.Equal(t, "[DEBUG] Translate path\nRaw protocol command=stack_get\n<response>\n</response>\n", out.String())
+	assert.Equal(t, "plain", l.Colorize("plain", "blue"))
+}
+
+func TestNewFromConfig(t *testing.T) {
+	_, err := New(&config.Config{LogLevel: "verbose"})
+	assert.Error(t, err)
+	_, err = New(&config.Config{LogFormat: "xml"})
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	l, err := New(&config.Config{LogLevel: "warn", LogFormat: "json", LogFile: path})
+	assert.NoError(t, err)
+	l.Info("hidden")
+	l.Warn("Connection denied")
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"level":"warn","msg":"Connection denied"`)
+	assert.NotContains(t, string(data), "hidden")
+}
+
+func TestColorOnlyForText(t *testing.T) {
+	for format, color := range map[string]bool{"text": true, "json": false, "logfmt": false} {
+		sink := &Sink{Color: true}
+		assert.NoError(t, sink.setFormat(format))
+		assert.Equal(t, color, sink.Color, format)
+		l := NewWithSink(&config.Config{}, sink)
+		assert.Equal(t, color, strings.Contains(l.Colorize("path", "yellow"), "\x1b["), format)
+	}
+}
+
+func TestVerbosityIsALevel(t *testing.T) {
+	for c, level := range map[*config.Config]Level{
+		{}:                                    LevelWarn,
+		{Verbose: true}:                       LevelInfo,
+		{Verbose: true, VeryVerbose: true}:    LevelDebug,
+		{Debug: true}:                         LevelDebug,
+		{VeryVerbose: true, LogLevel: "warn"}: LevelWarn,
+		{LogLevel: "info"}:                    LevelInfo,
+	} {
+		l, err := New(c)
+		assert.NoError(t, err)
+		assert.Equal(t, level, l.getSink().Level, "%+v", c)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	f, err := OpenFile(path, 10, 2)
+	assert.NoError(t, err)
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		_, err := f.Write([]byte(line))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, f.Close())
+
+	for name, expected := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+		data, err := ioutil.ReadFile(path + name)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, string(data))
+	}
+	_, err = ioutil.ReadFile(path + ".3")
+	assert.Error(t, err)
+}
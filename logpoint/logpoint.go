@@ -0,0 +1,344 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package logpoint
+
+import (
+	"github.com/dfeyer/flow-debugproxy/breakpointtracker"
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionKey = "logpoint"
+	// SetCommand is the custom command adding a logpoint, like
+	// proxy_logpoint_set -i 1 -f file:///path/to/File.php -n 42 -- base64(template)
+	SetCommand = "proxy_logpoint_set"
+)
+
+var regexpLogpoint = regexp.MustCompile(`^(.+?\.php):(\d+)\s+(.*)$`)
+
+// Logpoint log a message when the engine reach a line, without stopping the script.
+// The expressions between braces in the template are evaluated by the engine.
+type Logpoint struct {
+	ID       string
+	File     string
+	Line     int
+	Template string
+}
+
+// Parse a logpoint definition, like "/path/to/File.php:42 user={$user->getName()}"
+func Parse(definition string) (*Logpoint, error) {
+	match := regexpLogpoint.FindStringSubmatch(definition)
+	if match == nil {
+		return nil, fmt.Errorf("invalid logpoint %q, expected file.php:line template", definition)
+	}
+	line, _ := strconv.Atoi(match[2])
+	return &Logpoint{File: match[1], Line: line, Template: match[3]}, nil
+}
+
+// at check if the logpoint is at the given location
+func (l *Logpoint) at(path string, line int) bool {
+	return l.Line == line && fileuri.ToPath(l.File) == path
+}
+
+// parts split the template in text and expressions, expressions have an odd index
+func (l *Logpoint) parts() []string {
+	parts := []string{""}
+	depth := 0
+	for _, r := range l.Template {
+		switch {
+		case r == '{' && depth == 0:
+			parts = append(parts, "")
+			depth++
+			continue
+		case r == '{':
+			depth++
+		case r == '}' && depth == 1:
+			parts = append(parts, "")
+			depth--
+			continue
+		case r == '}' && depth > 1:
+			depth--
+		}
+		parts[len(parts)-1] += string(r)
+	}
+	return parts
+}
+
+// Logpoints set the logpoints in each session, log the messages and continue the script.
+// It must be placed on the IDE side of the path mappers, logpoints use the paths of the IDE.
+type Logpoints struct {
+	config *config.Config
+	logger *logger.Logger
+
+	mu sync.Mutex
+	// logpoints of the configuration are set in every session
+	logpoints []*Logpoint
+	// custom logpoints set by an IDE are set in the sessions of its idekey only
+	custom map[string][]*Logpoint
+	lastID int
+	file   *os.File
+}
+
+// state is the logpoints of a session, by breakpoint id
+type state struct {
+	sync.Mutex
+	idekey       string
+	byBreakpoint map[string]*Logpoint
+}
+
+// New create the logpoints of the configuration
+func New(c *config.Config, l *logger.Logger) (*Logpoints, error) {
+	p := &Logpoints{config: c, logger: l, custom: map[string][]*Logpoint{}}
+	for _, definition := range c.Logpoints {
+		lp, err := Parse(definition)
+		if err != nil {
+			return nil, err
+		}
+		p.add(lp)
+	}
+	if c.LogpointFile != "" {
+		file, err := os.OpenFile(c.LogpointFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		p.file = file
+	}
+	return p, nil
+}
+
+func (p *Logpoints) add(lp *Logpoint) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastID++
+	lp.ID = strconv.Itoa(p.lastID)
+	p.logpoints = append(p.logpoints, lp)
+}
+
+// addCustom add a logpoint of an IDE, kept for the idekey if any
+func (p *Logpoints) addCustom(lp *Logpoint, idekey string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastID++
+	lp.ID = strconv.Itoa(p.lastID)
+	if idekey != "" {
+		p.custom[idekey] = append(p.custom[idekey], lp)
+	}
+}
+
+// Process set the logpoints after the init packet, and handle the engine stopping on them
+func (p *Logpoints) Process(s *xdebugproxy.Session, m *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+	st := s.LoadOrStore(sessionKey, &state{byBreakpoint: map[string]*Logpoint{}}).(*state)
+	if m.Direction == xdebugproxy.ToEngine {
+		if m.Command.Name != SetCommand {
+			return []*xdebugproxy.Message{m}, nil
+		}
+		return p.set(s, st, m.Command)
+	}
+	h, err := m.Header()
+	if err != nil {
+		return nil, err
+	}
+	if h.Element == "init" {
+		idekey := h.Attr("idekey")
+		st.Lock()
+		st.idekey = idekey
+		st.Unlock()
+		p.mu.Lock()
+		logpoints := append(append([]*Logpoint(nil), p.logpoints...), p.custom[idekey]...)
+		p.mu.Unlock()
+		messages := []*xdebugproxy.Message{m}
+		for _, lp := range logpoints {
+			messages = append(messages, p.breakpoint(s, st, lp, nil))
+		}
+		return messages, nil
+	}
+	// the IDE keep the control of the steps
+	if h.Command() != "run" || h.Status() != "break" {
+		return []*xdebugproxy.Message{m}, nil
+	}
+	lp, path, line := p.hit(st, m)
+	if lp == nil {
+		return []*xdebugproxy.Message{m}, nil
+	}
+	if breakpointtracker.SessionBreakpoints(s).At(path, line) {
+		// the IDE want to stop here too, the engine answer the evals before its commands
+		return append(p.evaluate(s, lp), m), nil
+	}
+	return append(p.evaluate(s, lp), xdebugproxy.NewCommandMessage(dbgp.NewCommand("run", h.TransactionID()))), nil
+}
+
+// set add a logpoint requested by the custom command, for this session and the next
+// sessions of the same idekey
+func (p *Logpoints) set(s *xdebugproxy.Session, st *state, c *dbgp.Command) ([]*xdebugproxy.Message, error) {
+	file, _ := c.Get("f")
+	line, err := strconv.Atoi(argument(c, "n"))
+	template, decodeErr := base64.StdEncoding.DecodeString(c.Data)
+	if file == "" || err != nil || decodeErr != nil {
+		response := dbgp.NewErrorResponse(c.Name, c.TransactionID(), dbgp.ErrorInvalidOptions, "expected -f file -n line -- base64(template)")
+		return []*xdebugproxy.Message{xdebugproxy.NewXMLMessage(response)}, nil
+	}
+	lp := &Logpoint{File: file, Line: line, Template: string(template)}
+	st.Lock()
+	idekey := st.idekey
+	st.Unlock()
+	p.addCustom(lp, idekey)
+	s.Logger.Log(logger.LevelInfo, "Logpoint set", logger.F("logpoint", lp.ID), logger.F("file", lp.File), logger.F("line", lp.Line))
+	return []*xdebugproxy.Message{p.breakpoint(s, st, lp, c)}, nil
+}
+
+// breakpoint set the breakpoint of a logpoint, the custom command is answered once the engine set it
+func (p *Logpoints) breakpoint(s *xdebugproxy.Session, st *state, lp *Logpoint, custom *dbgp.Command) *xdebugproxy.Message {
+	c := dbgp.NewCommand("breakpoint_set", "")
+	c.Set("t", "line")
+	c.Set("f", lp.File)
+	c.Set("n", strconv.Itoa(lp.Line))
+	request := s.Request(c, func(s *xdebugproxy.Session, response *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+		h, err := response.Header()
+		if err != nil {
+			return nil, err
+		}
+		id := h.Attr("id")
+		if id != "" {
+			st.Lock()
+			st.byBreakpoint[id] = lp
+			st.Unlock()
+		} else {
+			s.Logger.Log(logger.LevelWarn, "Unable to set the logpoint", logger.F("logpoint", lp.ID), logger.F("file", lp.File), logger.F("line", lp.Line))
+		}
+		if custom == nil {
+			return nil, nil
+		}
+		if id == "" {
+			return []*xdebugproxy.Message{xdebugproxy.NewXMLMessage(dbgp.NewErrorResponse(custom.Name, custom.TransactionID(), dbgp.ErrorInvalidOptions, "unable to set the breakpoint"))}, nil
+		}
+		return []*xdebugproxy.Message{xdebugproxy.NewXMLMessage(dbgp.NewResponse(custom.Name, custom.TransactionID(), []string{"id", lp.ID}, ""))}, nil
+	})
+	// the path mappers must process the file of the logpoint
+	request.Chain = custom == nil
+	return request
+}
+
+// hit return the logpoint where the engine stopped, and the location
+func (p *Logpoints) hit(st *state, m *xdebugproxy.Message) (*Logpoint, string, int) {
+	doc, err := dbgp.ParseDocument(m.Data())
+	if err != nil {
+		return nil, "", 0
+	}
+	message := doc.Root.Child("xdebug:message")
+	if message == nil {
+		return nil, "", 0
+	}
+	line, err := strconv.Atoi(message.Attr("lineno"))
+	if err != nil {
+		return nil, "", 0
+	}
+	path := fileuri.ToPath(message.Attr("filename"))
+	st.Lock()
+	defer st.Unlock()
+	for _, lp := range st.byBreakpoint {
+		if lp.at(path, line) {
+			return lp, path, line
+		}
+	}
+	return nil, "", 0
+}
+
+// evaluate the expressions of the logpoint, the message is written once they are answered, when
+// the script continue the response to the run command of the IDE is sent by the engine when the
+// script stop again
+func (p *Logpoints) evaluate(s *xdebugproxy.Session, lp *Logpoint) []*xdebugproxy.Message {
+	parts := lp.parts()
+	values := make([]string, len(parts))
+	pending := len(parts) / 2
+	var messages []*xdebugproxy.Message
+	for i, part := range parts {
+		if i%2 == 0 {
+			values[i] = part
+			continue
+		}
+		i := i
+		c := dbgp.NewCommand("eval", "")
+		c.Data = base64.StdEncoding.EncodeToString([]byte(part))
+		messages = append(messages, s.Request(c, func(s *xdebugproxy.Session, response *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+			v, err := value(response)
+			if err != nil {
+				v = "<" + err.Error() + ">"
+			}
+			values[i] = v
+			pending--
+			if pending == 0 {
+				p.write(s, lp, strings.Join(values, ""))
+			}
+			return nil, nil
+		}))
+	}
+	if pending == 0 {
+		p.write(s, lp, lp.Template)
+	}
+	return messages
+}
+
+func (p *Logpoints) write(s *xdebugproxy.Session, lp *Logpoint, message string) {
+	if p.file == nil {
+		s.Logger.Log(logger.LevelInfo, "Logpoint", logger.F("file", lp.File), logger.F("line", lp.Line), logger.F("message", message))
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := fmt.Fprintf(p.file, "%s [session %d] %s:%d %s\n", time.Now().Format(time.RFC3339), s.ID, lp.File, lp.Line, message); err != nil {
+		s.Logger.Log(logger.LevelWarn, "Unable to write the logpoint", logger.F("error", err))
+	}
+}
+
+// value format the result of an eval
+func value(response *xdebugproxy.Message) (string, error) {
+	doc, err := dbgp.ParseDocument(response.Data())
+	if err != nil {
+		return "", err
+	}
+	if e := doc.Root.Child("error"); e != nil {
+		if message := e.Child("message"); message != nil {
+			return "", errors.New(strings.TrimSpace(message.Text))
+		}
+		return "", errors.New("error " + e.Attr("code"))
+	}
+	property := doc.Root.Child("property")
+	if property == nil {
+		return "", errors.New("no value")
+	}
+	switch property.Attr("type") {
+	case "null", "uninitialized":
+		return "null", nil
+	case "bool":
+		if v, _ := property.Value(); v == "1" {
+			return "true", nil
+		}
+		return "false", nil
+	case "array":
+		return "array(" + property.Attr("numchildren") + ")", nil
+	case "object":
+		return property.Attr("classname"), nil
+	}
+	return property.Value()
+}
+
+func argument(c *dbgp.Command, flag string) string {
+	v, _ := c.Get(flag)
+	return v
+}
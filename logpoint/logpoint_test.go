@@ -0,0 +1,134 @@
+package logpoint
+
+import (
+	"github.com/dfeyer/flow-debugproxy/breakpointtracker"
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgptest"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+	"github.com/stretchr/testify/assert"
+
+	"encoding/base64"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const file = "file:///home/dev/project/Packages/Application/Acme.Demo/Classes/Service.php"
+
+func TestParseLogpoint(t *testing.T) {
+	lp, err := Parse("C:/project/Service.php:42 user={$user->getName()} items={count(['a' => 1])}")
+	assert.NoError(t, err)
+	assert.Equal(t, "C:/project/Service.php", lp.File)
+	assert.Equal(t, 42, lp.Line)
+	assert.Equal(t, []string{"user=", "$user->getName()", " items=", "count(['a' => 1])", ""}, lp.parts())
+
+	_, err = Parse("Service.php user")
+	assert.Error(t, err)
+}
+
+// respond answer a request of the proxy with the end of the response element
+func respond(t *testing.T, s *xdebugproxy.Session, request *xdebugproxy.Message, body string) []*xdebugproxy.Message {
+	return dbgptest.Respond(t, s, `<response command="`+request.Command.Name+`" transaction_id="`+request.TransactionID()+`"`+body+`</response>`)
+}
+
+func TestLogAndContinue(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "logpoints.log")
+	c := &config.Config{Logpoints: []string{file + ":20 user={$user} count={$count}"}, LogpointFile: output}
+	l := dbgptest.Logger(c)
+	p, err := New(c, l)
+	assert.NoError(t, err)
+	s := dbgptest.Session(c)
+
+	out, err := p.Process(s, dbgptest.XML(`<init idekey="PHPSTORM"></init>`))
+	assert.NoError(t, err)
+	assert.Len(t, out, 2)
+	assert.True(t, out[1].Chain)
+	assert.Equal(t, "breakpoint_set -i "+out[1].TransactionID()+" -t line -f "+file+" -n 20", out[1].Command.String())
+	assert.Empty(t, respond(t, s, out[1], ` id="7">`))
+
+	out, err = p.Process(s, dbgptest.XML(`<response command="run" transaction_id="12" status="break" reason="ok">`+
+		`<xdebug:message filename="`+file+`" lineno="20"></xdebug:message></response>`))
+	assert.NoError(t, err)
+	assert.Len(t, out, 3)
+	expression, _ := base64.StdEncoding.DecodeString(out[0].Command.Data)
+	assert.Equal(t, "$user", string(expression))
+	assert.Equal(t, "run -i 12", out[2].Command.String())
+
+	respond(t, s, out[0], `><property type="string" encoding="base64"><![CDATA[`+base64.StdEncoding.EncodeToString([]byte("john"))+`]]></property>`)
+	respond(t, s, out[1], `><property type="int"><![CDATA[3]]></property>`)
+
+	log, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Contains(t, string(log), file+":20 user=john count=3\n")
+}
+
+func TestLogBeforeTheBreakOfTheIDE(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "logpoints.log")
+	c := &config.Config{Logpoints: []string{file + ":20 user={$user}"}, LogpointFile: output}
+	l := dbgptest.Logger(c)
+	p, err := New(c, l)
+	assert.NoError(t, err)
+	s := dbgptest.Session(c)
+
+	// the IDE has a breakpoint on the line of the logpoint
+	tracker := breakpointtracker.New(c, l)
+	tracker.Process(s, dbgptest.Command("breakpoint_set -i 3 -t line -f "+file+" -n 20"))
+	tracker.Process(s, dbgptest.XML(`<response command="breakpoint_set" transaction_id="3" id="8"></response>`))
+
+	out, _ := p.Process(s, dbgptest.XML(`<init idekey="PHPSTORM"></init>`))
+	respond(t, s, out[1], ` id="7">`)
+
+	brk := dbgptest.XML(`<response command="run" transaction_id="12" status="break" reason="ok">` +
+		`<xdebug:message filename="` + file + `" lineno="20"></xdebug:message></response>`)
+	out, err = p.Process(s, brk)
+	assert.NoError(t, err)
+	assert.Len(t, out, 2)
+	assert.Equal(t, "eval", out[0].Command.Name)
+	assert.Equal(t, brk, out[1])
+
+	respond(t, s, out[0], `><property type="string" encoding="base64"><![CDATA[`+base64.StdEncoding.EncodeToString([]byte("john"))+`]]></property>`)
+	log, err := ioutil.ReadFile(output)
+	assert.NoError(t, err)
+	assert.Contains(t, string(log), file+":20 user=john\n")
+}
+
+func TestStepsAreNotHandled(t *testing.T) {
+	c := &config.Config{Logpoints: []string{file + ":20 reached"}}
+	l := dbgptest.Logger(c)
+	p, _ := New(c, l)
+	s := dbgptest.Session(c)
+	m := dbgptest.XML(`<response command="step_over" transaction_id="12" status="break" reason="ok">` +
+		`<xdebug:message filename="` + file + `" lineno="20"></xdebug:message></response>`)
+	out, err := p.Process(s, m)
+	assert.NoError(t, err)
+	assert.Equal(t, []*xdebugproxy.Message{m}, out)
+}
+
+func TestCustomLogpointsAreKeptForTheIDEKey(t *testing.T) {
+	c := &config.Config{}
+	p, err := New(c, dbgptest.Logger(c))
+	assert.NoError(t, err)
+	session := func(idekey string) *xdebugproxy.Session {
+		s := dbgptest.Session(c)
+		out, err := p.Process(s, dbgptest.XML(`<init idekey="`+idekey+`"></init>`))
+		assert.NoError(t, err)
+		assert.Len(t, out, 1)
+		return s
+	}
+	set := dbgptest.Command("proxy_logpoint_set -i 3 -f " + file + " -n 20 -- " + base64.StdEncoding.EncodeToString([]byte("reached")))
+
+	out, err := p.Process(session("alice"), set)
+	assert.NoError(t, err)
+	assert.Equal(t, "breakpoint_set", out[0].Command.Name)
+	out, err = p.Process(session(""), set)
+	assert.NoError(t, err)
+	assert.Equal(t, "breakpoint_set", out[0].Command.Name)
+
+	// the next sessions of alice only
+	out, err = p.Process(dbgptest.Session(c), dbgptest.XML(`<init idekey="alice"></init>`))
+	assert.NoError(t, err)
+	assert.Len(t, out, 2)
+	assert.Equal(t, "breakpoint_set -i "+out[1].TransactionID()+" -t line -f "+file+" -n 20", out[1].Command.String())
+	session("bob")
+	session("")
+}
@@ -5,12 +5,30 @@
 package main
 
 import (
+	"github.com/dfeyer/flow-debugproxy/access"
+	"github.com/dfeyer/flow-debugproxy/audit"
+	"github.com/dfeyer/flow-debugproxy/breakpointtracker"
+	"github.com/dfeyer/flow-debugproxy/commandpolicy"
 	"github.com/dfeyer/flow-debugproxy/config"
-
+	"github.com/dfeyer/flow-debugproxy/crashcapture"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
 	"github.com/dfeyer/flow-debugproxy/errorhandler"
+	"github.com/dfeyer/flow-debugproxy/flowdependencyproxy"
+	"github.com/dfeyer/flow-debugproxy/flowpropertyfilter"
+	"github.com/dfeyer/flow-debugproxy/flowstackfilter"
+	"github.com/dfeyer/flow-debugproxy/flowstepfilter"
 	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/logpoint"
+	"github.com/dfeyer/flow-debugproxy/observer"
+	"github.com/dfeyer/flow-debugproxy/parking"
 	"github.com/dfeyer/flow-debugproxy/pathmapperfactory"
 	"github.com/dfeyer/flow-debugproxy/pathmapping"
+	"github.com/dfeyer/flow-debugproxy/pathtranslator"
+	"github.com/dfeyer/flow-debugproxy/proxyprotocol"
+	"github.com/dfeyer/flow-debugproxy/repl"
+	"github.com/dfeyer/flow-debugproxy/script"
+	"github.com/dfeyer/flow-debugproxy/sessionfilter"
+	"github.com/dfeyer/flow-debugproxy/sourceprovider"
 	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
 
 	// Register available path mapper
@@ -19,7 +37,9 @@ import (
 
 	"github.com/urfave/cli"
 
+	"fmt"
 	"net"
+	"net/http"
 	"os"
 	"strings"
 )
@@ -56,13 +76,205 @@ func main() {
 			Value: "flow",
 			Usage: "Framework support, currently on Flow framework (flow) or Dummy (dummy) is supported",
 		},
+		&cli.StringFlag{
+			Name:  "engine-os",
+			Value: "auto",
+			Usage: "Path style of the debugger engine: auto, unix or windows",
+		},
+		&cli.StringFlag{
+			Name:  "ide-os",
+			Value: "auto",
+			Usage: "Path style of the IDE: auto, unix or windows",
+		},
+		&cli.StringSliceFlag{
+			Name:  "path-map",
+			Usage: "Translate an engine directory to an IDE directory, like /var/www=C:\\Projects\\app (repeatable)",
+		},
+		&cli.BoolFlag{
+			Name:  "map-payloads",
+			Usage: "Map file path inside base64 encoded streams and property values",
+		},
+		&cli.BoolFlag{
+			Name:  "hide-frames",
+			Usage: "Hide Flow AOP and proxy plumbing frames in the call stack",
+		},
+		&cli.StringSliceFlag{
+			Name:  "frame-pattern",
+			Usage: "Frame to hide, as where:regexp, file:regexp or flow:proxy, replace the default patterns (repeatable)",
+		},
+		&cli.BoolFlag{
+			Name:  "just-my-code",
+			Usage: "Keep stepping while the engine stop in Flow plumbing or library code",
+		},
+		&cli.StringSliceFlag{
+			Name:  "library-pattern",
+			Usage: "Library location, as [into:|out:]regexp or flow:proxy, replace the default patterns (repeatable)",
+		},
+		&cli.IntFlag{
+			Name:  "step-limit",
+			Value: 100,
+			Usage: "Maximum number of steps skipped in library code",
+		},
+		&cli.BoolFlag{
+			Name:  "hide-injected-properties",
+			Usage: "Hide the properties injected by Flow in the variables view, toggle it with feature_set -n flow_hide_injected_properties",
+		},
+		&cli.StringSliceFlag{
+			Name:  "hidden-property",
+			Usage: "Property to hide, * is a wildcard, replace the default properties (repeatable)",
+		},
+		&cli.BoolFlag{
+			Name:  "resolve-dependency-proxies",
+			Usage: "Replace the lazy DependencyProxy by the real instance in the variables view, the dependency is activated",
+		},
+		&cli.BoolFlag{
+			Name:  "replay-breakpoints",
+			Usage: "Remember the breakpoints by idekey and set them right after the init of the next sessions",
+		},
+		&cli.StringSliceFlag{
+			Name:  "logpoint",
+			Usage: "Log a message when the engine reach a line, like \"/path/to/File.php:42 user={$user->getName()}\" (repeatable)",
+		},
+		&cli.StringFlag{
+			Name:  "logpoint-file",
+			Usage: "Append the logpoint messages to a file instead of the proxy output",
+		},
+		&cli.BoolFlag{
+			Name:  "headless",
+			Usage: "Act as the IDE, write a report of the stack and the local variables on exceptions and detach",
+		},
+		&cli.StringSliceFlag{
+			Name:  "capture-exception",
+			Usage: "Exception class to capture in headless mode, all exceptions by default (repeatable)",
+		},
+		&cli.IntFlag{
+			Name:  "capture-depth",
+			Value: 2,
+			Usage: "Depth of the local variables captured in headless mode",
+		},
+		&cli.StringFlag{
+			Name:  "report-dir",
+			Value: ".",
+			Usage: "Directory of the crash reports in headless mode",
+		},
+		&cli.StringFlag{
+			Name:  "report-format",
+			Value: "json",
+			Usage: "Format of the crash reports in headless mode, json or text",
+		},
+		&cli.StringSliceFlag{
+			Name:  "script",
+			Usage: "Script file, YAML or JSON, run as the IDE of the sessions it match (repeatable)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "session-include",
+			Usage: "Forward only the sessions matching field:regexp, field is idekey, file, uri, sapi or cookie.NAME (repeatable)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "session-exclude",
+			Usage: "Detach the sessions matching field:regexp, field is idekey, file, uri, sapi or cookie.NAME (repeatable)",
+		},
+		&cli.BoolFlag{
+			Name:  "park",
+			Usage: "Hold the sessions at their first break until a developer claim them with the control interface",
+		},
+		&cli.DurationFlag{
+			Name:  "park-timeout",
+			Value: parking.DefaultTimeout,
+			Usage: "Time a session stay parked before it is detached",
+		},
+		&cli.StringFlag{
+			Name:  "control",
+			Value: "127.0.0.1:9020",
+			Usage: "Listen address of the control interface of the parked sessions",
+		},
+		&cli.StringFlag{
+			Name:  "control-token",
+			Usage: "Require this token as bearer token on the control interface",
+		},
+		&cli.StringFlag{
+			Name:  "observer",
+			Usage: "Listen address of the read-only observers, they receive a copy of the traffic of the sessions",
+		},
+		&cli.StringSliceFlag{
+			Name:  "policy",
+			Usage: "Command policy of the matching sessions, like \"idekey:^guest deny:eval,property_set max_depth:2\", the first matching policy apply (repeatable)",
+		},
+		&cli.StringFlag{
+			Name:  "audit-file",
+			Usage: "Append the eval, expr, exec and property_set commands of the IDE, with their result, to a JSON Lines file",
+		},
+		&cli.StringSliceFlag{
+			Name:  "audit-redact",
+			Usage: "Secret to redact in the audit file, as a regexp, only the first group is redacted if any (repeatable)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "engine-allow",
+			Usage: "Accept the engine connections only from this network, like 10.0.0.0/8 (repeatable)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "engine-deny",
+			Usage: "Refuse the engine connections from this network (repeatable)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "control-allow",
+			Usage: "Accept the control and observer connections only from this network (repeatable)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "control-deny",
+			Usage: "Refuse the control and observer connections from this network (repeatable)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "idekey",
+			Usage: "Forward only the sessions of this idekey, the others are detached (repeatable)",
+		},
+		&cli.StringFlag{
+			Name:  "idekey-prefix",
+			Usage: "Forward only the sessions with an idekey starting with this shared secret, the others are detached",
+		},
+		&cli.BoolFlag{
+			Name:  "proxy-protocol",
+			Usage: "Read the PROXY protocol v1 or v2 header sent by a load balancer on the engine connections, the sessions get the address of the client",
+		},
+		&cli.StringSliceFlag{
+			Name:  "proxy-protocol-from",
+			Usage: "Accept the PROXY protocol header only from this network, like the address of the load balancer, required by --proxy-protocol (repeatable)",
+		},
+		&cli.IntFlag{
+			Name:  "max-packet-size",
+			Value: dbgp.DefaultMaxPacketSize >> 20,
+			Usage: "Size in megabytes of the largest packet accepted from the debugger engine, the session is closed above",
+		},
+		&cli.StringFlag{
+			Name:  "log-level",
+			Usage: "Minimum level of the log entries, debug, info, warn or error (default: warn, info with --verbose, debug with -vv or --debug)",
+		},
+		&cli.StringFlag{
+			Name:  "log-format",
+			Value: "text",
+			Usage: "Format of the log entries, text (coloured on a terminal), logfmt or json",
+		},
+		&cli.StringFlag{
+			Name:  "log-file",
+			Usage: "Append the log entries to a file instead of stdout",
+		},
+		&cli.IntFlag{
+			Name:  "log-max-size",
+			Value: 10,
+			Usage: "Size of the log file in megabytes before it is rotated, 0 to never rotate",
+		},
+		&cli.IntFlag{
+			Name:  "log-max-backups",
+			Value: 3,
+			Usage: "Number of rotated log files kept",
+		},
 		&cli.BoolFlag{
 			Name:  "verbose",
-			Usage: "Verbose",
+			Usage: "Log the sessions, same as --log-level info",
 		},
 		&cli.BoolFlag{
 			Name:  "vv",
-			Usage: "Very verbose",
+			Usage: "Log the messages of the sessions, same as --log-level debug",
 		},
 		&cli.BoolFlag{
 			Name:  "debug",
@@ -71,26 +283,66 @@ func main() {
 	}
 
 	app.Action = func(cli *cli.Context) error {
-		c := &config.Config{
-			Context:     cli.String("context"),
-			Framework:   cli.String("framework"),
-			LocalRoot:   strings.TrimRight(cli.String("localroot"), "/"),
-			Verbose:     cli.Bool("verbose") || cli.Bool("vv"),
-			VeryVerbose: cli.Bool("vv"),
-			Debug:       cli.Bool("debug"),
+		c, err := newConfig(cli)
+		if err != nil {
+			return err
 		}
 
-		log := &logger.Logger{
-			Config: c,
+		log, err := logger.New(c)
+		if err != nil {
+			return err
 		}
 
 		laddr, raddr, listener := setupNetworkConnection(cli.String("xdebug"), cli.String("ide"), log)
 
 		log.Info("Debugger from %v\nIDE      from %v\n", laddr, raddr)
 
-		pathMapping := &pathmapping.PathMapping{}
-		pathMapper, err := pathmapperfactory.Create(c, pathMapping, log)
+		processors := newProcessors(c, log)
+
+		engine, err := newEngineAcceptor(c, log)
+		errorhandler.PanicHandling(err, log)
+		controlACL, err := access.NewACL(c.ControlAllow, c.ControlDeny)
+		errorhandler.PanicHandling(err, log)
+
+		dialIDE := xdebugproxy.DialTCP(raddr)
+		capture, err := crashcapture.New(c, log)
+		errorhandler.PanicHandling(err, log)
+		if capture != nil {
+			dialIDE = capture.DialIDE
+		}
+		lot, err := parking.New(c, log)
+		errorhandler.PanicHandling(err, log)
+		if lot != nil {
+			lot.IDE = raddr.String()
+			dialIDE = lot.DialIDE
+			serveControl(cli.String("control"), lot, controlACL, log)
+		}
+		scripts, err := script.New(c, log)
 		errorhandler.PanicHandling(err, log)
+		if scripts != nil {
+			dialIDE = scripts.Dialer(dialIDE)
+		}
+		// first, the unwanted sessions are detached
+		filter, err := sessionfilter.New(c, log)
+		errorhandler.PanicHandling(err, log)
+		if filter != nil {
+			dialIDE = filter.Dialer(dialIDE)
+		}
+		// before anything else, the sessions without a known idekey are detached
+		if idekeys := access.NewIDEKeys(c.IDEKeys, c.IDEKeyPrefix, log); idekeys != nil {
+			dialIDE = idekeys.Dialer(dialIDE)
+		}
+
+		var observers []xdebugproxy.Observer
+		if hub := observer.New(c, log); hub != nil {
+			serveObservers(c.ObserverAddress, hub, controlACL, log)
+			observers = append(observers, hub)
+		}
+		auditor, err := audit.New(c, log)
+		errorhandler.PanicHandling(err, log)
+		if auditor != nil {
+			observers = append(observers, auditor)
+		}
 
 		for {
 			conn, err := listener.AcceptTCP()
@@ -99,16 +351,72 @@ func main() {
 				continue
 			}
 
-			proxy := &xdebugproxy.Proxy{
-				Lconn:      conn,
-				Raddr:      raddr,
-				PathMapper: pathMapper,
-				Config:     c,
-			}
-			go proxy.Start()
+			// the PROXY protocol header is read in the background, a slow client do not
+			// delay the other connections
+			go func() {
+				conn, ok := engine.Accept(conn)
+				if !ok {
+					return
+				}
+				proxy := newProxy(conn, raddr, c, log, processors)
+				proxy.DialIDE = dialIDE
+				proxy.Observers = observers
+				proxy.Start()
+			}()
 		}
 	}
 
+	app.Commands = []cli.Command{
+		{
+			Name:  "repl",
+			Usage: "Accept the engine connections and debug them from the command line",
+			Flags: app.Flags,
+			Action: func(cli *cli.Context) error {
+				c, err := newConfig(cli)
+				if err != nil {
+					return err
+				}
+
+				log, err := logger.New(c)
+				if err != nil {
+					return err
+				}
+
+				laddr, err := net.ResolveTCPAddr("tcp", cli.String("xdebug"))
+				errorhandler.PanicHandling(err, log)
+				listener, err := net.ListenTCP("tcp", laddr)
+				errorhandler.PanicHandling(err, log)
+
+				engine, err := newEngineAcceptor(c, log)
+				errorhandler.PanicHandling(err, log)
+
+				processors := newProcessors(c, log)
+				r := repl.New(os.Stdin, os.Stdout)
+				fmt.Printf("Waiting for the debugger on %v, type help for the commands\n", laddr)
+				for {
+					conn, err := listener.AcceptTCP()
+					if err != nil {
+						log.Warn("Failed to accept connection '%s'\n", err)
+						continue
+					}
+					accepted, ok := engine.Accept(conn)
+					if !ok {
+						continue
+					}
+					proxy := newProxy(accepted, nil, c, log, processors)
+					ide, client := net.Pipe()
+					proxy.DialIDE = func(*dbgp.Header) (net.Conn, error) {
+						return ide, nil
+					}
+					go proxy.Start()
+					if err := r.Session(client); err == repl.ErrQuit {
+						return nil
+					}
+				}
+			},
+		},
+	}
+
 	app.Run(os.Args)
 }
 
@@ -124,3 +432,185 @@ func setupNetworkConnection(xdebugAddr string, ideAddr string, log *logger.Logge
 
 	return laddr, raddr, listener
 }
+
+// engineAcceptor check the engine connections, after the PROXY protocol header if enabled
+type engineAcceptor struct {
+	proxyProtocol bool
+	balancers     *access.ACL
+	acl           *access.ACL
+	logger        *logger.Logger
+}
+
+// newEngineAcceptor create the acceptor, the PROXY protocol require the trusted balancers,
+// the header can be forged by anyone reaching the proxy
+func newEngineAcceptor(c *config.Config, log *logger.Logger) (*engineAcceptor, error) {
+	if c.ProxyProtocol && len(c.ProxyProtocolFrom) == 0 {
+		return nil, fmt.Errorf("--proxy-protocol require --proxy-protocol-from, the address of the load balancer")
+	}
+	a := &engineAcceptor{proxyProtocol: c.ProxyProtocol, logger: log}
+	var err error
+	if a.balancers, err = access.NewACL(c.ProxyProtocolFrom, nil); err != nil {
+		return nil, err
+	}
+	if a.acl, err = access.NewACL(c.EngineAllow, c.EngineDeny); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Accept return the connection with the address of the client, false if it is closed
+func (a *engineAcceptor) Accept(conn net.Conn) (net.Conn, bool) {
+	if a.proxyProtocol {
+		if !a.balancers.Allowed(conn.RemoteAddr()) {
+			a.logger.Log(logger.LevelWarn, "Connection denied, not a trusted PROXY protocol source", logger.F("remote", conn.RemoteAddr()))
+			conn.Close()
+			return nil, false
+		}
+		pconn, err := proxyprotocol.Accept(conn, proxyprotocol.DefaultTimeout)
+		if err != nil {
+			a.logger.Log(logger.LevelWarn, "Connection closed, invalid PROXY protocol header", logger.F("remote", conn.RemoteAddr()), logger.F("error", err))
+			conn.Close()
+			return nil, false
+		}
+		conn = pconn
+	}
+	if !a.acl.Allowed(conn.RemoteAddr()) {
+		a.logger.Log(logger.LevelWarn, "Connection denied", logger.F("remote", conn.RemoteAddr()))
+		conn.Close()
+		return nil, false
+	}
+	return conn, true
+}
+
+// serveControl serve the control interface in the background
+func serveControl(addr string, handler http.Handler, acl *access.ACL, log *logger.Logger) {
+	listener, err := net.Listen("tcp", addr)
+	errorhandler.PanicHandling(err, log)
+	listener = access.Listener(listener, acl, log)
+	log.Info("Control  on %v\n", listener.Addr())
+	go http.Serve(listener, handler)
+}
+
+// serveObservers accept the observers in the background
+func serveObservers(addr string, hub *observer.Hub, acl *access.ACL, log *logger.Logger) {
+	listener, err := net.Listen("tcp", addr)
+	errorhandler.PanicHandling(err, log)
+	listener = access.Listener(listener, acl, log)
+	log.Info("Observer on %v\n", listener.Addr())
+	go hub.Serve(listener)
+}
+
+// newConfig read the configuration from the command line flags
+func newConfig(cli *cli.Context) (*config.Config, error) {
+	c := &config.Config{
+		Context:                  cli.String("context"),
+		Framework:                cli.String("framework"),
+		LocalRoot:                strings.TrimRight(cli.String("localroot"), "/"),
+		EngineOS:                 cli.String("engine-os"),
+		IDEOS:                    cli.String("ide-os"),
+		MapPayloads:              cli.Bool("map-payloads"),
+		HideFrames:               cli.Bool("hide-frames"),
+		FramePatterns:            cli.StringSlice("frame-pattern"),
+		JustMyCode:               cli.Bool("just-my-code"),
+		LibraryPatterns:          cli.StringSlice("library-pattern"),
+		StepLimit:                cli.Int("step-limit"),
+		HideInjectedProperties:   cli.Bool("hide-injected-properties"),
+		HiddenProperties:         cli.StringSlice("hidden-property"),
+		ResolveDependencyProxies: cli.Bool("resolve-dependency-proxies"),
+		ReplayBreakpoints:        cli.Bool("replay-breakpoints"),
+		Logpoints:                cli.StringSlice("logpoint"),
+		LogpointFile:             cli.String("logpoint-file"),
+		Headless:                 cli.Bool("headless"),
+		CaptureExceptions:        cli.StringSlice("capture-exception"),
+		CaptureDepth:             cli.Int("capture-depth"),
+		ReportDir:                cli.String("report-dir"),
+		ReportFormat:             cli.String("report-format"),
+		Scripts:                  cli.StringSlice("script"),
+		SessionIncludes:          cli.StringSlice("session-include"),
+		SessionExcludes:          cli.StringSlice("session-exclude"),
+		Park:                     cli.Bool("park"),
+		ParkTimeout:              cli.Duration("park-timeout"),
+		ObserverAddress:          cli.String("observer"),
+		Policies:                 cli.StringSlice("policy"),
+		AuditFile:                cli.String("audit-file"),
+		AuditRedactions:          cli.StringSlice("audit-redact"),
+		EngineAllow:              cli.StringSlice("engine-allow"),
+		EngineDeny:               cli.StringSlice("engine-deny"),
+		ControlAllow:             cli.StringSlice("control-allow"),
+		ControlDeny:              cli.StringSlice("control-deny"),
+		ControlToken:             cli.String("control-token"),
+		IDEKeys:                  cli.StringSlice("idekey"),
+		IDEKeyPrefix:             cli.String("idekey-prefix"),
+		ProxyProtocol:            cli.Bool("proxy-protocol"),
+		ProxyProtocolFrom:        cli.StringSlice("proxy-protocol-from"),
+		MaxPacketSize:            cli.Int("max-packet-size"),
+		LogLevel:                 cli.String("log-level"),
+		LogFormat:                cli.String("log-format"),
+		LogFile:                  cli.String("log-file"),
+		LogMaxSize:               cli.Int("log-max-size"),
+		LogMaxBackups:            cli.Int("log-max-backups"),
+		Verbose:                  cli.Bool("verbose") || cli.Bool("vv"),
+		VeryVerbose:              cli.Bool("vv"),
+		Debug:                    cli.Bool("debug"),
+	}
+	for _, m := range cli.StringSlice("path-map") {
+		parts := strings.SplitN(m, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid path mapping '%s', use engine-path=ide-path", m)
+		}
+		c.PathPrefixes = append(c.PathPrefixes, config.PathPrefix{Engine: parts[0], IDE: parts[1]})
+	}
+	return c, nil
+}
+
+// newProcessors build the processors chain, ordered from the engine to the IDE
+func newProcessors(c *config.Config, log *logger.Logger) []xdebugproxy.Processor {
+	pathMapping := &pathmapping.PathMapping{}
+	pathMapper, err := pathmapperfactory.Create(c, pathMapping, log)
+	errorhandler.PanicHandling(err, log)
+
+	var processors []xdebugproxy.Processor
+	stepFilter, err := flowstepfilter.New(c, log)
+	errorhandler.PanicHandling(err, log)
+	if stepFilter != nil {
+		processors = append(processors, stepFilter)
+	}
+	stackFilter, err := flowstackfilter.New(c, log)
+	errorhandler.PanicHandling(err, log)
+	if stackFilter != nil {
+		processors = append(processors, stackFilter)
+	}
+	processors = append(processors, sourceprovider.New(c, log, pathMapping), pathMapper, flowpropertyfilter.New(c, log))
+	translator, err := pathtranslator.New(c, log)
+	errorhandler.PanicHandling(err, log)
+	if translator != nil {
+		processors = append(processors, translator)
+	}
+	logpoints, err := logpoint.New(c, log)
+	errorhandler.PanicHandling(err, log)
+	processors = append(processors, logpoints, breakpointtracker.New(c, log))
+	// last, the resolver see the responses sent to the IDE and to its own commands fully processed
+	if resolver := flowdependencyproxy.New(c, log); resolver != nil {
+		processors = append(processors, resolver)
+	}
+	// the policy apply to the commands of the IDE only, not to those of the proxy
+	policy, err := commandpolicy.New(c, log)
+	errorhandler.PanicHandling(err, log)
+	if policy != nil {
+		processors = append(processors, policy)
+	}
+	return processors
+}
+
+func newProxy(conn net.Conn, raddr *net.TCPAddr, c *config.Config, log *logger.Logger, processors []xdebugproxy.Processor) *xdebugproxy.Proxy {
+	proxy := &xdebugproxy.Proxy{
+		Lconn:  conn,
+		Raddr:  raddr,
+		Config: c,
+		Logger: log,
+	}
+	for _, processor := range processors {
+		proxy.RegisterProcessor(processor)
+	}
+	return proxy
+}
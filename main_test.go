@@ -0,0 +1,46 @@
+package main
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/stretchr/testify/assert"
+
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyProtocolRequireTheBalancers(t *testing.T) {
+	c := &config.Config{ProxyProtocol: true}
+	_, err := newEngineAcceptor(c, &logger.Logger{Config: c})
+	assert.Error(t, err)
+}
+
+func TestProxyProtocolFromAnUntrustedSourceIsClosed(t *testing.T) {
+	c := &config.Config{ProxyProtocol: true, ProxyProtocolFrom: []string{"10.0.0.5"}}
+	a, err := newEngineAcceptor(c, &logger.Logger{Config: c})
+	assert.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer client.Close()
+	// a forged header, the connection come from 127.0.0.1
+	client.Write([]byte("PROXY TCP4 10.0.0.5 127.0.0.1 41000 9000\r\n"))
+
+	conn, err := listener.Accept()
+	assert.NoError(t, err)
+	accepted, ok := a.Accept(conn)
+	assert.False(t, ok)
+	assert.Nil(t, accepted)
+
+	// closed, or reset as the header is not read, not timed out
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.Error(t, err)
+	if e, ok := err.(net.Error); ok {
+		assert.False(t, e.Timeout())
+	}
+}
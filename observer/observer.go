@@ -0,0 +1,181 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package observer
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+)
+
+// backlog is the number of messages queued for an observer, a slower observer is disconnected
+const backlog = 256
+
+// session is what a new observer is told about a live session
+type session struct {
+	idekey   string
+	script   string
+	location string
+	stack    []byte
+}
+
+// Hub mirror the traffic of the sessions to read-only observer connections
+type Hub struct {
+	logger    *logger.Logger
+	mu        sync.Mutex
+	observers map[net.Conn]chan []byte
+	sessions  map[uint64]*session
+}
+
+// New create the hub, return nil if no observer address is configured
+func New(c *config.Config, l *logger.Logger) *Hub {
+	if c.ObserverAddress == "" {
+		return nil
+	}
+	return &Hub{logger: l, observers: map[net.Conn]chan []byte{}, sessions: map[uint64]*session{}}
+}
+
+// Serve accept the observers, what they send is ignored
+func (h *Hub) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		h.add(conn)
+	}
+}
+
+func (h *Hub) add(conn net.Conn) {
+	ch := make(chan []byte, backlog)
+	h.mu.Lock()
+	ch <- h.snapshot()
+	h.observers[conn] = ch
+	h.mu.Unlock()
+	h.logger.Info("Observer %s connected", conn.RemoteAddr())
+
+	go func() {
+		defer conn.Close()
+		for b := range ch {
+			if _, err := conn.Write(b); err != nil {
+				h.remove(conn)
+				return
+			}
+		}
+	}()
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		h.remove(conn)
+	}()
+}
+
+func (h *Hub) remove(conn net.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if ch, ok := h.observers[conn]; ok {
+		close(ch)
+		delete(h.observers, conn)
+		h.logger.Info("Observer %s disconnected", conn.RemoteAddr())
+	}
+}
+
+// snapshot describe the live sessions, with their location and last stack
+func (h *Hub) snapshot() []byte {
+	var b bytes.Buffer
+	ids := make([]uint64, 0, len(h.sessions))
+	for id := range h.sessions {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	fmt.Fprintf(&b, "%d live session(s)\n", len(ids))
+	for _, id := range ids {
+		s := h.sessions[id]
+		fmt.Fprintf(&b, "[session %d %s] %s", id, s.idekey, s.script)
+		if s.location != "" {
+			fmt.Fprintf(&b, ", break at %s", s.location)
+		}
+		b.WriteString("\n")
+		if s.stack != nil {
+			b.Write(s.stack)
+			b.WriteString("\n")
+		}
+	}
+	return b.Bytes()
+}
+
+// Observe mirror a message to the observers
+func (h *Hub) Observe(s *xdebugproxy.Session, m *xdebugproxy.Message) {
+	data := m.Bytes()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state, ok := h.sessions[s.ID]
+	if !ok {
+		state = &session{}
+		h.sessions[s.ID] = state
+	}
+	if m.Direction == xdebugproxy.ToIDE {
+		state.track(data)
+	}
+	b := []byte(fmt.Sprintf("[session %d %s] %s\n%s\n", s.ID, state.idekey, m.Direction, data))
+	for conn, ch := range h.observers {
+		select {
+		case ch <- b:
+		default:
+			close(ch)
+			delete(h.observers, conn)
+			h.logger.Warn("Observer %s too slow, disconnected", conn.RemoteAddr())
+		}
+	}
+}
+
+// Closed forget the session
+func (h *Hub) Closed(s *xdebugproxy.Session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.sessions, s.ID)
+	b := []byte(fmt.Sprintf("[session %d] Closed\n", s.ID))
+	for _, ch := range h.observers {
+		select {
+		case ch <- b:
+		default:
+		}
+	}
+}
+
+// track the script, the location and the stack of the session
+func (s *session) track(data []byte) {
+	header, err := dbgp.ParseHeader(data)
+	if err != nil {
+		return
+	}
+	switch {
+	case header.Element == "init":
+		s.idekey = header.Attr("idekey")
+		s.script = fileuri.ToPath(header.Attr("fileuri"))
+	case header.Command() == "stack_get":
+		s.stack = data
+	case header.Status() == "break":
+		s.location, s.stack = "", nil
+		doc, err := dbgp.ParseDocument(data)
+		if err != nil {
+			return
+		}
+		if n := doc.Root.Child("xdebug:message"); n != nil && n.Attr("filename") != "" {
+			s.location = fileuri.ToPath(n.Attr("filename")) + ":" + n.Attr("lineno")
+		}
+	case header.Status() != "":
+		s.location, s.stack = "", nil
+	}
+}
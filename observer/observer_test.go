@@ -0,0 +1,60 @@
+package observer
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+	"github.com/stretchr/testify/assert"
+
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestObserverReceiveTheLocationAndTheTraffic(t *testing.T) {
+	c := &config.Config{ObserverAddress: "127.0.0.1:0"}
+	l := &logger.Logger{Config: c}
+	hub := New(c, l)
+	listener, err := net.Listen("tcp", c.ObserverAddress)
+	assert.NoError(t, err)
+	defer listener.Close()
+	go hub.Serve(listener)
+
+	s := xdebugproxy.NewSession(nil, nil, c, l)
+	prefix := fmt.Sprintf("[session %d PHPSTORM]", s.ID)
+	hub.Observe(s, xdebugproxy.NewXMLMessage([]byte(`<init idekey="PHPSTORM" fileuri="file:///var/www/index.php"></init>`)))
+	hub.Observe(s, xdebugproxy.NewCommandMessage(dbgp.ParseCommand([]byte("run -i 1"))))
+	hub.Observe(s, xdebugproxy.NewXMLMessage([]byte(`<response command="run" transaction_id="1" status="break" reason="ok">`+
+		`<xdebug:message filename="file:///var/www/Service.php" lineno="12"></xdebug:message></response>`)))
+	hub.Observe(s, xdebugproxy.NewXMLMessage([]byte(`<response command="stack_get" transaction_id="2"><stack level="0"></stack></response>`)))
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	line := func() string {
+		l, err := r.ReadString('\n')
+		assert.NoError(t, err)
+		return strings.TrimSuffix(l, "\n")
+	}
+	assert.Equal(t, "1 live session(s)", line())
+	assert.Equal(t, prefix+" /var/www/index.php, break at /var/www/Service.php:12", line())
+	assert.Contains(t, line(), `command="stack_get"`)
+
+	// what the observer send is ignored
+	conn.Write(dbgp.CommandLine([]byte("step_into -i 1")))
+	hub.Observe(s, xdebugproxy.NewCommandMessage(dbgp.ParseCommand([]byte("step_over -i 3"))))
+	assert.Equal(t, prefix+" IDE >>> Debugger", line())
+	assert.Equal(t, "step_over -i 3", line())
+
+	hub.Closed(s)
+	assert.Equal(t, fmt.Sprintf("[session %d] Closed", s.ID), line())
+}
+
+func TestNoHubWithoutAddress(t *testing.T) {
+	c := &config.Config{}
+	assert.Nil(t, New(c, &logger.Logger{Config: c}))
+}
@@ -0,0 +1,113 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parking
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+)
+
+// maxRequestSize is the maximum size of the JSON body of a control request
+const maxRequestSize = 4096
+
+// request is the JSON body of the claim and detach requests
+type request struct {
+	ID  int    `json:"id"`
+	IDE string `json:"ide"`
+}
+
+// ServeHTTP is the control interface of the lot:
+//
+//	GET  /sessions                                list the parked sessions
+//	POST /sessions/claim   {"id":1,"ide":"addr"}  connect a session to an IDE, the default IDE without ide
+//	POST /sessions/detach  {"id":1}               detach a session
+//
+// The changes need a JSON body, a browser can not send it from another site without the
+// consent of the control interface, and the token as bearer if the lot has one.
+func (l *Lot) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !l.authorized(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+	switch r.URL.Path {
+	case "/sessions":
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(l.Sessions())
+	case "/sessions/claim", "/sessions/detach":
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || t != "application/json" {
+			http.Error(w, "expected a JSON body", http.StatusUnsupportedMediaType)
+			return
+		}
+		var req request
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxRequestSize)).Decode(&req); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		if req.ID <= 0 {
+			http.Error(w, "invalid session id", http.StatusBadRequest)
+			return
+		}
+		var err error
+		if r.URL.Path == "/sessions/claim" {
+			if !l.allowedIDE(req.IDE, r.RemoteAddr) {
+				http.Error(w, "the IDE must be the default IDE or listen on your address", http.StatusForbidden)
+				return
+			}
+			err = l.Claim(req.ID, req.IDE)
+		} else {
+			err = l.Detach(req.ID)
+		}
+		switch {
+		case err == ErrUnknownSession:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadGateway)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorized check the bearer token of the request, if the lot has one
+func (l *Lot) authorized(r *http.Request) bool {
+	if l.Token == "" {
+		return true
+	}
+	token := r.Header.Get("Authorization")
+	return subtle.ConstantTimeCompare([]byte(token), []byte("Bearer "+l.Token)) == 1
+}
+
+// allowedIDE check that a session is claimed for the default IDE, or an IDE on the address
+// of the caller, the control interface must not connect the sessions to any host
+func (l *Lot) allowedIDE(addr, remote string) bool {
+	if addr == "" || addr == l.IDE {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	remoteHost, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		return false
+	}
+	ip, remoteIP := net.ParseIP(host), net.ParseIP(remoteHost)
+	return ip != nil && remoteIP != nil && ip.Equal(remoteIP)
+}
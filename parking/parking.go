@@ -0,0 +1,193 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package parking
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgpclient"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/logger"
+
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// DefaultTimeout is the time a session stay parked before it is detached
+const DefaultTimeout = 10 * time.Minute
+
+const uriExpression = "isset($_SERVER['REQUEST_URI']) ? $_SERVER['REQUEST_URI'] : ''"
+
+// ErrUnknownSession is returned for a session not parked, or not anymore
+var ErrUnknownSession = errors.New("unknown session")
+
+// Session is a session paused at its first break, waiting for an IDE
+type Session struct {
+	ID     int       `json:"id"`
+	IDEKey string    `json:"idekey"`
+	Script string    `json:"script"`
+	URI    string    `json:"uri,omitempty"`
+	File   string    `json:"file,omitempty"`
+	Line   int       `json:"line,omitempty"`
+	Parked time.Time `json:"parked"`
+	Age    string    `json:"age"`
+	// release receive the IDE claiming the session, nil to detach it
+	release chan net.Conn
+}
+
+// Lot park the sessions until a developer claim them, or they expire
+type Lot struct {
+	config *config.Config
+	logger *logger.Logger
+	// IDE is the address of the IDE used when a claim does not give one
+	IDE string
+	// Token is required as bearer token by the control interface, if not empty
+	Token    string
+	mu       sync.Mutex
+	sessions map[int]*Session
+	lastID   int
+}
+
+// New create the lot, return nil if the parking mode is disabled
+func New(c *config.Config, l *logger.Logger) (*Lot, error) {
+	if !c.Park {
+		return nil, nil
+	}
+	if c.Headless {
+		return nil, errors.New("the parking mode is not available in headless mode")
+	}
+	return &Lot{config: c, logger: l, Token: c.ControlToken, sessions: map[int]*Session{}}, nil
+}
+
+// DialIDE return the IDE end of an in memory connection, the session is parked on the
+// other end
+func (l *Lot) DialIDE(init *dbgp.Header) (net.Conn, error) {
+	proxy, ide := net.Pipe()
+	go func() {
+		defer ide.Close()
+		if err := l.park(ide); err != nil && err != io.EOF && err != io.ErrClosedPipe {
+			l.logger.Warn("Parking failed: %s", err)
+		}
+	}()
+	return proxy, nil
+}
+
+func (l *Lot) park(conn net.Conn) error {
+	client, err := dbgpclient.New(conn)
+	if err != nil {
+		return err
+	}
+	s := &Session{
+		IDEKey:  client.Init.Root.Attr("idekey"),
+		Script:  fileuri.ToPath(client.Init.Root.Attr("fileuri")),
+		Parked:  time.Now(),
+		release: make(chan net.Conn, 1),
+	}
+	if v, err := client.Eval(uriExpression); err == nil {
+		s.URI = v.Value
+	}
+	status, err := client.Continue("step_into")
+	if err != nil {
+		return err
+	}
+	if status.Status != "break" {
+		return nil
+	}
+	s.File, s.Line = fileuri.ToPath(status.File), status.Line
+
+	l.mu.Lock()
+	l.lastID++
+	s.ID = l.lastID
+	l.sessions[s.ID] = s
+	l.mu.Unlock()
+	l.logger.Info("Session %d of %s parked (idekey %s)", s.ID, s.Script, s.IDEKey)
+
+	timeout := l.config.ParkTimeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	var ide net.Conn
+	select {
+	case ide = <-s.release:
+	case <-timer.C:
+		if l.remove(s.ID) == nil {
+			// claimed or detached meanwhile
+			ide = <-s.release
+		} else {
+			l.logger.Info("Session %d expired", s.ID)
+		}
+	}
+	if ide == nil {
+		_, err := client.Command("detach", nil, "")
+		return err
+	}
+	l.logger.Info("Session %d claimed by %s", s.ID, ide.RemoteAddr())
+	return client.Splice(ide)
+}
+
+func (l *Lot) remove(id int) *Session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.sessions[id]
+	delete(l.sessions, id)
+	return s
+}
+
+// Sessions return the parked sessions, the oldest first
+func (l *Lot) Sessions() []Session {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sessions := make([]Session, 0, len(l.sessions))
+	for _, s := range l.sessions {
+		c := *s
+		c.Age = time.Since(s.Parked).Round(time.Second).String()
+		sessions = append(sessions, c)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ID < sessions[j].ID
+	})
+	return sessions
+}
+
+// Claim connect a parked session to the IDE listening on addr, the default IDE if empty
+func (l *Lot) Claim(id int, addr string) error {
+	if addr == "" {
+		addr = l.IDE
+	}
+	l.mu.Lock()
+	_, ok := l.sessions[id]
+	l.mu.Unlock()
+	if !ok {
+		return ErrUnknownSession
+	}
+	ide, err := net.Dial("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to connect to the IDE %s: %s", addr, err)
+	}
+	if s := l.remove(id); s != nil {
+		s.release <- ide
+		return nil
+	}
+	// detached or claimed meanwhile
+	ide.Close()
+	return ErrUnknownSession
+}
+
+// Detach a parked session, the script run to its end
+func (l *Lot) Detach(id int) error {
+	s := l.remove(id)
+	if s == nil {
+		return ErrUnknownSession
+	}
+	s.release <- nil
+	return nil
+}
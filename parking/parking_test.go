@@ -0,0 +1,155 @@
+package parking
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgptest"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/stretchr/testify/assert"
+
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var responses = map[string]string{
+	"eval":      `><property type="string" encoding="base64"><![CDATA[` + base64.StdEncoding.EncodeToString([]byte("/shop/checkout")) + `]]></property>`,
+	"step_into": ` status="break" reason="ok"><xdebug:message filename="file:///var/www/index.php" lineno="3"></xdebug:message>`,
+	"run":       ` status="stopping" reason="ok">`,
+	"detach":    ` status="stopping" reason="ok">`,
+}
+
+func park(t *testing.T, timeout time.Duration) (*Lot, chan *dbgp.Command) {
+	c := &config.Config{Park: true, ParkTimeout: timeout}
+	lot, err := New(c, &logger.Logger{Config: c})
+	assert.NoError(t, err)
+	conn, err := lot.DialIDE(&dbgp.Header{})
+	assert.NoError(t, err)
+	commands := make(chan *dbgp.Command, 10)
+	go (&dbgptest.Engine{Respond: dbgptest.Responses(responses), Commands: commands}).Serve(conn)
+	assert.Equal(t, "eval", (<-commands).Name)
+	assert.Equal(t, "step_into", (<-commands).Name)
+	for i := 0; i < 100 && len(lot.Sessions()) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	return lot, commands
+}
+
+func TestParkedSessionIsClaimedByAnIDE(t *testing.T) {
+	lot, commands := park(t, time.Minute)
+
+	rec := httptest.NewRecorder()
+	lot.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	var sessions []Session
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &sessions))
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, 1, sessions[0].ID)
+		assert.Equal(t, "PHPSTORM", sessions[0].IDEKey)
+		assert.Equal(t, "/var/www/index.php", sessions[0].Script)
+		assert.Equal(t, "/shop/checkout", sessions[0].URI)
+		assert.Equal(t, 3, sessions[0].Line)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	lot.IDE = listener.Addr().String()
+	rec = control(lot, "/sessions/claim", `{"id":1}`)
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, lot.Sessions())
+
+	ide, err := listener.Accept()
+	assert.NoError(t, err)
+	r := dbgp.NewReader(ide)
+	data, err := r.ReadPacket()
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `idekey="PHPSTORM"`)
+	ide.Write(dbgp.CommandLine([]byte("run -i 1")))
+	data, err = r.ReadPacket()
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `command="run" transaction_id="1"`)
+	assert.Equal(t, "run", (<-commands).Name)
+	ide.Close()
+
+	rec = control(lot, "/sessions/detach", `{"id":1}`)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+// control send a JSON request to the control interface of the lot, from 127.0.0.1
+func control(lot *Lot, path, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	r.RemoteAddr = "127.0.0.1:40000"
+	rec := httptest.NewRecorder()
+	lot.ServeHTTP(rec, r)
+	return rec
+}
+
+func TestControlNeedAJSONBody(t *testing.T) {
+	lot, commands := park(t, time.Minute)
+
+	// a form, like a cross site request, is rejected
+	rec := httptest.NewRecorder()
+	lot.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/sessions/detach?id=1", nil))
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+	r := httptest.NewRequest(http.MethodPost, "/sessions/detach", strings.NewReader("id=1"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	lot.ServeHTTP(rec, r)
+	assert.Equal(t, http.StatusUnsupportedMediaType, rec.Code)
+	assert.Len(t, lot.Sessions(), 1)
+
+	assert.Equal(t, http.StatusBadRequest, control(lot, "/sessions/detach", `id=1`).Code)
+	assert.Equal(t, http.StatusNoContent, control(lot, "/sessions/detach", `{"id":1}`).Code)
+	assert.Equal(t, "detach", (<-commands).Name)
+}
+
+func TestClaimOnlyForTheDefaultIDEOrTheCaller(t *testing.T) {
+	lot, _ := park(t, time.Minute)
+	lot.IDE = "10.0.0.1:9000"
+
+	assert.Equal(t, http.StatusForbidden, control(lot, "/sessions/claim", `{"id":1,"ide":"192.0.2.1:9000"}`).Code)
+	assert.Equal(t, http.StatusForbidden, control(lot, "/sessions/claim", `{"id":1,"ide":"localhost:9000"}`).Code)
+	assert.Len(t, lot.Sessions(), 1)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	assert.Equal(t, http.StatusNoContent, control(lot, "/sessions/claim", `{"id":1,"ide":"`+listener.Addr().String()+`"}`).Code)
+	ide, err := listener.Accept()
+	assert.NoError(t, err)
+	ide.Close()
+}
+
+func TestControlToken(t *testing.T) {
+	c := &config.Config{Park: true, ControlToken: "s3cr3t"}
+	lot, err := New(c, &logger.Logger{Config: c})
+	assert.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	lot.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/sessions", nil))
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	r := httptest.NewRequest(http.MethodGet, "/sessions", nil)
+	r.Header.Set("Authorization", "Bearer s3cr3t")
+	rec = httptest.NewRecorder()
+	lot.ServeHTTP(rec, r)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestParkedSessionIsDetachedWhenItExpire(t *testing.T) {
+	lot, commands := park(t, 10*time.Millisecond)
+	assert.Equal(t, "detach", (<-commands).Name)
+	assert.Empty(t, lot.Sessions())
+}
+
+func TestParkingIsNotAvailableInHeadlessMode(t *testing.T) {
+	c := &config.Config{Park: true, Headless: true}
+	_, err := New(c, &logger.Logger{Config: c})
+	assert.Error(t, err)
+}
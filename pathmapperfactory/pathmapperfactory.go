@@ -13,15 +13,20 @@ import (
 	"errors"
 )
 
-var pathMapperRegistry = map[string]xdebugproxy.XDebugProcessorPlugin{}
+var pathMapperRegistry = map[string]xdebugproxy.PathMapper{}
 
-// Register a path mapper
+// Register a legacy path mapper
 func Register(f string, p xdebugproxy.XDebugProcessorPlugin) {
+	RegisterPathMapper(f, &xdebugproxy.LegacyProcessor{Plugin: p})
+}
+
+// RegisterPathMapper register a path mapper
+func RegisterPathMapper(f string, p xdebugproxy.PathMapper) {
 	pathMapperRegistry[f] = p
 }
 
 // Create return a pathmapper for the given framework
-func Create(c *config.Config, p *pathmapping.PathMapping, l *logger.Logger) (xdebugproxy.XDebugProcessorPlugin, error) {
+func Create(c *config.Config, p *pathmapping.PathMapping, l *logger.Logger) (xdebugproxy.PathMapper, error) {
 	if _, exist := pathMapperRegistry[c.Framework]; exist {
 		pathmapper := pathMapperRegistry[c.Framework]
 		pathmapper.Initialize(c, l, p)
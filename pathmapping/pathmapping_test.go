@@ -0,0 +1,34 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathmapping
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConcurrentSessions(t *testing.T) {
+	p := &PathMapping{}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				path := fmt.Sprintf("/Data/Temporary/Cache/Foo_%d_%d.php", i, j)
+				p.Set(path, fmt.Sprintf("/Packages/Foo_%d_%d.php", i, j))
+				original, ok := p.Get(path)
+				assert.True(t, ok)
+				assert.Equal(t, fmt.Sprintf("/Packages/Foo_%d_%d.php", i, j), original)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.True(t, p.Has("/Data/Temporary/Cache/Foo_7_99.php"))
+	assert.False(t, p.Has("/Data/Temporary/Cache/Bar.php"))
+}
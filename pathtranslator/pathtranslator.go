@@ -0,0 +1,109 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package pathtranslator
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+
+	"regexp"
+	"strings"
+)
+
+var regexpFileAttribute = regexp.MustCompile(`\b(filename|fileuri)="([^"]*)"`)
+
+// Translator translate file URIs between the OS style of the debugger engine and the OS style of the IDE
+type Translator struct {
+	config      *config.Config
+	logger      *logger.Logger
+	engineStyle fileuri.Style
+	ideStyle    fileuri.Style
+}
+
+// New create a translator, it return nil if there is nothing to translate
+func New(c *config.Config, l *logger.Logger) (*Translator, error) {
+	engineStyle, err := fileuri.ParseStyle(c.EngineOS)
+	if err != nil {
+		return nil, err
+	}
+	ideStyle, err := fileuri.ParseStyle(c.IDEOS)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.PathPrefixes) == 0 && engineStyle == ideStyle {
+		return nil, nil
+	}
+	return &Translator{
+		config:      c,
+		logger:      l,
+		engineStyle: engineStyle,
+		ideStyle:    ideStyle,
+	}, nil
+}
+
+// Process translate file URIs of the message
+func (t *Translator) Process(s *xdebugproxy.Session, m *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+	if m.Direction == xdebugproxy.ToEngine {
+		if uri, ok := m.Command.Get("f"); ok {
+			m.Command.Set("f", t.ToEngine(uri))
+		}
+		return []*xdebugproxy.Message{m}, nil
+	}
+	data := regexpFileAttribute.ReplaceAllFunc(m.Data(), func(attr []byte) []byte {
+		match := regexpFileAttribute.FindSubmatch(attr)
+		return []byte(string(match[1]) + `="` + t.ToIDE(string(match[2])) + `"`)
+	})
+	m.SetData(data)
+	return []*xdebugproxy.Message{m}, nil
+}
+
+// ToIDE translate an engine file URI to an IDE file URI
+func (t *Translator) ToIDE(uri string) string {
+	return t.translate(uri, t.engineStyle, t.ideStyle, func(p config.PathPrefix) (string, string) {
+		return p.Engine, p.IDE
+	})
+}
+
+// ToEngine translate an IDE file URI to an engine file URI
+func (t *Translator) ToEngine(uri string) string {
+	return t.translate(uri, t.ideStyle, t.engineStyle, func(p config.PathPrefix) (string, string) {
+		return p.IDE, p.Engine
+	})
+}
+
+func (t *Translator) translate(uri string, from, to fileuri.Style, prefix func(config.PathPrefix) (string, string)) string {
+	isURI := fileuri.IsURI(uri)
+	path := fileuri.ToPath(uri)
+	if from == fileuri.Auto {
+		// detected per message, an engine or an IDE can use both styles
+		from = fileuri.DetectStyle(path)
+	}
+	translated := from.Normalize(path)
+	for _, p := range t.config.PathPrefixes {
+		source, target := prefix(p)
+		if from.HasPrefix(translated, source) {
+			source = strings.TrimRight(from.Normalize(source), "/")
+			translated = strings.TrimRight(to.Normalize(target), "/") + translated[len(source):]
+			break
+		}
+	}
+	if to == fileuri.Auto {
+		to = fileuri.DetectStyle(translated)
+	}
+	translated = to.Normalize(translated)
+	if translated == path {
+		return uri
+	}
+	t.logger.Debug("Translate path %s >>> %s", path, translated)
+	if isURI {
+		return fileuri.FromPath(translated)
+	}
+	if to == fileuri.Windows {
+		return strings.Replace(translated, "/", `\`, -1)
+	}
+	return translated
+}
@@ -0,0 +1,55 @@
+package pathtranslator
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newTranslator(t *testing.T, c *config.Config) *Translator {
+	translator, err := New(c, &logger.Logger{Config: c})
+	assert.NoError(t, err)
+	return translator
+}
+
+func TestNoTranslationWithoutConfiguration(t *testing.T) {
+	translator := newTranslator(t, &config.Config{EngineOS: "auto", IDEOS: "auto"})
+	assert.Nil(t, translator)
+}
+
+func TestLinuxEngineAndWindowsIDE(t *testing.T) {
+	translator := newTranslator(t, &config.Config{
+		EngineOS:     "unix",
+		IDEOS:        "windows",
+		PathPrefixes: []config.PathPrefix{{Engine: "/var/www", IDE: `c:\Projects\My App`}},
+	})
+	assert.Equal(t, "file:///C:/Projects/My%20App/Packages/Foo.php", translator.ToIDE("file:///var/www/Packages/Foo.php"))
+	assert.Equal(t, "file:///var/www/Packages/Foo.php", translator.ToEngine("file:///c:/projects/my%20app/Packages/Foo.php"))
+	assert.Equal(t, "file:///var/wwwroot/Foo.php", translator.ToIDE("file:///var/wwwroot/Foo.php"))
+}
+
+func TestWindowsEngineAndLinuxIDE(t *testing.T) {
+	translator := newTranslator(t, &config.Config{
+		PathPrefixes: []config.PathPrefix{{Engine: `C:\inetpub\app`, IDE: "/home/me/app"}},
+	})
+	assert.Equal(t, "file:///home/me/app/index.php", translator.ToIDE("file:///c:/inetpub/app/index.php"))
+	assert.Equal(t, "file:///C:/inetpub/app/index.php", translator.ToEngine("file:///home/me/app/index.php"))
+}
+
+func TestProcessRewriteFileAttributesAndCommands(t *testing.T) {
+	translator := newTranslator(t, &config.Config{
+		PathPrefixes: []config.PathPrefix{{Engine: "/data", IDE: "C:/app"}},
+	})
+	m := xdebugproxy.NewXMLMessage([]byte(`<response command="stack_get"><stack level="0" filename="file:///data/index.php" lineno="3"></stack></response>`))
+	out, err := translator.Process(nil, m)
+	assert.NoError(t, err)
+	assert.Equal(t, `<response command="stack_get"><stack level="0" filename="file:///C:/app/index.php" lineno="3"></stack></response>`, string(out[0].Data()))
+
+	c := xdebugproxy.NewCommandMessage(dbgp.ParseCommand([]byte("breakpoint_set -i 1 -t line -f file:///C:/app/index.php -n 3")))
+	out, err = translator.Process(nil, c)
+	assert.NoError(t, err)
+	assert.Equal(t, "breakpoint_set -i 1 -t line -f file:///data/index.php -n 3", out[0].Command.String())
+}
@@ -0,0 +1,155 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package proxyprotocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is the time given to the load balancer to send the header
+const DefaultTimeout = 5 * time.Second
+
+// maxV1Length is the maximum length of a version 1 header, with the CRLF
+const maxV1Length = 107
+
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// ErrNoHeader is returned when the connection does not start with a PROXY protocol header
+var ErrNoHeader = errors.New("missing PROXY protocol header")
+
+// Conn is a connection with the addresses of the client given by the PROXY protocol header
+type Conn struct {
+	net.Conn
+	reader      *bufio.Reader
+	source      net.Addr
+	destination net.Addr
+}
+
+// Accept read the version 1 or 2 header at the start of the connection, the header is
+// required, a LOCAL or UNKNOWN header keep the addresses of the connection
+func Accept(conn net.Conn, timeout time.Duration) (*Conn, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	c := &Conn{Conn: conn, reader: bufio.NewReader(conn)}
+	signature, err := c.reader.Peek(len(v2Signature))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(signature, v2Signature):
+		err = c.readV2()
+	case bytes.HasPrefix(signature, []byte("PROXY ")):
+		err = c.readV1()
+	default:
+		err = ErrNoHeader
+	}
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// readV1 read a header like PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func (c *Conn) readV1() error {
+	line, err := c.reader.ReadSlice('\n')
+	if err != nil && err != bufio.ErrBufferFull {
+		return err
+	}
+	if len(line) > maxV1Length || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return errors.New("invalid PROXY protocol header")
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("invalid PROXY protocol header %q", strings.TrimSpace(string(line)))
+	}
+	if c.source, err = tcpAddr(fields[2], fields[4]); err != nil {
+		return err
+	}
+	c.destination, err = tcpAddr(fields[3], fields[5])
+	return err
+}
+
+func tcpAddr(host, port string) (*net.TCPAddr, error) {
+	ip := net.ParseIP(host)
+	p, err := strconv.ParseUint(port, 10, 16)
+	if ip == nil || err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol address %s:%s", host, port)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(p)}, nil
+}
+
+// readV2 read a binary header, only the TCP and UDP over IPv4 or IPv6 addresses are used
+func (c *Conn) readV2() error {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(c.reader, header); err != nil {
+		return err
+	}
+	if header[12]>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY protocol version %d", header[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		return err
+	}
+	command, family := header[12]&0x0f, header[13]>>4
+	if command == 0 {
+		// LOCAL, like a health check of the load balancer
+		return nil
+	}
+	if command != 1 {
+		return fmt.Errorf("unsupported PROXY protocol command %d", command)
+	}
+	size := 0
+	switch family {
+	case 1:
+		size = net.IPv4len
+	case 2:
+		size = net.IPv6len
+	default:
+		return nil
+	}
+	if len(payload) < 2*size+4 {
+		return errors.New("truncated PROXY protocol addresses")
+	}
+	ports := payload[2*size:]
+	c.source = &net.TCPAddr{IP: net.IP(payload[:size]), Port: int(binary.BigEndian.Uint16(ports[0:2]))}
+	c.destination = &net.TCPAddr{IP: net.IP(payload[size : 2*size]), Port: int(binary.BigEndian.Uint16(ports[2:4]))}
+	return nil
+}
+
+// Read from the connection, after the header
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// RemoteAddr return the address of the client
+func (c *Conn) RemoteAddr() net.Addr {
+	if c.source != nil {
+		return c.source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr return the address the client connected to
+func (c *Conn) LocalAddr() net.Addr {
+	if c.destination != nil {
+		return c.destination
+	}
+	return c.Conn.LocalAddr()
+}
@@ -0,0 +1,78 @@
+package proxyprotocol
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+const initPacket = "12\x00<init></init>\x00"
+
+// accept send the data on a pipe and read the header from the other end
+func accept(t *testing.T, data []byte) (*Conn, error) {
+	engine, proxy := net.Pipe()
+	go func() {
+		engine.Write(data)
+		engine.Close()
+	}()
+	return Accept(proxy, DefaultTimeout)
+}
+
+func v2(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, v2Signature...)
+	header = append(header, 0x20|command, family, 0, 0)
+	binary.BigEndian.PutUint16(header[14:16], uint16(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestVersion1(t *testing.T) {
+	c, err := accept(t, []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 9000\r\n"+initPacket))
+	assert.NoError(t, err)
+	assert.Equal(t, "192.168.0.1:56324", c.RemoteAddr().String())
+	assert.Equal(t, "192.168.0.11:9000", c.LocalAddr().String())
+	data, err := ioutil.ReadAll(c)
+	assert.NoError(t, err)
+	assert.Equal(t, initPacket, string(data))
+
+	c, err = accept(t, []byte("PROXY TCP6 fd00::1 fd00::2 56324 9000\r\n"+initPacket))
+	assert.NoError(t, err)
+	assert.Equal(t, "[fd00::1]:56324", c.RemoteAddr().String())
+
+	c, err = accept(t, []byte("PROXY UNKNOWN\r\n"+initPacket))
+	assert.NoError(t, err)
+	assert.Equal(t, "pipe", c.RemoteAddr().String())
+}
+
+func TestVersion2(t *testing.T) {
+	addresses := []byte{10, 1, 2, 3, 10, 0, 0, 1, 0xdc, 0x04, 0x23, 0x28}
+	c, err := accept(t, append(v2(1, 0x11, addresses), initPacket...))
+	assert.NoError(t, err)
+	assert.Equal(t, "10.1.2.3:56324", c.RemoteAddr().String())
+	assert.Equal(t, "10.0.0.1:9000", c.LocalAddr().String())
+	data, err := ioutil.ReadAll(c)
+	assert.NoError(t, err)
+	assert.Equal(t, initPacket, string(data))
+
+	addresses = append(net.ParseIP("fd00::1"), net.ParseIP("fd00::2")...)
+	c, err = accept(t, append(v2(1, 0x21, append(addresses, 0xdc, 0x04, 0x23, 0x28)), initPacket...))
+	assert.NoError(t, err)
+	assert.Equal(t, "[fd00::1]:56324", c.RemoteAddr().String())
+
+	c, err = accept(t, append(v2(0, 0x00, nil), initPacket...))
+	assert.NoError(t, err)
+	assert.Equal(t, "pipe", c.RemoteAddr().String())
+}
+
+func TestInvalidHeader(t *testing.T) {
+	_, err := accept(t, []byte(initPacket+"                "))
+	assert.Equal(t, ErrNoHeader, err)
+	_, err = accept(t, []byte("PROXY TCP4 192.168.0.1 56324\r\n"+initPacket))
+	assert.Error(t, err)
+	_, err = accept(t, []byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 90000\r\n"+initPacket))
+	assert.Error(t, err)
+	_, err = accept(t, append(v2(1, 0x11, []byte{10, 1, 2, 3}), initPacket...))
+	assert.Error(t, err)
+}
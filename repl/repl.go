@@ -0,0 +1,276 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package repl
+
+import (
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgpclient"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	prompt = "(fdp) "
+	// context is the number of source lines shown around the current line
+	context = 3
+)
+
+// ErrQuit is returned by Session when the user quit the REPL
+var ErrQuit = errors.New("quit")
+
+// usageError is a mistake of the user, the session continue
+type usageError string
+
+func (e usageError) Error() string {
+	return string(e)
+}
+
+// continuations are the commands of the REPL moving the engine
+var continuations = map[string]string{
+	"step": "step_into",
+	"next": "step_over",
+	"out":  "step_out",
+	"run":  "run",
+}
+
+const help = `break file:line     set a breakpoint, for this session and the next ones
+step, next, out     step into, over or out
+run                 run until the next breakpoint
+bt                  show the call stack
+locals [level]      show the local variables of a frame
+print expr          evaluate an expression
+source [file:line]  show the source around the current or given line
+detach              let the script end without the debugger
+quit                detach and quit`
+
+// REPL is a minimal command line debugger client, it read the commands of the user
+// and debug the sessions one after the other
+type REPL struct {
+	in  *bufio.Scanner
+	out io.Writer
+	// breakpoints are set in every session, as file:line
+	breakpoints []string
+}
+
+// session is the state of the current debugging session
+type session struct {
+	client *dbgpclient.Client
+	file   string
+	line   int
+}
+
+// New create a REPL reading the commands of the user
+func New(in io.Reader, out io.Writer) *REPL {
+	return &REPL{in: bufio.NewScanner(in), out: out}
+}
+
+// Session debug a session from its start to its end, the connection is the IDE side
+// of the proxy, it return ErrQuit if the user quit the REPL
+func (r *REPL) Session(conn io.ReadWriteCloser) error {
+	defer conn.Close()
+	client, err := dbgpclient.New(conn)
+	if err != nil {
+		return err
+	}
+	client.OnPacket = r.stream
+	s := &session{client: client}
+	fmt.Fprintf(r.out, "Session %s started, %s\n", client.Init.Root.Attr("idekey"), fileuri.ToPath(client.Init.Root.Attr("fileuri")))
+	for _, bp := range r.breakpoints {
+		if err := r.breakpoint(s, bp); err != nil {
+			fmt.Fprintf(r.out, "Unable to set breakpoint %s: %s\n", bp, err)
+		}
+	}
+	for {
+		fmt.Fprint(r.out, prompt)
+		if !r.in.Scan() {
+			client.Command("detach", nil, "")
+			return ErrQuit
+		}
+		done, err := r.exec(s, strings.TrimSpace(r.in.Text()))
+		if err == ErrQuit {
+			return err
+		}
+		if err != nil {
+			_, engineError := err.(*dbgpclient.Error)
+			if _, usage := err.(usageError); !engineError && !usage {
+				// the connection is lost
+				fmt.Fprintf(r.out, "Session ended: %s\n", err)
+				return nil
+			}
+			fmt.Fprintln(r.out, err)
+		}
+		if done {
+			fmt.Fprintln(r.out, "Session ended, waiting for the next one")
+			return nil
+		}
+	}
+}
+
+// exec run a command of the user, it return true when the session ended
+func (r *REPL) exec(s *session, line string) (bool, error) {
+	name, arg := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		name, arg = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	if command, ok := continuations[name]; ok {
+		return r.continuation(s, command)
+	}
+	switch name {
+	case "":
+		return false, nil
+	case "help", "h":
+		fmt.Fprintln(r.out, help)
+	case "break", "b":
+		if err := r.breakpoint(s, arg); err != nil {
+			return false, err
+		}
+		r.breakpoints = append(r.breakpoints, arg)
+	case "bt":
+		frames, err := s.client.Stack()
+		if err != nil {
+			return false, err
+		}
+		for _, f := range frames {
+			fmt.Fprintf(r.out, "#%d %s at %s:%d\n", f.Level, f.Where, fileuri.ToPath(f.File), f.Line)
+		}
+	case "locals":
+		level, _ := strconv.Atoi(arg)
+		vars, err := s.client.Locals(level)
+		if err != nil {
+			return false, err
+		}
+		for _, v := range vars {
+			fmt.Fprintf(r.out, "%s = %s\n", v.Name, v)
+		}
+	case "print", "p":
+		v, err := s.client.Eval(arg)
+		if err != nil {
+			return false, err
+		}
+		r.print(v, 0)
+	case "source", "list":
+		file, line := s.file, s.line
+		if arg != "" {
+			var err error
+			if file, line, err = location(arg); err != nil {
+				return false, err
+			}
+		}
+		return false, r.source(s, file, line)
+	case "detach":
+		_, err := s.client.Command("detach", nil, "")
+		return true, err
+	case "quit", "q":
+		s.client.Command("detach", nil, "")
+		return true, ErrQuit
+	default:
+		return false, usageError("unknown command " + name + ", type help for the commands")
+	}
+	return false, nil
+}
+
+func (r *REPL) continuation(s *session, command string) (bool, error) {
+	status, err := s.client.Continue(command)
+	if err != nil {
+		return false, err
+	}
+	if status.Status != "break" {
+		s.client.Command("stop", nil, "")
+		return true, nil
+	}
+	s.file, s.line = status.File, status.Line
+	if status.Exception != "" {
+		fmt.Fprintf(r.out, "%s: %s\n", status.Exception, status.Message)
+	}
+	if s.file == "" {
+		fmt.Fprintln(r.out, "Break")
+		return false, nil
+	}
+	fmt.Fprintf(r.out, "Break at %s:%d\n", fileuri.ToPath(s.file), s.line)
+	return false, r.source(s, s.file, s.line)
+}
+
+// breakpoint set a line breakpoint, the file is the original file, mapped by the proxy
+func (r *REPL) breakpoint(s *session, arg string) error {
+	file, line, err := location(arg)
+	if err != nil {
+		return err
+	}
+	doc, err := s.client.Command("breakpoint_set", []string{"t", "line", "f", file, "n", strconv.Itoa(line)}, "")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(r.out, "Breakpoint %s at %s:%d\n", doc.Root.Attr("id"), fileuri.ToPath(file), line)
+	return nil
+}
+
+// source show the lines around the given line
+func (r *REPL) source(s *session, file string, line int) error {
+	if file == "" {
+		return usageError("no current location, use source file:line")
+	}
+	begin := line - context
+	if begin < 1 {
+		begin = 1
+	}
+	source, err := s.client.Source(file, begin, line+context)
+	if err != nil {
+		return err
+	}
+	for i, text := range strings.Split(strings.TrimRight(source, "\n"), "\n") {
+		marker := "  "
+		if begin+i == line {
+			marker = "=>"
+		}
+		fmt.Fprintf(r.out, "%s %4d %s\n", marker, begin+i, text)
+	}
+	return nil
+}
+
+func (r *REPL) print(v *dbgpclient.Variable, depth int) {
+	name := v.Name
+	if name == "" {
+		name = "="
+	} else {
+		name += " ="
+	}
+	fmt.Fprintf(r.out, "%s%s %s\n", strings.Repeat("  ", depth), name, v)
+	for _, c := range v.Children {
+		r.print(c, depth+1)
+	}
+}
+
+// stream show the output of the script
+func (r *REPL) stream(doc *dbgp.Document) {
+	if doc.Root.Name != "stream" {
+		return
+	}
+	if v, err := doc.Root.Value(); err == nil {
+		fmt.Fprint(r.out, v)
+	}
+}
+
+// location parse file:line, the file is converted to a file URI
+func location(arg string) (string, int, error) {
+	i := strings.LastIndexByte(arg, ':')
+	if i < 0 {
+		return "", 0, usageError("expected file:line")
+	}
+	line, err := strconv.Atoi(arg[i+1:])
+	if err != nil || line < 1 {
+		return "", 0, usageError("invalid line " + arg[i+1:])
+	}
+	file := arg[:i]
+	if !fileuri.IsURI(file) {
+		file = fileuri.FromPath(file)
+	}
+	return file, line, nil
+}
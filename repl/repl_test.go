@@ -0,0 +1,57 @@
+package repl
+
+import (
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgptest"
+	"github.com/stretchr/testify/assert"
+
+	"bytes"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+)
+
+const service = "file:///home/dev/project/Packages/Application/Acme.Demo/Classes/Service.php"
+
+// engine break at Service.php:12 and evaluate any expression to array('a' => 1)
+func engine(commands chan<- *dbgp.Command) *dbgptest.Engine {
+	source := base64.StdEncoding.EncodeToString([]byte("line 9\nline 10\nline 11\nline 12\n"))
+	return &dbgptest.Engine{
+		Init: `<init idekey="REPL" fileuri="file:///var/www/index.php"></init>`,
+		Respond: dbgptest.Responses(map[string]string{
+			"breakpoint_set": ` id="5" state="enabled">`,
+			"run":            ` status="break" reason="ok"><xdebug:message filename="` + service + `" lineno="12"></xdebug:message>`,
+			"source":         ` encoding="base64"><![CDATA[` + source + `]]>`,
+			"eval":           `><property type="array" numchildren="1"><property name="a" type="int"><![CDATA[1]]></property></property>`,
+			"detach":         ` status="stopping" reason="ok">`,
+		}),
+		Commands: commands,
+	}
+}
+
+func TestSession(t *testing.T) {
+	conn, ide := net.Pipe()
+	commands := make(chan *dbgp.Command, 20)
+	go engine(commands).Serve(conn)
+
+	var out bytes.Buffer
+	in := strings.NewReader("break /home/dev/project/Packages/Application/Acme.Demo/Classes/Service.php:12\nrun\nprint $a\nfoo\nquit\n")
+	r := New(in, &out)
+	assert.Equal(t, ErrQuit, r.Session(ide))
+	ide.Close()
+
+	assert.Equal(t, []string{
+		"breakpoint_set -i 1 -t line -f " + service + " -n 12",
+		"run -i 2",
+		"source -i 3 -f " + service + " -b 9 -e 15",
+		"eval -i 4 -- JGE=",
+		"detach -i 5",
+	}, dbgptest.Sent(commands))
+	output := out.String()
+	assert.Contains(t, output, "Breakpoint 5 at /home/dev/project/Packages/Application/Acme.Demo/Classes/Service.php:12")
+	assert.Contains(t, output, "=>   12 line 12\n")
+	assert.Contains(t, output, "= array(1)\n  a = 1\n")
+	assert.Contains(t, output, "unknown command foo")
+	assert.Equal(t, []string{"/home/dev/project/Packages/Application/Acme.Demo/Classes/Service.php:12"}, r.breakpoints)
+}
@@ -0,0 +1,248 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package script
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgpclient"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+
+	"encoding/csv"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Runner run the scripts as the IDE of the sessions they match
+type Runner struct {
+	scripts []*Script
+	logger  *logger.Logger
+	// mu serialize the writes to the CSV files, shared by the sessions
+	mu sync.Mutex
+}
+
+// New load the scripts, return nil if there is no script
+func New(c *config.Config, l *logger.Logger) (*Runner, error) {
+	if len(c.Scripts) == 0 {
+		return nil, nil
+	}
+	r := &Runner{logger: l}
+	for _, path := range c.Scripts {
+		s, err := Load(path)
+		if err != nil {
+			return nil, err
+		}
+		r.scripts = append(r.scripts, s)
+	}
+	return r, nil
+}
+
+// Match return the first script matching the session of the init packet, nil if none
+func (r *Runner) Match(init *dbgp.Header) *Script {
+	for _, s := range r.scripts {
+		if s.Matches(init) {
+			return s
+		}
+	}
+	return nil
+}
+
+// Dialer run the matching script as the IDE of a session, the sessions without script
+// use next
+func (r *Runner) Dialer(next xdebugproxy.DialFunc) xdebugproxy.DialFunc {
+	return func(init *dbgp.Header) (net.Conn, error) {
+		s := r.Match(init)
+		if s == nil {
+			return next(init)
+		}
+		proxy, ide := net.Pipe()
+		go func() {
+			defer ide.Close()
+			if err := r.Run(s, ide); err != nil && err != io.EOF {
+				r.logger.Warn("[script %s] Failed: %s", s.Name, err)
+			}
+		}()
+		return proxy, nil
+	}
+}
+
+// execution is the state of a script running for a session
+type execution struct {
+	runner *Runner
+	script *Script
+	client *dbgpclient.Client
+	status string
+	file   string
+	line   int
+	// done is set once the session is detached or stopped
+	done bool
+}
+
+// Run the script on the IDE end of a connection, the session is detached at the end
+func (r *Runner) Run(s *Script, conn io.ReadWriteCloser) error {
+	client, err := dbgpclient.New(conn)
+	if err != nil {
+		return err
+	}
+	e := &execution{runner: r, script: s, client: client, status: "starting"}
+	r.logger.Info("[script %s] Started for %s", s.Name, fileuri.ToPath(client.Init.Root.Attr("fileuri")))
+	err = e.steps(s.Steps)
+	if !e.done {
+		if _, derr := client.Command("detach", nil, ""); err == nil {
+			err = derr
+		}
+	}
+	r.logger.Info("[script %s] Ended", s.Name)
+	return err
+}
+
+func (e *execution) steps(steps []*Step) error {
+	for _, step := range steps {
+		if e.done {
+			return nil
+		}
+		if !e.applies(step) {
+			continue
+		}
+		if err := e.step(step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *execution) step(step *Step) error {
+	switch {
+	case step.Breakpoint != "":
+		args := []string{"t", "line", "f", step.file, "n", strconv.Itoa(step.line)}
+		if step.Condition != "" {
+			args[1] = "conditional"
+		}
+		_, err := e.client.Command("breakpoint_set", args, step.Condition)
+		return err
+	case step.Command == "detach" || step.Command == "stop":
+		e.done = true
+		_, err := e.client.Command(step.Command, nil, "")
+		return err
+	case step.Command != "":
+		status, err := e.client.Continue(step.Command)
+		if err != nil {
+			return err
+		}
+		e.status, e.file, e.line = status.Status, status.File, status.Line
+		return nil
+	case len(step.Eval) > 0:
+		return e.eval(step)
+	}
+	for i := 0; i < step.Repeat && !e.done && e.status != "stopping"; i++ {
+		if err := e.steps(step.Steps); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applies check the conditions of a step, a condition failing in the engine skip the step
+func (e *execution) applies(step *Step) bool {
+	if step.If != "" && e.status != step.If {
+		return false
+	}
+	if step.When == "" {
+		return true
+	}
+	if e.status != "break" {
+		return false
+	}
+	v, err := e.client.Eval(step.When)
+	if err != nil {
+		e.runner.logger.Warn("[script %s] Unable to evaluate %s: %s", e.script.Name, step.When, err)
+		return false
+	}
+	return truthy(v)
+}
+
+// eval log the values of the expressions or append them to a CSV file
+func (e *execution) eval(step *Step) error {
+	values := make([]string, len(step.Eval))
+	for i, expression := range step.Eval {
+		v, err := e.client.Eval(expression)
+		if err != nil {
+			if _, ok := err.(*dbgpclient.Error); !ok {
+				return err
+			}
+			values[i] = "error: " + err.Error()
+			continue
+		}
+		values[i] = value(v)
+	}
+	file := fileuri.ToPath(e.file)
+	if step.CSV == "" {
+		pairs := make([]string, len(values))
+		for i, v := range values {
+			pairs[i] = step.Eval[i] + "=" + v
+		}
+		e.runner.logger.Info("[script %s] %s:%d %s", e.script.Name, file, e.line, strings.Join(pairs, " "))
+		return nil
+	}
+	header := append([]string{"time", "idekey", "file", "line"}, step.Eval...)
+	row := append([]string{time.Now().Format(time.RFC3339), e.client.Init.Root.Attr("idekey"), file, strconv.Itoa(e.line)}, values...)
+	if err := e.runner.append(step.CSV, header, row); err != nil {
+		e.runner.logger.Warn("[script %s] Unable to write %s: %s", e.script.Name, step.CSV, err)
+	}
+	return nil
+}
+
+// append a row to a CSV file, the header is written first in a new file
+func (r *Runner) append(path string, header, row []string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	if info.Size() == 0 {
+		w.Write(header)
+	}
+	w.Write(row)
+	w.Flush()
+	return w.Error()
+}
+
+// value format a value for the log or a CSV cell, strings are not quoted
+func value(v *dbgpclient.Variable) string {
+	if v.Type == "string" {
+		return v.Value
+	}
+	return v.String()
+}
+
+// truthy follow the PHP conversion to boolean
+func truthy(v *dbgpclient.Variable) bool {
+	switch v.Type {
+	case "uninitialized", "null":
+		return false
+	case "array":
+		return v.Size > 0
+	case "object":
+		return true
+	case "float":
+		f, _ := strconv.ParseFloat(v.Value, 64)
+		return f != 0
+	}
+	return v.Value != "" && v.Value != "0"
+}
@@ -0,0 +1,202 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package script
+
+import (
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// commands are the engine commands a step can send
+var commands = map[string]bool{
+	"run":       true,
+	"step_into": true,
+	"step_over": true,
+	"step_out":  true,
+	"detach":    true,
+	"stop":      true,
+}
+
+// statuses are the engine status a step can depend on
+var statuses = map[string]bool{
+	"starting": true,
+	"break":    true,
+	"stopping": true,
+}
+
+// Script is a sequence of steps run as the IDE of the sessions matching a filter
+type Script struct {
+	Name  string  `yaml:"name"`
+	Match Match   `yaml:"match"`
+	Steps []*Step `yaml:"steps"`
+}
+
+// Match select the sessions of a script, with regular expressions on the init packet,
+// a script without filter match every session
+type Match struct {
+	IDEKey string `yaml:"idekey"`
+	File   string `yaml:"file"`
+	idekey *regexp.Regexp
+	file   *regexp.Regexp
+}
+
+// Step is a single action of a script: a breakpoint, a command, an eval or a repeat
+type Step struct {
+	// Breakpoint set a line breakpoint as file:line, with an optional PHP condition
+	Breakpoint string `yaml:"breakpoint"`
+	Condition  string `yaml:"condition"`
+	// Command is run, step_into, step_over, step_out, detach or stop
+	Command string `yaml:"command"`
+	// Eval evaluate expressions, the values are logged or appended as a row to the CSV file
+	Eval []string `yaml:"eval"`
+	CSV  string   `yaml:"csv"`
+	// Repeat run the steps a number of times, until the end of the script
+	Repeat int     `yaml:"repeat"`
+	Steps  []*Step `yaml:"steps"`
+	// If skip the step unless the engine status is this one
+	If string `yaml:"if"`
+	// When skip the step unless the PHP expression is true, on a break
+	When string `yaml:"when"`
+	file string
+	line int
+}
+
+// Load read and validate a YAML or JSON script
+func Load(path string) (*Script, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	if s.Name == "" {
+		s.Name = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+	return s, nil
+}
+
+// Parse a YAML or JSON script, unknown fields are errors
+func Parse(data []byte) (*Script, error) {
+	d := yaml.NewDecoder(bytes.NewReader(data))
+	d.KnownFields(true)
+	s := &Script{}
+	if err := d.Decode(s); err != nil {
+		return nil, err
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Script) validate() error {
+	var err error
+	if s.Match.idekey, err = compile(s.Match.IDEKey); err != nil {
+		return fmt.Errorf("match idekey: %s", err)
+	}
+	if s.Match.file, err = compile(s.Match.File); err != nil {
+		return fmt.Errorf("match file: %s", err)
+	}
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("no steps")
+	}
+	return validateSteps(s.Steps, "steps")
+}
+
+func compile(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+func validateSteps(steps []*Step, path string) error {
+	for i, step := range steps {
+		if err := step.validate(); err != nil {
+			return fmt.Errorf("%s[%d]: %s", path, i, err)
+		}
+		if step.Repeat > 0 {
+			if err := validateSteps(step.Steps, fmt.Sprintf("%s[%d].steps", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (step *Step) validate() error {
+	actions := 0
+	for _, set := range []bool{step.Breakpoint != "", step.Command != "", len(step.Eval) > 0, step.Repeat != 0} {
+		if set {
+			actions++
+		}
+	}
+	if actions != 1 {
+		return fmt.Errorf("expected one of breakpoint, command, eval or repeat")
+	}
+	if step.Condition != "" && step.Breakpoint == "" {
+		return fmt.Errorf("condition without breakpoint")
+	}
+	if step.CSV != "" && len(step.Eval) == 0 {
+		return fmt.Errorf("csv without eval")
+	}
+	if len(step.Steps) > 0 && step.Repeat == 0 {
+		return fmt.Errorf("steps without repeat")
+	}
+	if step.If != "" && !statuses[step.If] {
+		return fmt.Errorf("invalid status %s, expected starting, break or stopping", step.If)
+	}
+	switch {
+	case step.Breakpoint != "":
+		return step.location()
+	case step.Command != "" && !commands[step.Command]:
+		return fmt.Errorf("invalid command %s, expected run, step_into, step_over, step_out, detach or stop", step.Command)
+	case step.Repeat < 0:
+		return fmt.Errorf("invalid repeat %d", step.Repeat)
+	case step.Repeat > 0 && len(step.Steps) == 0:
+		return fmt.Errorf("repeat without steps")
+	}
+	return nil
+}
+
+// location parse the file:line of a breakpoint, the file is converted to a file URI
+func (step *Step) location() error {
+	i := strings.LastIndexByte(step.Breakpoint, ':')
+	if i < 0 {
+		return fmt.Errorf("invalid breakpoint %s, expected file:line", step.Breakpoint)
+	}
+	line, err := strconv.Atoi(step.Breakpoint[i+1:])
+	if err != nil || line < 1 {
+		return fmt.Errorf("invalid breakpoint line %s", step.Breakpoint[i+1:])
+	}
+	step.file, step.line = step.Breakpoint[:i], line
+	if !fileuri.IsURI(step.file) {
+		step.file = fileuri.FromPath(step.file)
+	}
+	return nil
+}
+
+// Matches return true if the script should run for the session of the init packet
+func (s *Script) Matches(init *dbgp.Header) bool {
+	if s.Match.idekey != nil && !s.Match.idekey.MatchString(init.Attr("idekey")) {
+		return false
+	}
+	if s.Match.file != nil && !s.Match.file.MatchString(fileuri.ToPath(init.Attr("fileuri"))) {
+		return false
+	}
+	return true
+}
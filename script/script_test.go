@@ -0,0 +1,118 @@
+package script
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgptest"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/stretchr/testify/assert"
+
+	"encoding/base64"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const orders = `
+name: orders
+match:
+  idekey: ^SCRIPT$
+steps:
+  - breakpoint: /var/www/Order.php:12
+  - repeat: 3
+    steps:
+      - command: run
+      - eval: ["$id", "$total"]
+        csv: %s
+        if: break
+        when: $total > 10
+`
+
+// engine break twice at Order.php:12 then stop, $total > 10 on the second break
+func engine(commands chan<- *dbgp.Command) *dbgptest.Engine {
+	runs := 0
+	return &dbgptest.Engine{
+		Init:     `<init idekey="SCRIPT" fileuri="file:///var/www/index.php"></init>`,
+		Commands: commands,
+		Respond: func(c *dbgp.Command) string {
+			switch c.Name {
+			case "run":
+				runs++
+				if runs <= 2 {
+					return ` status="break" reason="ok"><xdebug:message filename="file:///var/www/Order.php" lineno="12"></xdebug:message>`
+				}
+				return ` status="stopping" reason="ok">`
+			case "eval":
+				expression, _ := base64.StdEncoding.DecodeString(c.Data)
+				switch string(expression) {
+				case "$total > 10":
+					return `><property type="bool"><![CDATA[` + map[bool]string{false: "0", true: "1"}[runs == 2] + `]]></property>`
+				case "$id":
+					return `><property type="string" encoding="base64"><![CDATA[` + base64.StdEncoding.EncodeToString([]byte("A-"+strconv.Itoa(runs))) + `]]></property>`
+				case "$total":
+					return `><property type="int"><![CDATA[42]]></property>`
+				}
+			case "detach":
+				return ` status="stopping" reason="ok">`
+			}
+			return ">"
+		},
+	}
+}
+
+func TestScriptAppendTheValuesOnBreakAndDetach(t *testing.T) {
+	dir := t.TempDir()
+	csv := filepath.Join(dir, "orders.csv")
+	s, err := Parse([]byte(strings.Replace(orders, "%s", csv, 1)))
+	assert.NoError(t, err)
+	c := &config.Config{}
+	r := &Runner{scripts: []*Script{s}, logger: &logger.Logger{Config: c}}
+	assert.Equal(t, s, r.Match(&dbgp.Header{Attrs: map[string]string{"idekey": "SCRIPT"}}))
+	assert.Nil(t, r.Match(&dbgp.Header{Attrs: map[string]string{"idekey": "PHPSTORM"}}))
+
+	conn, ide := net.Pipe()
+	commands := make(chan *dbgp.Command, 20)
+	go engine(commands).Serve(conn)
+	assert.NoError(t, r.Run(s, ide))
+	ide.Close()
+
+	assert.Equal(t, []string{
+		"breakpoint_set -i 1 -t line -f file:///var/www/Order.php -n 12",
+		"run -i 2",
+		"eval -i 3 -- JHRvdGFsID4gMTA=",
+		"run -i 4",
+		"eval -i 5 -- JHRvdGFsID4gMTA=",
+		"eval -i 6 -- JGlk",
+		"eval -i 7 -- JHRvdGFs",
+		"run -i 8",
+		"detach -i 9",
+	}, dbgptest.Sent(commands))
+
+	data, err := ioutil.ReadFile(csv)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	assert.Len(t, lines, 2)
+	assert.Equal(t, "time,idekey,file,line,$id,$total", lines[0])
+	assert.True(t, strings.HasSuffix(lines[1], ",SCRIPT,/var/www/Order.php,12,A-2,42"), lines[1])
+}
+
+func TestParseValidateTheSteps(t *testing.T) {
+	for script, message := range map[string]string{
+		`steps: []`:                        "no steps",
+		`{"steps": [{"command": "jump"}]}`: "steps[0]: invalid command jump",
+		`{"steps": [{"command": "run", "eval": ["$a"]}]}`:           "steps[0]: expected one of",
+		`{"steps": [{"breakpoint": "Order.php"}]}`:                  "steps[0]: invalid breakpoint Order.php",
+		`{"steps": [{"repeat": 2, "steps": [{"csv": "a.csv"}]}]}`:   "steps[0].steps[0]: expected one of",
+		`{"steps": [{"command": "run", "if": "running"}]}`:          "steps[0]: invalid status running",
+		`{"match": {"idekey": "("}, "steps": [{"command": "run"}]}`: "match idekey",
+		`{"steps": [{"command": "run", "unknown": 1}]}`:             "field unknown not found",
+	} {
+		_, err := Parse([]byte(script))
+		if assert.Error(t, err, script) {
+			assert.Contains(t, err.Error(), message, script)
+		}
+	}
+}
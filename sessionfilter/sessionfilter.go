@@ -0,0 +1,191 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sessionfilter
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgpclient"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+)
+
+// expressions are the fields of a rule evaluated in the engine, the others are read from
+// the init packet
+var expressions = map[string]string{
+	"uri":  "isset($_SERVER['REQUEST_URI']) ? $_SERVER['REQUEST_URI'] : ''",
+	"sapi": "PHP_SAPI",
+}
+
+var cookieName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// rule match a field of the session with a regular expression
+type rule struct {
+	source     string
+	field      string
+	expression string
+	pattern    *regexp.Regexp
+}
+
+// Filter forward to the IDE only the sessions matching the include rules and none of the
+// exclude rules, the other sessions are detached
+type Filter struct {
+	includes []*rule
+	excludes []*rule
+	// evaluate is true if a rule need an eval in the engine
+	evaluate bool
+	config   *config.Config
+	logger   *logger.Logger
+}
+
+// New create the filter, return nil if there is no rule
+func New(c *config.Config, l *logger.Logger) (*Filter, error) {
+	if len(c.SessionIncludes) == 0 && len(c.SessionExcludes) == 0 {
+		return nil, nil
+	}
+	f := &Filter{config: c, logger: l}
+	var err error
+	if f.includes, err = f.parse(c.SessionIncludes); err != nil {
+		return nil, err
+	}
+	if f.excludes, err = f.parse(c.SessionExcludes); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *Filter) parse(sources []string) ([]*rule, error) {
+	var rules []*rule
+	for _, source := range sources {
+		r, err := parseRule(source)
+		if err != nil {
+			return nil, err
+		}
+		if r.expression != "" {
+			f.evaluate = true
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+// parseRule parse field:regexp, field is idekey, file, uri, sapi or cookie.NAME
+func parseRule(source string) (*rule, error) {
+	parts := strings.SplitN(source, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("invalid session rule '%s', use field:regexp", source)
+	}
+	r := &rule{source: source, field: parts[0], expression: expressions[parts[0]]}
+	switch {
+	case r.field == "idekey" || r.field == "file" || r.expression != "":
+	case strings.HasPrefix(r.field, "cookie.") && cookieName.MatchString(r.field[7:]):
+		name := r.field[7:]
+		r.expression = "isset($_COOKIE['" + name + "']) ? $_COOKIE['" + name + "'] : ''"
+	default:
+		return nil, fmt.Errorf("invalid session rule field '%s', use idekey, file, uri, sapi or cookie.NAME", r.field)
+	}
+	var err error
+	if r.pattern, err = regexp.Compile(parts[1]); err != nil {
+		return nil, fmt.Errorf("invalid session rule '%s': %s", source, err)
+	}
+	return r, nil
+}
+
+// Dialer connect the matching sessions with next, the fields evaluated in the engine are
+// read by the proxy acting as the IDE, then the session is handed over to next
+func (f *Filter) Dialer(next xdebugproxy.DialFunc) xdebugproxy.DialFunc {
+	return func(init *dbgp.Header) (net.Conn, error) {
+		if !f.evaluate {
+			if rule := f.reject(f.fields(init)); rule == "" {
+				return next(init)
+			}
+		}
+		proxy, ide := net.Pipe()
+		go func() {
+			defer ide.Close()
+			if err := f.filter(ide, init, next); err != nil && err != io.EOF && err != io.ErrClosedPipe {
+				f.logger.Warn("Session filter failed: %s", err)
+			}
+		}()
+		return proxy, nil
+	}
+}
+
+func (f *Filter) fields(init *dbgp.Header) map[string]string {
+	return map[string]string{
+		"idekey": init.Attr("idekey"),
+		"file":   fileuri.ToPath(init.Attr("fileuri")),
+	}
+}
+
+// filter read the fields evaluated in the engine, detach or hand over the session
+func (f *Filter) filter(conn net.Conn, init *dbgp.Header, next xdebugproxy.DialFunc) error {
+	client, err := dbgpclient.New(conn)
+	if err != nil {
+		return err
+	}
+	fields := f.fields(init)
+	for _, r := range append(f.includes, f.excludes...) {
+		if _, ok := fields[r.field]; ok || r.expression == "" {
+			continue
+		}
+		// a failed eval match as an empty value
+		fields[r.field] = ""
+		if v, err := client.Eval(r.expression); err == nil {
+			fields[r.field] = v.Value
+		} else if _, ok := err.(*dbgpclient.Error); !ok {
+			return err
+		}
+	}
+	if rule := f.reject(fields); rule != "" {
+		f.logger.Info("Session %s of %s detached by the rule %s", fields["idekey"], fields["file"], rule)
+		_, err := client.Command("detach", nil, "")
+		return err
+	}
+	ide, err := next(init)
+	if err != nil {
+		f.logger.Warn("Unable to connect to your IDE: %s", err)
+		client.Command("detach", nil, "")
+		return nil
+	}
+	return client.Splice(ide)
+}
+
+// reject return the rule rejecting a session, an empty string if it is forwarded
+func (f *Filter) reject(fields map[string]string) string {
+	if len(f.includes) > 0 {
+		included := false
+		for _, r := range f.includes {
+			if r.pattern.MatchString(fields[r.field]) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return "include " + strings.Join(sources(f.includes), ", ")
+		}
+	}
+	for _, r := range f.excludes {
+		if r.pattern.MatchString(fields[r.field]) {
+			return "exclude " + r.source
+		}
+	}
+	return ""
+}
+
+func sources(rules []*rule) []string {
+	s := make([]string, len(rules))
+	for i, r := range rules {
+		s[i] = r.source
+	}
+	return s
+}
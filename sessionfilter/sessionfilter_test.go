@@ -0,0 +1,90 @@
+package sessionfilter
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/dbgptest"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/stretchr/testify/assert"
+
+	"encoding/base64"
+	"net"
+	"testing"
+)
+
+var header = &dbgp.Header{Element: "init", Attrs: map[string]string{"idekey": "PHPSTORM", "fileuri": "file:///var/www/index.php"}}
+
+// engine act as the engine on the connection returned by the dialer, the request URI is uri
+func engine(uri string, commands chan<- *dbgp.Command) *dbgptest.Engine {
+	return &dbgptest.Engine{Commands: commands, Respond: func(c *dbgp.Command) string {
+		if c.Name == "eval" {
+			return `><property type="string" encoding="base64"><![CDATA[` + base64.StdEncoding.EncodeToString([]byte(uri)) + `]]></property>`
+		}
+		return ` status="stopping" reason="ok">`
+	}}
+}
+
+func newFilter(t *testing.T, includes, excludes []string) *Filter {
+	c := &config.Config{SessionIncludes: includes, SessionExcludes: excludes}
+	f, err := New(c, &logger.Logger{Config: c})
+	assert.NoError(t, err)
+	return f
+}
+
+func TestSessionExcludedByTheRequestURIIsDetached(t *testing.T) {
+	f := newFilter(t, nil, []string{"uri:^/_Resources/"})
+	dialed := false
+	conn, err := f.Dialer(func(*dbgp.Header) (net.Conn, error) {
+		dialed = true
+		return nil, nil
+	})(header)
+	assert.NoError(t, err)
+
+	commands := make(chan *dbgp.Command, 10)
+	engine("/_Resources/Static/main.css", commands).Serve(conn)
+	assert.Equal(t, []string{"eval", "detach"}, dbgptest.Names(commands))
+	assert.False(t, dialed)
+}
+
+func TestSessionIncludedIsHandedOverToTheIDE(t *testing.T) {
+	f := newFilter(t, []string{"idekey:^PHPSTORM$"}, []string{"uri:^/_Resources/"})
+	proxy, ide := net.Pipe()
+	conn, err := f.Dialer(func(*dbgp.Header) (net.Conn, error) {
+		return proxy, nil
+	})(header)
+	assert.NoError(t, err)
+
+	commands := make(chan *dbgp.Command, 10)
+	go engine("/shop/checkout", commands).Serve(conn)
+	r := dbgp.NewReader(ide)
+	data, err := r.ReadPacket()
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), "<init")
+	ide.Write(dbgp.CommandLine([]byte("run -i 1")))
+	data, err = r.ReadPacket()
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `command="run" transaction_id="1"`)
+	ide.Close()
+	assert.Equal(t, []string{"eval", "run"}, dbgptest.Names(commands))
+}
+
+func TestSessionWithoutEvaluatedRuleIsDialedDirectly(t *testing.T) {
+	f := newFilter(t, []string{"file:^/var/www/"}, nil)
+	dialed := false
+	_, err := f.Dialer(func(*dbgp.Header) (net.Conn, error) {
+		dialed = true
+		return nil, nil
+	})(header)
+	assert.NoError(t, err)
+	assert.True(t, dialed)
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, source := range []string{"uri", "host:.*", "cookie.a'b:.*", "uri:("} {
+		_, err := parseRule(source)
+		assert.Error(t, err, source)
+	}
+	r, err := parseRule("cookie.XDEBUG_TRIGGER:^1$")
+	assert.NoError(t, err)
+	assert.Equal(t, "isset($_COOKIE['XDEBUG_TRIGGER']) ? $_COOKIE['XDEBUG_TRIGGER'] : ''", r.expression)
+}
@@ -0,0 +1,144 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sourceprovider
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/pathmapping"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Provider answer the DBGp source command with the original file, instead of the proxy class.
+// It must be placed on the engine side of the path mapper, to receive the proxy class path.
+type Provider struct {
+	config      *config.Config
+	logger      *logger.Logger
+	pathMapping *pathmapping.PathMapping
+}
+
+// New create a source provider
+func New(c *config.Config, l *logger.Logger, m *pathmapping.PathMapping) *Provider {
+	return &Provider{
+		config:      c,
+		logger:      l,
+		pathMapping: m,
+	}
+}
+
+// Process answer source commands for mapped files
+func (p *Provider) Process(s *xdebugproxy.Session, m *xdebugproxy.Message) ([]*xdebugproxy.Message, error) {
+	if m.Direction != xdebugproxy.ToEngine || m.Command.Name != "source" {
+		return []*xdebugproxy.Message{m}, nil
+	}
+	uri, ok := m.Command.Get("f")
+	if !ok {
+		// source of the current script, the engine know better
+		return []*xdebugproxy.Message{m}, nil
+	}
+	path := fileuri.ToPath(uri)
+	originalPath, mapped := p.pathMapping.Get(path)
+	if !mapped {
+		// without a proxy class, like with the dummy framework, the file is served if it
+		// is found locally through the local root or the prefix mappings
+		originalPath = path
+	}
+	localPath, ok := p.localPath(originalPath, mapped)
+	if !ok {
+		if mapped {
+			p.logger.Debug("Original source %s not available locally, forward source command to the engine", originalPath)
+		}
+		return []*xdebugproxy.Message{m}, nil
+	}
+	source, err := ioutil.ReadFile(localPath)
+	if err != nil {
+		return nil, err
+	}
+	p.logger.Debug("Serve source of %s from %s", uri, localPath)
+
+	// Flow keep the line numbers of the original code in the proxy class, the range apply as is
+	source = lineRange(source, intArg(m.Command, "b"), intArg(m.Command, "e"))
+	response := dbgp.NewResponse("source", m.Command.TransactionID(), []string{"encoding", "base64"}, dbgp.CDATA(base64.StdEncoding.EncodeToString(source)))
+	return []*xdebugproxy.Message{xdebugproxy.NewXMLMessage(response)}, nil
+}
+
+// candidate is a local file, which must stay under root if any
+type candidate struct {
+	path string
+	root string
+}
+
+// localPath find the original file on the proxy filesystem, using prefix mappings and the local root,
+// the path itself is a candidate only if asIs is true
+func (p *Provider) localPath(path string, asIs bool) (string, bool) {
+	var candidates []candidate
+	if asIs {
+		candidates = append(candidates, candidate{path: path})
+	}
+	for _, prefix := range p.config.PathPrefixes {
+		if fileuri.Auto.HasPrefix(path, prefix.Engine) {
+			root := strings.TrimRight(prefix.IDE, `/\`)
+			candidates = append(candidates, candidate{path: root + path[len(strings.TrimRight(prefix.Engine, `/\`)):], root: root})
+		}
+	}
+	if len(p.config.LocalRoot) > 0 {
+		if i := strings.Index(path, "/Packages/"); i >= 0 {
+			candidates = append([]candidate{{path: p.config.LocalRoot + path[i:], root: p.config.LocalRoot}}, candidates...)
+		}
+	}
+	for _, c := range candidates {
+		local := filepath.Clean(c.path)
+		if len(c.root) > 0 && !within(filepath.Clean(c.root), local) {
+			p.logger.Debug("Source %s is outside of %s, ignored", local, c.root)
+			continue
+		}
+		if info, err := os.Stat(local); err == nil && !info.IsDir() {
+			return local, true
+		}
+	}
+	return "", false
+}
+
+// within check that the cleaned path is the root or below it, a path traversal go outside
+func within(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// lineRange return the lines between begin and end, both included and starting at 1
+func lineRange(source []byte, begin, end int) []byte {
+	if begin <= 1 && end <= 0 {
+		return source
+	}
+	lines := strings.SplitAfter(string(source), "\n")
+	if begin < 1 {
+		begin = 1
+	}
+	if end <= 0 || end > len(lines) {
+		end = len(lines)
+	}
+	if begin > end {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines[begin-1:end], ""))
+}
+
+func intArg(c *dbgp.Command, flag string) int {
+	v, _ := c.Get(flag)
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		return 0
+	}
+	return i
+}
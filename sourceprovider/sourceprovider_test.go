@@ -0,0 +1,114 @@
+package sourceprovider
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/fileuri"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/pathmapperfactory"
+	"github.com/dfeyer/flow-debugproxy/pathmapping"
+	"github.com/dfeyer/flow-debugproxy/xdebugproxy"
+	"github.com/stretchr/testify/assert"
+
+	_ "github.com/dfeyer/flow-debugproxy/dummypathmapper"
+
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+)
+
+func sourceOf(t *testing.T, p *Provider, command string) string {
+	out, err := p.Process(nil, xdebugproxy.NewCommandMessage(dbgp.ParseCommand([]byte(command))))
+	assert.NoError(t, err)
+	assert.Len(t, out, 1)
+	assert.Equal(t, xdebugproxy.ToIDE, out[0].Direction)
+	h, err := out[0].Header()
+	assert.NoError(t, err)
+	assert.Equal(t, "source", h.Command())
+	assert.Equal(t, "7", h.TransactionID())
+	match := regexp.MustCompile(`<!\[CDATA\[(.*)\]\]>`).FindSubmatch(out[0].Data())
+	source, err := base64.StdEncoding.DecodeString(string(match[1]))
+	assert.NoError(t, err)
+	return string(source)
+}
+
+func TestServeOriginalSourceOfMappedFile(t *testing.T) {
+	dir := t.TempDir()
+	originalPath := filepath.Join(dir, "Packages/Application/Acme.Demo/Classes/Foo.php")
+	proxyPath := filepath.Join(dir, "Data/Temporary/Development/Cache/Code/Flow_Object_Classes/Acme_Demo_Foo.php")
+	c := &config.Config{LocalRoot: dir}
+	m := &pathmapping.PathMapping{}
+	m.Set(proxyPath, "/var/www/Packages/Application/Acme.Demo/Classes/Foo.php")
+	p := New(c, &logger.Logger{Config: c}, m)
+
+	// the original file is only available through the local root
+	assert.NoError(t, mkdirAndWrite(originalPath, "<?php\nline 2\nline 3\nline 4\n"))
+
+	assert.Equal(t, "<?php\nline 2\nline 3\nline 4\n", sourceOf(t, p, "source -i 7 -f "+fileuri.FromPath(proxyPath)))
+	assert.Equal(t, "line 2\nline 3\n", sourceOf(t, p, "source -i 7 -f "+fileuri.FromPath(proxyPath)+" -b 2 -e 3"))
+	assert.Equal(t, "line 3\nline 4\n", sourceOf(t, p, "source -i 7 -b 3 -f "+fileuri.FromPath(proxyPath)))
+}
+
+func TestForwardSourceOfUnmappedFile(t *testing.T) {
+	c := &config.Config{}
+	p := New(c, &logger.Logger{Config: c}, &pathmapping.PathMapping{})
+	m := xdebugproxy.NewCommandMessage(dbgp.ParseCommand([]byte("source -i 7 -f file:///not/mapped.php")))
+	out, err := p.Process(nil, m)
+	assert.NoError(t, err)
+	assert.Equal(t, []*xdebugproxy.Message{m}, out)
+}
+
+func TestServeSourceWithTheDummyFramework(t *testing.T) {
+	dir := t.TempDir()
+	c := &config.Config{Framework: "dummy", PathPrefixes: []config.PathPrefix{{Engine: "/var/www/app", IDE: dir}}}
+	l := &logger.Logger{Config: c}
+	m := &pathmapping.PathMapping{}
+	mapper, err := pathmapperfactory.Create(c, m, l)
+	assert.NoError(t, err)
+	p := New(c, l, m)
+	assert.NoError(t, mkdirAndWrite(filepath.Join(dir, "src/Foo.php"), "<?php\nline 2\n"))
+
+	// the command reach the provider through the dummy mapper, nothing is cached
+	out, err := mapper.Process(nil, xdebugproxy.NewCommandMessage(dbgp.ParseCommand([]byte("source -i 7 -f file:///var/www/app/src/Foo.php -b 2"))))
+	assert.NoError(t, err)
+	assert.Equal(t, "line 2\n", sourceOf(t, p, out[0].Command.String()))
+
+	// a file not found locally is left to the engine
+	m2 := xdebugproxy.NewCommandMessage(dbgp.ParseCommand([]byte("source -i 7 -f file:///var/www/app/src/Bar.php")))
+	out, err = p.Process(nil, m2)
+	assert.NoError(t, err)
+	assert.Equal(t, []*xdebugproxy.Message{m2}, out)
+}
+
+func TestPathTraversalIsForwarded(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "app")
+	c := &config.Config{LocalRoot: root, PathPrefixes: []config.PathPrefix{{Engine: "/var/www/app", IDE: root}}}
+	p := New(c, &logger.Logger{Config: c}, &pathmapping.PathMapping{})
+	assert.NoError(t, mkdirAndWrite(filepath.Join(dir, "secret.php"), "<?php\nsecret\n"))
+	assert.NoError(t, mkdirAndWrite(filepath.Join(root, "Packages/Foo.php"), "<?php\n"))
+
+	for _, uri := range []string{
+		"file:///var/www/Packages/../../secret.php",
+		"file:///var/www/app/Packages/../../secret.php",
+		"file:///var/www/app/../secret.php",
+	} {
+		m := xdebugproxy.NewCommandMessage(dbgp.ParseCommand([]byte("source -i 7 -f " + uri)))
+		out, err := p.Process(nil, m)
+		assert.NoError(t, err)
+		assert.Equal(t, []*xdebugproxy.Message{m}, out, "source of %s", uri)
+	}
+
+	// a path going back under the root is still served
+	assert.Equal(t, "<?php\n", sourceOf(t, p, "source -i 7 -f file:///var/www/app/src/../Packages/Foo.php"))
+}
+
+func mkdirAndWrite(path, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, []byte(content), 0644)
+}
@@ -0,0 +1,182 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xdebugproxy
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/dfeyer/flow-debugproxy/pathmapping"
+
+	"bytes"
+)
+
+// Direction of a message
+type Direction int
+
+const (
+	// ToIDE is a message sent by the debugger engine to the IDE
+	ToIDE Direction = iota
+	// ToEngine is a command sent by the IDE to the debugger engine
+	ToEngine
+)
+
+func (d Direction) String() string {
+	if d == ToIDE {
+		return "Debugger >>> IDE"
+	}
+	return "IDE >>> Debugger"
+}
+
+// XDebugProcessorPlugin process message in xDebug protocol
+type XDebugProcessorPlugin interface {
+	Initialize(c *config.Config, l *logger.Logger, m *pathmapping.PathMapping)
+	ApplyMappingToTextProtocol(message []byte) []byte
+	ApplyMappingToXML(message []byte) []byte
+}
+
+// Processor process parsed DBGp messages, it return the messages to emit in place of
+// the given one: none to drop it, the message itself to forward it, or new messages.
+// Messages in the same direction continue through the processor chain, messages in
+// the other direction are sent as is, unless Chain is set. The chain is ordered from the engine to the IDE,
+// so the first processor see messages sent to the IDE first, and commands last.
+type Processor interface {
+	Process(s *Session, m *Message) ([]*Message, error)
+}
+
+// PathMapper is the framework specific processor, created by the path mapper factory
+type PathMapper interface {
+	Initialize(c *config.Config, l *logger.Logger, m *pathmapping.PathMapping)
+	Processor
+}
+
+// ProcessorFunc adapt a function to the Processor interface
+type ProcessorFunc func(s *Session, m *Message) ([]*Message, error)
+
+// Process call the function
+func (f ProcessorFunc) Process(s *Session, m *Message) ([]*Message, error) {
+	return f(s, m)
+}
+
+// Message is a single DBGp message, processors must not modify the XML document
+// in place, use SetData to replace it
+type Message struct {
+	Direction Direction
+	// Command is the parsed IDE command, for messages sent to the engine
+	Command *dbgp.Command
+	// Chain a message emitted in the other direction, to process it by the processors
+	// between the emitter and its destination, like a command that need path mapping
+	Chain bool
+	// data is the XML document, for messages sent to the IDE
+	data   []byte
+	header *dbgp.Header
+	final  bool
+}
+
+// NewCommandMessage create a message sent to the engine
+func NewCommandMessage(c *dbgp.Command) *Message {
+	return &Message{Direction: ToEngine, Command: c}
+}
+
+// NewXMLMessage create a message sent to the IDE
+func NewXMLMessage(data []byte) *Message {
+	return &Message{Direction: ToIDE, data: data}
+}
+
+// Clone return a copy of the message, used to restore it if a processor fail
+func (m *Message) Clone() *Message {
+	n := *m
+	if m.Command != nil {
+		n.Command = m.Command.Clone()
+	}
+	return &n
+}
+
+// Data return the XML document of a message sent to the IDE
+func (m *Message) Data() []byte {
+	return m.data
+}
+
+// SetData replace the XML document of a message sent to the IDE
+func (m *Message) SetData(data []byte) {
+	m.data = data
+	m.header = nil
+}
+
+// Header return the root element of a message sent to the IDE
+func (m *Message) Header() (*dbgp.Header, error) {
+	if m.header == nil {
+		h, err := dbgp.ParseHeader(m.data)
+		if err != nil {
+			return nil, err
+		}
+		m.header = h
+	}
+	return m.header, nil
+}
+
+// CommandName return the name of the command, or the command a response belong to
+func (m *Message) CommandName() string {
+	if m.Direction == ToEngine {
+		return m.Command.Name
+	}
+	if h, err := m.Header(); err == nil {
+		return h.Command()
+	}
+	return ""
+}
+
+// TransactionID return the transaction id of the command or response
+func (m *Message) TransactionID() string {
+	if m.Direction == ToEngine {
+		return m.Command.TransactionID()
+	}
+	if h, err := m.Header(); err == nil {
+		return h.TransactionID()
+	}
+	return ""
+}
+
+// Bytes return the message payload, without framing
+func (m *Message) Bytes() []byte {
+	if m.Direction == ToEngine {
+		return m.Command.Bytes()
+	}
+	return m.data
+}
+
+// Frame return the message as sent on the wire
+func (m *Message) Frame() []byte {
+	if m.Direction == ToEngine {
+		return dbgp.CommandLine(m.Command.Bytes())
+	}
+	return dbgp.Packet(m.data)
+}
+
+// LegacyProcessor adapt a XDebugProcessorPlugin to the Processor interface
+type LegacyProcessor struct {
+	Plugin XDebugProcessorPlugin
+}
+
+// Initialize the plugin dependencies
+func (l *LegacyProcessor) Initialize(c *config.Config, lg *logger.Logger, m *pathmapping.PathMapping) {
+	l.Plugin.Initialize(c, lg, m)
+}
+
+// Process apply the plugin mapping to the framed message
+func (l *LegacyProcessor) Process(s *Session, m *Message) ([]*Message, error) {
+	if m.Direction == ToEngine {
+		b := l.Plugin.ApplyMappingToTextProtocol(m.Frame())
+		m.Command = dbgp.ParseCommand(b)
+		return []*Message{m}, nil
+	}
+	b := l.Plugin.ApplyMappingToXML(m.Frame())
+	// strip the size prefix and the trailing NULL byte
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[i+1:]
+	}
+	m.SetData(bytes.TrimRight(b, "\x00"))
+	return []*Message{m}, nil
+}
@@ -0,0 +1,174 @@
+// Copyright 2015 Dominique Feyer <dfeyer@ttree.ch>. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package xdebugproxy
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/logger"
+
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	lastSessionID    uint64
+	processingErrors uint64
+)
+
+// firstRequestID is the first transaction id of the commands sent by the proxy, far
+// above the transaction ids used by the IDE
+const firstRequestID = 1 << 30
+
+// ResponseFunc handle the response to a command sent by the proxy, it return the
+// messages to emit, the response itself is never sent to the IDE
+type ResponseFunc func(s *Session, response *Message) ([]*Message, error)
+
+// ProcessingErrors return the number of messages processors failed to handle, for all sessions
+func ProcessingErrors() uint64 {
+	return atomic.LoadUint64(&processingErrors)
+}
+
+// Session is a debugging session between a debugger engine and an IDE
+type Session struct {
+	ID     uint64
+	Config *config.Config
+	Logger *logger.Logger
+
+	engine, ide   net.Conn
+	engineW, ideW sync.Mutex
+	mu            sync.Mutex
+	values        map[string]interface{}
+	errors        uint64
+	lastRequestID uint64
+	requests      map[string]ResponseFunc
+	init          *dbgp.Header
+}
+
+// NewSession create a session between the given connections, its logger add the
+// session id to the entries
+func NewSession(engine, ide net.Conn, c *config.Config, l *logger.Logger) *Session {
+	id := atomic.AddUint64(&lastSessionID, 1)
+	return &Session{
+		ID:       id,
+		Config:   c,
+		Logger:   l.With(logger.F("session", id)),
+		engine:   engine,
+		ide:      ide,
+		values:   map[string]interface{}{},
+		requests: map[string]ResponseFunc{},
+
+		lastRequestID: firstRequestID,
+	}
+}
+
+// EngineAddr return the address of the debugger engine
+func (s *Session) EngineAddr() net.Addr {
+	if s.engine == nil {
+		return nil
+	}
+	return s.engine.RemoteAddr()
+}
+
+// Send write a message to the engine or to the IDE, depending on its direction
+func (s *Session) Send(m *Message) (int, error) {
+	if m.Direction == ToEngine {
+		s.engineW.Lock()
+		defer s.engineW.Unlock()
+		return s.engine.Write(m.Frame())
+	}
+	s.ideW.Lock()
+	defer s.ideW.Unlock()
+	return s.ide.Write(m.Frame())
+}
+
+// ProcessingError report a message a processor failed to handle, the message is
+// passed through unmodified and the session keep running
+func (s *Session) ProcessingError(m *Message, err error) {
+	atomic.AddUint64(&s.errors, 1)
+	atomic.AddUint64(&processingErrors, 1)
+	s.Logger.Log(logger.LevelWarn, "Processing failed", logFields(m, logger.F("error", err))...)
+}
+
+// Errors return the number of messages processors failed to handle in this session
+func (s *Session) Errors() uint64 {
+	return atomic.LoadUint64(&s.errors)
+}
+
+// IDEKey return the IDE key sent by the engine in the init packet
+func (s *Session) IDEKey() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.init == nil {
+		return ""
+	}
+	return s.init.Attr("idekey")
+}
+
+// Track the protocol state of the session, the proxy call it before processors see the message
+func (s *Session) Track(m *Message) {
+	if m.Direction == ToEngine {
+		return
+	}
+	if h, err := m.Header(); err == nil && h.Element == "init" {
+		s.mu.Lock()
+		s.init = h
+		s.mu.Unlock()
+	}
+}
+
+// Request prepare a command sent by the proxy to the engine, the command get its own
+// transaction id and the response is passed to the given function, once the processor
+// chain processed it. The returned message must be emitted by the processor.
+func (s *Session) Request(c *dbgp.Command, f ResponseFunc) *Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastRequestID++
+	tid := strconv.FormatUint(s.lastRequestID, 10)
+	c.Set("i", tid)
+	s.requests[tid] = f
+	return NewCommandMessage(c)
+}
+
+// PendingRequest return and forget the function waiting for the given response, the
+// proxy call it once the response went through the processor chain
+func (s *Session) PendingRequest(m *Message) ResponseFunc {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		return nil
+	}
+	tid := m.TransactionID()
+	f := s.requests[tid]
+	delete(s.requests, tid)
+	return f
+}
+
+// Value return a value stored in the session, processors use it to keep their state
+func (s *Session) Value(key string) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.values[key]
+}
+
+// LoadOrStore return the value stored in the session, or store and return the given value
+func (s *Session) LoadOrStore(key string, value interface{}) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.values[key]; ok {
+		return v
+	}
+	s.values[key] = value
+	return value
+}
+
+// SetValue store a value in the session
+func (s *Session) SetValue(key string, value interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.values[key] = value
+}
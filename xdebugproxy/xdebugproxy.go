@@ -6,175 +6,349 @@ package xdebugproxy
 
 import (
 	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
 	"github.com/dfeyer/flow-debugproxy/logger"
-	"github.com/dfeyer/flow-debugproxy/pathmapping"
 
 	"fmt"
 	"io"
 	"net"
-	"bytes"
-	"strconv"
+	"sync/atomic"
 )
 
 const h = "%s"
 
-// XDebugProcessorPlugin process message in xDebug protocol
-type XDebugProcessorPlugin interface {
-	Initialize(c *config.Config, l *logger.Logger, m *pathmapping.PathMapping)
-	ApplyMappingToTextProtocol(message []byte) []byte
-	ApplyMappingToXML(message []byte) []byte
+// DialFunc connect to the IDE of a session, given the init packet of the engine
+type DialFunc func(init *dbgp.Header) (net.Conn, error)
+
+// Observer receive a copy of the messages exchanged with the IDE: the commands as sent by
+// the IDE and the messages as received by the IDE, it must not modify them
+type Observer interface {
+	Observe(s *Session, m *Message)
+	// Closed is called at the end of the session
+	Closed(s *Session)
+}
+
+// EngineObserver is an observer receiving also a copy of the messages exchanged with the
+// engine: the messages as sent by the engine and the commands as received by the engine,
+// including the commands of the proxy itself
+type EngineObserver interface {
+	Observer
+	ObserveEngine(s *Session, m *Message)
 }
 
 // Proxy represents a pair of connections and their state
 type Proxy struct {
-	sentBytes      uint64
-	receivedBytes  uint64
-	Raddr          *net.TCPAddr
-	Lconn, rconn   *net.TCPConn
-	PathMapper     XDebugProcessorPlugin
-	Config         *config.Config
-	Logger         *logger.Logger
-	postProcessors []XDebugProcessorPlugin
-	pipeErrors     chan error
+	sentBytes     uint64
+	receivedBytes uint64
+	Raddr         *net.TCPAddr
+	Lconn         net.Conn
+	rconn         net.Conn
+	// DialIDE connect to the IDE once the init packet of the engine is read, a TCP
+	// connection to Raddr by default
+	DialIDE    DialFunc
+	Observers  []Observer
+	Config     *config.Config
+	Logger     *logger.Logger
+	processors []Processor
+	session    *Session
+	pipeErrors chan error
+}
+
+// DialTCP connect to the IDE listening on addr
+func DialTCP(addr *net.TCPAddr) DialFunc {
+	return func(*dbgp.Header) (net.Conn, error) {
+		return net.DialTCP("tcp", nil, addr)
+	}
 }
 
 // Start the proxy
 func (p *Proxy) Start() {
 	defer p.Lconn.Close()
 
+	// read the init packet, the IDE endpoint can depend on the session
+	engine := dbgp.NewReader(p.Lconn)
+	if p.Config != nil && p.Config.MaxPacketSize > 0 {
+		engine.MaxPacketSize = p.Config.MaxPacketSize << 20
+	}
+	init, err := p.read(engine, ToIDE)
+	if err != nil {
+		p.Logger.Log(logger.LevelWarn, "Unable to read the init packet", logger.F("remote", p.Lconn.RemoteAddr()), logger.F("error", err))
+		return
+	}
+	header, err := init.Header()
+	if err != nil {
+		header = &dbgp.Header{}
+	}
+
 	// connect to remote
-	rconn, err := net.DialTCP("tcp", nil, p.Raddr)
+	dial := p.DialIDE
+	if dial == nil {
+		dial = DialTCP(p.Raddr)
+	}
+	rconn, err := dial(header)
 	if err != nil {
-		p.log(h, "Unable to connect to your IDE, please check if your editor listen to incoming connection")
-		p.log("Error message: %s", err)
-		p.log(h, "Configure your IDE and reload the web page should solve this issue")
-		p.log(h, "\nHit Ctrl-C to exit the proxy if don't need it ...")
-		p.log(h, "\nYour fellow Umpa Lumpa")
+		p.Logger.Log(logger.LevelWarn, "Unable to connect to your IDE, please check if your editor listen to incoming connection", logger.F("error", err))
+		p.Logger.Info(h, "Configure your IDE and reload the web page should solve this issue")
+		p.Logger.Info(h, "\nHit Ctrl-C to exit the proxy if don't need it ...")
+		p.Logger.Info(h, "\nYour fellow Umpa Lumpa")
 		return
 	}
 
 	p.rconn = rconn
 	defer p.rconn.Close()
 
+	p.session = NewSession(p.Lconn, p.rconn, p.Config, p.Logger)
+
 	p.pipeErrors = make(chan error)
 	defer close(p.pipeErrors)
 
 	// display both ends
-	p.log("Opened %s >>> %s", p.Lconn.RemoteAddr().String(), p.rconn.RemoteAddr().String())
+	p.session.Logger.Log(logger.LevelInfo, "Opened", logger.F("engine", p.Lconn.RemoteAddr()), logger.F("ide", p.rconn.RemoteAddr()))
 	// bidirectional copy
-	go p.pipe(p.Lconn, p.rconn)
-	go p.pipe(p.rconn, p.Lconn)
+	go p.pipe(ToIDE, engine, init)
+	go p.pipe(ToEngine, dbgp.NewReader(p.rconn), nil)
 
 	if err = <-p.pipeErrors; err != io.EOF {
-		p.Logger.Warn(h, err)
+		p.session.Logger.Log(logger.LevelWarn, "Connection failed", logger.F("error", err))
 	}
 	<-p.pipeErrors
+	for _, o := range p.Observers {
+		o.Closed(p.session)
+	}
 
-	p.log("Closed (%d bytes sent, %d bytes recieved)", p.sentBytes, p.receivedBytes)
+	p.session.Logger.Log(logger.LevelInfo, "Closed", logger.F("sent", atomic.LoadUint64(&p.sentBytes)), logger.F("received", atomic.LoadUint64(&p.receivedBytes)), logger.F("processing_errors", p.session.Errors()))
 }
 
 // RegisterPostProcessor add a new message post processor
 func (p *Proxy) RegisterPostProcessor(processor XDebugProcessorPlugin) {
-	p.postProcessors = append(p.postProcessors, processor)
+	p.RegisterProcessor(&LegacyProcessor{Plugin: processor})
 }
 
-func (p *Proxy) log(s string, args ...interface{}) {
-	if p.Config.Verbose {
-		p.Logger.Info(s, args...)
+// RegisterProcessor add a new message processor
+func (p *Proxy) RegisterProcessor(processor Processor) {
+	p.processors = append(p.processors, processor)
+}
+
+// logFields return the fields describing a message, the command and transaction id if any
+func logFields(m *Message, fields ...logger.Field) []logger.Field {
+	f := []logger.Field{logger.F("direction", m.Direction)}
+	if name := m.CommandName(); name != "" {
+		f = append(f, logger.F("command", name))
+	}
+	if tid := m.TransactionID(); tid != "" {
+		f = append(f, logger.F("transaction_id", tid))
 	}
+	return append(f, fields...)
 }
 
-func (p *Proxy) pipe(src, dst *net.TCPConn) {
-	// data direction
-	var f, h string
-	var processor XDebugProcessorPlugin
-	isFromDebugger := src == p.Lconn
-	if isFromDebugger {
-		f = "\nDebugger >>> IDE\n================"
+// logProtocol write the message at the debug level, formatted only if the level is enabled
+func (p *Proxy) logProtocol(title string, m *Message) {
+	if !p.session.Logger.Enabled(logger.LevelDebug) {
+		return
+	}
+	var b []byte
+	if m.Direction == ToIDE {
+		b = p.Logger.FormatXMLProtocol(m.Frame())
 	} else {
-		f = "\nIDE >>> Debugger\n================"
-	}
-	h = "%s"
-	// directional copy (64k buffer)
-	buff := make([]byte, 0xffff)
-	for {
-		n, err := src.Read(buff)
-		if p.handleError(err, dst) {
-			return
-		}
-		// check for incomplete data from xdebug
-		if isFromDebugger {
-			header := bytes.Split(buff, []byte{0})
-			sizeStr := string(header[0])
-			sizeLen := len(sizeStr)
-			size, err := strconv.Atoi(sizeStr)
+		b = p.Logger.FormatTextProtocol(m.Frame())
+	}
+	p.session.Logger.Log(logger.LevelDebug, title, logFields(m, logger.F("data", b))...)
+}
+
+func (p *Proxy) read(r *dbgp.Reader, d Direction) (*Message, error) {
+	if d == ToIDE {
+		data, err := r.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+		return NewXMLMessage(data), nil
+	}
+	line, err := r.ReadCommand()
+	if err != nil {
+		return nil, err
+	}
+	return NewCommandMessage(dbgp.ParseCommand(line)), nil
+}
+
+// pipe copy the messages read from r in one direction, starting with m when not nil
+func (p *Proxy) pipe(d Direction, r *dbgp.Reader, m *Message) {
+	var src, dst net.Conn = p.Lconn, p.rconn
+	if d == ToEngine {
+		src, dst = p.rconn, p.Lconn
+	}
+	for ; ; m = nil {
+		if m == nil {
+			var err error
+			m, err = p.read(r, d)
 			if p.handleError(err, dst) {
 				return
 			}
+		}
+		p.logProtocol("Raw protocol", m)
+		if d == ToEngine {
+			p.observe(m)
+		} else {
+			p.observeEngine(m)
+		}
 
-			// whole message consists of [size NULL XML(data) NULL]
-			packetLen := sizeLen + size + 2
-			// read more data if buffer has not been filled with all expected data
-			for n < packetLen {
-				n2, err := src.Read(buff[n:])
-				if p.handleError(err, dst) {
-					return
-				}
+		p.session.Track(m)
+		messages := p.process(m)
 
-				n += n2
+		// write out result
+		for _, o := range messages {
+			if o.Direction == d {
+				p.logProtocol("Processed protocol", o)
+			} else {
+				p.logProtocol("Emitted by the proxy ("+o.Direction.String()+")", o)
 			}
-		}
-		b := buff[:n]
-		p.log(h, f)
-		if p.Config.VeryVerbose {
-			if isFromDebugger {
-				p.log("Raw protocol:\n%s\n", p.Logger.Colorize(fmt.Sprintf(h, p.Logger.FormatXMLProtocol(b)), "blue"))
+			if o.Direction == ToIDE {
+				p.observe(o)
 			} else {
-				p.log("Raw protocol:\n%s\n", p.Logger.Colorize(fmt.Sprintf(h, p.Logger.FormatTextProtocol(b)), "blue"))
+				p.observeEngine(o)
 			}
-		}
-		// extract command name
-		if isFromDebugger {
-			b = p.PathMapper.ApplyMappingToXML(b)
-			// post processors
-			for _, d := range p.postProcessors {
-				processor = d
-				b = processor.ApplyMappingToXML(b)
+			n, err := p.session.Send(o)
+			if p.handleError(err, src) {
+				return
 			}
-		} else {
-			b = p.PathMapper.ApplyMappingToTextProtocol(b)
-			// post processors
-			for _, d := range p.postProcessors {
-				processor = d
-				b = processor.ApplyMappingToTextProtocol(b)
+			if o.Direction == ToIDE {
+				atomic.AddUint64(&p.sentBytes, uint64(n))
+			} else {
+				atomic.AddUint64(&p.receivedBytes, uint64(n))
 			}
 		}
+		if len(messages) == 0 {
+			p.session.Logger.Log(logger.LevelDebug, "Message dropped by the proxy", logFields(m)...)
+		}
+	}
+}
 
-		// show output
-		if p.Config.VeryVerbose {
-			if isFromDebugger {
-				p.log("Processed protocol:\n%s\n", p.Logger.Colorize(fmt.Sprintf(h, p.Logger.FormatXMLProtocol(b)), "blue"))
-			} else {
-				p.log("Processed protocol:\n%s\n", p.Logger.Colorize(fmt.Sprintf(h, p.Logger.FormatTextProtocol(b)), "blue"))
+func (p *Proxy) observe(m *Message) {
+	for _, o := range p.Observers {
+		o.Observe(p.session, m)
+	}
+}
+
+func (p *Proxy) observeEngine(m *Message) {
+	for _, o := range p.Observers {
+		if e, ok := o.(EngineObserver); ok {
+			e.ObserveEngine(p.session, m)
+		}
+	}
+}
+
+// process run the message through the processor chain, the chain is ordered from the
+// engine to the IDE: messages sent to the IDE use it forward, commands use it backward
+func (p *Proxy) process(m *Message) []*Message {
+	from := 0
+	if m.Direction == ToEngine {
+		from = len(p.processors) - 1
+	}
+	messages := p.run(m, from)
+	if m.Direction == ToIDE {
+		messages = p.dispatch(messages)
+	}
+	return messages
+}
+
+// run the message through the processors, starting at the given index, messages emitted
+// in the other direction with Chain set run through the processors between the emitter
+// and their destination, the messages they emit are sent as is
+func (p *Proxy) run(m *Message, from int) []*Message {
+	step := 1
+	if m.Direction == ToEngine {
+		step = -1
+	}
+	messages := []*Message{m}
+	for i := from; i >= 0 && i < len(p.processors); i += step {
+		var next []*Message
+		for _, o := range messages {
+			if o.Direction != m.Direction || o.final {
+				next = append(next, o)
+				continue
+			}
+			out, err := p.apply(p.processors[i], o)
+			if err != nil {
+				p.session.ProcessingError(o, err)
+			}
+			for _, e := range out {
+				if e.Direction != m.Direction && e.Chain {
+					e.Chain = false
+					next = append(next, p.sendAsIs(p.run(e, i-step), e.Direction)...)
+					continue
+				}
+				next = append(next, e)
 			}
-		} else {
-			p.log(h, "")
 		}
+		messages = next
+	}
+	return messages
+}
 
-		// write out result
-		n, err = dst.Write(b)
-		if p.handleError(err, src) {
-			return
+// sendAsIs mark the messages in the other direction as final, they must not be processed again
+func (p *Proxy) sendAsIs(messages []*Message, d Direction) []*Message {
+	for _, m := range messages {
+		if m.Direction != d {
+			m.final = true
 		}
-		if isFromDebugger {
-			p.sentBytes += uint64(n)
-		} else {
-			p.receivedBytes += uint64(n)
+	}
+	return messages
+}
+
+// dispatch the responses to the commands sent by the proxy, on failure the response is dropped
+func (p *Proxy) dispatch(messages []*Message) []*Message {
+	var out []*Message
+	for _, m := range messages {
+		var f ResponseFunc
+		if m.Direction == ToIDE {
+			f = p.session.PendingRequest(m)
+		}
+		if f == nil {
+			out = append(out, m)
+			continue
+		}
+		emitted, err := p.respond(f, m)
+		if err != nil {
+			p.session.ProcessingError(m, err)
+		}
+		for _, e := range emitted {
+			if e.Direction == ToEngine && e.Chain {
+				e.Chain = false
+				out = append(out, p.sendAsIs(p.run(e, len(p.processors)-1), ToEngine)...)
+				continue
+			}
+			out = append(out, e)
 		}
 	}
+	return out
+}
+
+func (p *Proxy) respond(f ResponseFunc, m *Message) (out []*Message, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("response handler panic: %v", r)
+		}
+		if err != nil {
+			out = nil
+		}
+	}()
+	return f(p.session, m)
 }
 
-func (p *Proxy) handleError(err error, ch *net.TCPConn) bool {
+// apply a processor, on failure the message is passed through unmodified
+func (p *Proxy) apply(processor Processor, m *Message) (out []*Message, err error) {
+	original := m.Clone()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("processor panic: %v", r)
+		}
+		if err != nil {
+			out = []*Message{original}
+		}
+	}()
+	return processor.Process(p.session, m)
+}
+
+func (p *Proxy) handleError(err error, ch net.Conn) bool {
 	if err != nil {
 		p.pipeErrors <- err
 		// make sure the other pipe will stop as well
@@ -184,4 +358,4 @@ func (p *Proxy) handleError(err error, ch *net.TCPConn) bool {
 	}
 
 	return false
-}
\ No newline at end of file
+}
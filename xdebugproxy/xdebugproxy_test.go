@@ -0,0 +1,178 @@
+package xdebugproxy
+
+import (
+	"github.com/dfeyer/flow-debugproxy/config"
+	"github.com/dfeyer/flow-debugproxy/dbgp"
+	"github.com/dfeyer/flow-debugproxy/logger"
+	"github.com/stretchr/testify/assert"
+
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+func newTestProxy(processors ...Processor) *Proxy {
+	c := &config.Config{}
+	l := &logger.Logger{Config: c}
+	p := &Proxy{Config: c, Logger: l, processors: processors}
+	p.session = NewSession(nil, nil, c, l)
+	return p
+}
+
+func TestFailingProcessorPassMessageThroughUnmodified(t *testing.T) {
+	failing := ProcessorFunc(func(s *Session, m *Message) ([]*Message, error) {
+		m.Command.Set("f", "file:///changed.php")
+		return nil, errors.New("cache file not found")
+	})
+	panicking := ProcessorFunc(func(s *Session, m *Message) ([]*Message, error) {
+		panic("unexpected")
+	})
+	p := newTestProxy(failing, panicking)
+
+	out := p.process(NewCommandMessage(dbgp.ParseCommand([]byte("source -i 2 -f file:///original.php"))))
+	assert.Len(t, out, 1)
+	assert.Equal(t, "source -i 2 -f file:///original.php", out[0].Command.String())
+	assert.Equal(t, uint64(2), p.session.Errors())
+}
+
+func TestProcessorChainOrder(t *testing.T) {
+	var calls []string
+	processor := func(name string) Processor {
+		return ProcessorFunc(func(s *Session, m *Message) ([]*Message, error) {
+			calls = append(calls, name)
+			return []*Message{m}, nil
+		})
+	}
+	p := newTestProxy(processor("engine side"), processor("ide side"))
+
+	p.process(NewXMLMessage([]byte(`<response command="status"/>`)))
+	p.process(NewCommandMessage(dbgp.ParseCommand([]byte("status -i 1"))))
+	assert.Equal(t, []string{"engine side", "ide side", "ide side", "engine side"}, calls)
+}
+
+func TestEmittedMessagesSkipTheOtherDirection(t *testing.T) {
+	reply := ProcessorFunc(func(s *Session, m *Message) ([]*Message, error) {
+		if m.Direction == ToEngine {
+			return []*Message{NewXMLMessage([]byte(`<response command="source"/>`))}, nil
+		}
+		t.Fatal("emitted message must not be processed again")
+		return nil, nil
+	})
+	p := newTestProxy(reply, reply)
+
+	out := p.process(NewCommandMessage(dbgp.ParseCommand([]byte("source -i 1"))))
+	assert.Len(t, out, 1)
+	assert.Equal(t, ToIDE, out[0].Direction)
+}
+
+func TestResponseToProxyRequestIsNotSentToTheIDE(t *testing.T) {
+	var held *Message
+	request := ProcessorFunc(func(s *Session, m *Message) ([]*Message, error) {
+		if m.CommandName() != "context_get" {
+			return []*Message{m}, nil
+		}
+		held = m
+		c := dbgp.NewCommand("eval", "")
+		c.Data = "JGE="
+		return []*Message{s.Request(c, func(s *Session, r *Message) ([]*Message, error) {
+			return []*Message{held}, nil
+		})}, nil
+	})
+	p := newTestProxy(request)
+
+	out := p.process(NewXMLMessage([]byte(`<response command="context_get" transaction_id="3"/>`)))
+	assert.Len(t, out, 1)
+	assert.Equal(t, ToEngine, out[0].Direction)
+	tid := out[0].TransactionID()
+	assert.Equal(t, "1073741825", tid)
+
+	out = p.process(NewXMLMessage([]byte(`<response command="eval" transaction_id="` + tid + `"/>`)))
+	assert.Len(t, out, 1)
+	assert.Equal(t, "3", out[0].TransactionID())
+}
+
+func TestChainedMessagesRunThroughTheProcessorsBetweenTheEmitterAndTheEngine(t *testing.T) {
+	var calls []string
+	mapper := ProcessorFunc(func(s *Session, m *Message) ([]*Message, error) {
+		calls = append(calls, "mapper "+m.CommandName())
+		return []*Message{m}, nil
+	})
+	replay := ProcessorFunc(func(s *Session, m *Message) ([]*Message, error) {
+		if m.Direction == ToEngine {
+			t.Fatal("chained message must not be processed by the emitter")
+		}
+		c := NewCommandMessage(dbgp.ParseCommand([]byte("breakpoint_set -i 1 -t line -f file:///a.php -n 2")))
+		c.Chain = true
+		return []*Message{m, c}, nil
+	})
+	ide := ProcessorFunc(func(s *Session, m *Message) ([]*Message, error) {
+		calls = append(calls, "ide "+m.CommandName())
+		return []*Message{m}, nil
+	})
+	p := newTestProxy(mapper, replay, ide)
+
+	out := p.process(NewXMLMessage([]byte(`<init idekey="PHPSTORM"/>`)))
+	assert.Len(t, out, 2)
+	assert.Equal(t, []string{"mapper ", "mapper breakpoint_set", "ide "}, calls)
+}
+
+// engineObserver keep the messages exchanged with the engine, as "direction command tid"
+type engineObserver struct {
+	mu       sync.Mutex
+	messages []string
+	closed   chan struct{}
+}
+
+func (o *engineObserver) Observe(s *Session, m *Message) {}
+
+func (o *engineObserver) ObserveEngine(s *Session, m *Message) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.messages = append(o.messages, m.Direction.String()+" "+m.CommandName()+" "+m.TransactionID())
+}
+
+func (o *engineObserver) Closed(s *Session) {
+	close(o.closed)
+}
+
+func TestEngineObserverSeeTheCommandsOfTheProxy(t *testing.T) {
+	engine, proxyEngine := net.Pipe()
+	proxyIDE, ide := net.Pipe()
+	o := &engineObserver{closed: make(chan struct{})}
+	c := &config.Config{}
+	p := &Proxy{Config: c, Logger: &logger.Logger{Config: c}, Lconn: proxyEngine, Observers: []Observer{o}}
+	p.DialIDE = func(*dbgp.Header) (net.Conn, error) {
+		return proxyIDE, nil
+	}
+	p.RegisterProcessor(ProcessorFunc(func(s *Session, m *Message) ([]*Message, error) {
+		if h, err := m.Header(); err == nil && h.Element == "init" {
+			eval := dbgp.NewCommand("eval", "")
+			eval.Data = "JGE="
+			return []*Message{m, s.Request(eval, func(s *Session, r *Message) ([]*Message, error) {
+				return nil, nil
+			})}, nil
+		}
+		return []*Message{m}, nil
+	}))
+	go p.Start()
+	go func() {
+		r := dbgp.NewReader(ide)
+		for {
+			if _, err := r.ReadPacket(); err != nil {
+				return
+			}
+		}
+	}()
+
+	engine.Write(dbgp.Packet([]byte(`<init idekey="PHPSTORM"/>`)))
+	line, err := dbgp.NewReader(engine).ReadCommand()
+	assert.NoError(t, err)
+	assert.Equal(t, "eval -i 1073741825 -- JGE=", string(line))
+	engine.Write(dbgp.Packet([]byte(`<response command="eval" transaction_id="1073741825"/>`)))
+	engine.Close()
+	<-o.closed
+
+	// the init, then the command of the proxy and its response, not sent to the IDE
+	assert.Equal(t, []string{"Debugger >>> IDE  ", "IDE >>> Debugger eval 1073741825", "Debugger >>> IDE eval 1073741825"}, o.messages)
+}